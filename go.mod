@@ -1,6 +1,6 @@
 module github.com/codemicro/railmiles
 
-go 1.22
+go 1.24
 
 require (
 	git.tdpain.net/pkg/cfger v0.1.0
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/config"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"golang.org/x/exp/slog"
+	"io"
+	"os"
+	"time"
+)
+
+func runBackup(c *core.Core, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: railmiles backup [flags]")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", fmt.Sprintf("railmiles-backup-%s.json.gz", time.Now().Format("2006-01-02")), "file to write to (- for stdout)")
+	_ = flags.Parse(args)
+
+	backup, err := c.CreateBackup()
+	if err != nil {
+		return util.Wrap(err, "creating backup")
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return util.Wrap(err, "creating backup file")
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := backup.Write(w); err != nil {
+		return util.Wrap(err, "writing backup")
+	}
+
+	slog.Info("backup created", "file", *output, "users", len(backup.Users), "journeys", len(backup.Journeys))
+	return nil
+}
+
+// runRestore is run instead of the usual startup sequence, since it needs to create the database itself.
+func runRestore(conf *config.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: railmiles restore [flags] BACKUP.json.gz")
+		flags.PrintDefaults()
+	}
+	dsn := flags.String("db", conf.Database.DSN, "database to restore into, which must be new or empty")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("exactly one backup file must be specified")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return util.Wrap(err, "opening backup file")
+	}
+	defer file.Close()
+
+	backup, err := core.ReadBackup(file)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("read backup", "created", backup.CreatedAt, "users", len(backup.Users), "journeys", len(backup.Journeys))
+
+	restoreConf := *conf
+	restoreConf.Database.DSN = *dsn
+
+	database, err := db.New(&restoreConf)
+	if err != nil {
+		return util.Wrap(err, "opening database")
+	}
+
+	if err := database.Migrate(); err != nil {
+		return util.Wrap(err, "migrating database")
+	}
+
+	c, err := core.New(&restoreConf, database)
+	if err != nil {
+		return util.Wrap(err, "initialising core")
+	}
+
+	if err := c.RestoreBackup(backup); err != nil {
+		return util.Wrap(err, "restoring backup")
+	}
+
+	slog.Info("backup restored", "db", *dsn)
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/config"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"io"
+	"os"
+)
+
+func runExport(conf *config.Config, c *core.Core, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: railmiles export [flags]")
+		flags.PrintDefaults()
+	}
+	var (
+		formatName = flags.String("format", "csv", "output format (csv, json, gpx or kml)")
+		journeyID  = flags.String("journey", "", "only export the journey with this ID")
+		username   = flags.String("user", conf.Auth.Username, "user to export journeys for")
+		period     = flags.String("period", "", "only export journeys made in this period (eg. previous-year, 2024-03 or fy2024)")
+		from       = flags.String("from", "", "only export journeys made on or after this date (YYYY-MM-DD)")
+		to         = flags.String("to", "", "only export journeys made on or before this date (YYYY-MM-DD)")
+		start      = flags.String("start", "", "deprecated alias for -from")
+		end        = flags.String("end", "", "deprecated alias for -to")
+		tz         = flags.String("tz", "", "timezone used to work out the current date for periods (defaults to UTC)")
+		output     = flags.String("o", "", "file to write to (defaults to stdout)")
+	)
+	_ = flags.Parse(args)
+
+	if *from == "" {
+		from = start
+	}
+	if *to == "" {
+		to = end
+	}
+
+	format, err := core.ParseExportFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	loc, err := core.ParseTimezone(*tz)
+	if err != nil {
+		return err
+	}
+
+	dr, err := core.ParseDateRange(*period, *from, *to, loc)
+	if err != nil {
+		return err
+	}
+
+	user, err := c.GetUserByUsername(*username)
+	if err != nil {
+		return util.Wrap(err, "fetching user")
+	}
+	if user == nil {
+		return fmt.Errorf("no such user %#v", *username)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return util.Wrap(err, "creating output file")
+		}
+		defer f.Close()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+
+	if *journeyID != "" {
+		id, err := uuid.Parse(*journeyID)
+		if err != nil {
+			return fmt.Errorf("invalid journey ID %#v", *journeyID)
+		}
+
+		journey, err := c.GetJourney(user.ID, id)
+		if err != nil {
+			return util.Wrap(err, "fetching journey")
+		}
+		if journey == nil {
+			return fmt.Errorf("no such journey %s", id)
+		}
+
+		if err := c.ExportJourney(bw, journey, format); err != nil {
+			return util.Wrap(err, "exporting journey")
+		}
+	} else if err := c.ExportJourneys(bw, user.ID, format, dr); err != nil {
+		return util.Wrap(err, "exporting journeys")
+	}
+
+	return bw.Flush()
+}
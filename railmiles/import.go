@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/config"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+func runImport(conf *config.Config, c *core.Core, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: railmiles import [flags] FILE.csv")
+		flags.PrintDefaults()
+	}
+	var (
+		dryRun   = flags.Bool("dry-run", false, "report what would be imported without saving anything")
+		username = flags.String("user", conf.Auth.Username, "user to import journeys for")
+		columns  = flags.String("columns", "", "column mapping in the form field=Column Name,... (fields: date, from, to, via, service, distance)")
+		asJSON   = flags.Bool("json", false, "print the import report as JSON")
+	)
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("exactly one CSV file must be specified")
+	}
+
+	cols, err := core.ParseImportColumns(*columns)
+	if err != nil {
+		return err
+	}
+
+	user, err := c.GetUserByUsername(*username)
+	if err != nil {
+		return util.Wrap(err, "fetching user")
+	}
+	if user == nil {
+		return fmt.Errorf("no such user %#v", *username)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return util.Wrap(err, "opening CSV file")
+	}
+	defer file.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	status := make(chan *util.SSEItem)
+	done := make(chan struct{})
+	go func() {
+		for item := range status {
+			fmt.Fprintln(os.Stderr, item.Message)
+		}
+		close(done)
+	}()
+
+	report, err := c.ImportJourneys(ctx, user.ID, file, cols, *dryRun, status)
+	close(status)
+	<-done
+	if err != nil {
+		return util.Wrap(err, "importing journeys")
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	for _, row := range report.Rows {
+		line := fmt.Sprintf("line %d: %s", row.Line, row.Status)
+		if len(row.Stations) != 0 {
+			line += fmt.Sprintf(" %s %s", row.Date.Format("2006-01-02"), strings.Join(row.Stations, "->"))
+		}
+		if row.Distance != 0 {
+			line += fmt.Sprintf(" (%.2f miles)", row.Distance)
+		}
+		if row.Message != "" {
+			line += ": " + row.Message
+		}
+		fmt.Println(line)
+	}
+
+	if report.DryRun {
+		fmt.Printf("\nDry run: %d to import, %d duplicates, %d failed\n", report.Pending, report.Duplicates, report.Failed)
+	} else {
+		fmt.Printf("\n%d imported, %d duplicates, %d failed\n", report.Imported, report.Duplicates, report.Failed)
+	}
+
+	return nil
+}
@@ -7,10 +7,14 @@ import (
 )
 
 type Config struct {
-	Debug bool
-	HTTP  struct {
+	Debug            bool
+	DistanceProvider string
+	HTTP             struct {
 		Host string
 		Port int
+		// BehindHTTPSProxy should be set if the server is only reached through a reverse proxy that serves it over
+		// HTTPS. Session cookies are then marked as secure.
+		BehindHTTPSProxy bool
 	}
 	RealTimeTrains struct {
 		Username string
@@ -19,6 +23,12 @@ type Config struct {
 	Database struct {
 		DSN string
 	}
+	Auth struct {
+		// Disabled turns off authentication entirely, so that anyone can use the API as the admin user.
+		Disabled bool
+		Username string
+		Password string
+	}
 }
 
 func (c *Config) HTTPAddress() string {
@@ -38,11 +48,23 @@ func Load() (*Config, error) {
 
 	conf.HTTP.Host = cl.WithDefault("http.host", "127.0.0.1").AsString()
 	conf.HTTP.Port = cl.WithDefault("http.port", 8080).AsInt()
+	conf.HTTP.BehindHTTPSProxy = cl.WithDefault("http.behindHTTPSProxy", false).AsBool()
 
-	conf.RealTimeTrains.Username = cl.Required("realtimetrains.username").AsString()
-	conf.RealTimeTrains.Password = cl.Required("realtimetrains.password").AsString()
+	conf.DistanceProvider = cl.WithDefault("distanceProvider", "realtimetrains").AsString()
+
+	if conf.DistanceProvider == "realtimetrains" {
+		conf.RealTimeTrains.Username = cl.Required("realtimetrains.username").AsString()
+		conf.RealTimeTrains.Password = cl.Required("realtimetrains.password").AsString()
+	} else {
+		conf.RealTimeTrains.Username = cl.WithDefault("realtimetrains.username", "").AsString()
+		conf.RealTimeTrains.Password = cl.WithDefault("realtimetrains.password", "").AsString()
+	}
 
 	conf.Database.DSN = cl.WithDefault("database.dsn", "railmiles.db").AsString()
 
+	conf.Auth.Disabled = cl.WithDefault("auth.disabled", false).AsBool()
+	conf.Auth.Username = cl.WithDefault("auth.username", "admin").AsString()
+	conf.Auth.Password = cl.WithDefault("auth.password", "").AsString()
+
 	return conf, nil
 }
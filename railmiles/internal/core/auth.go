@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const SessionLifetime = time.Hour * 24 * 30
+
+// AuthEnabled returns false if authentication has been turned off in the configuration file, in which case anyone can
+// use the API as the admin user.
+func (c *Core) AuthEnabled() bool {
+	return !c.config.Auth.Disabled
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateSession creates a new login session for a user and returns the token that identifies it.
+func (c *Core) CreateSession(userID uuid.UUID) (string, time.Time, error) {
+	if _, err := c.db.DB.NewDelete().Model((*db.Session)(nil)).Where("expires_at < ?", time.Now().UTC()).Exec(context.Background()); err != nil {
+		return "", time.Time{}, err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now().UTC()
+	session := &db.Session{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(SessionLifetime),
+	}
+
+	if _, err := c.db.DB.NewInsert().Model(session).Exec(context.Background()); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, session.ExpiresAt, nil
+}
+
+// ValidateSession returns the user that a session token belongs to, or nil if the session is invalid or has expired.
+func (c *Core) ValidateSession(token string) (*db.User, error) {
+	session := new(db.Session)
+	err := c.db.DB.NewSelect().
+		Model(session).
+		Where("token_hash = ?", hashToken(token)).
+		Where("expires_at > ?", time.Now().UTC()).
+		Scan(context.Background())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c.GetUser(session.UserID)
+}
+
+func (c *Core) DeleteSession(token string) error {
+	_, err := c.db.DB.NewDelete().Model((*db.Session)(nil)).Where("token_hash = ?", hashToken(token)).Exec(context.Background())
+	return err
+}
+
+// CreateAPIToken creates a new named API token for a user. The token itself is only ever returned from this function.
+func (c *Core) CreateAPIToken(userID uuid.UUID, name string) (*db.APIToken, string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiToken := &db.APIToken{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashToken(token),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if _, err := c.db.DB.NewInsert().Model(apiToken).Exec(context.Background()); err != nil {
+		return nil, "", err
+	}
+
+	return apiToken, token, nil
+}
+
+func (c *Core) GetAPITokens(userID uuid.UUID) ([]*db.APIToken, error) {
+	var tokens []*db.APIToken
+	err := c.db.DB.NewSelect().Model(&tokens).Where("user_id = ?", userID).Order("created_at").Scan(context.Background())
+	return tokens, err
+}
+
+var ErrTokenNotFound = errors.New("token not found")
+
+func (c *Core) DeleteAPIToken(userID, id uuid.UUID) error {
+	res, err := c.db.DB.NewDelete().Model((*db.APIToken)(nil)).Where("id = ?", id).Where("user_id = ?", userID).Exec(context.Background())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// ValidateAPIToken returns the user that an API token belongs to, or nil if the token is invalid. The token is recorded
+// as having been used.
+func (c *Core) ValidateAPIToken(token string) (*db.User, error) {
+	apiToken := new(db.APIToken)
+	err := c.db.DB.NewSelect().Model(apiToken).Where("token_hash = ?", hashToken(token)).Scan(context.Background())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	apiToken.LastUsedAt = &now
+	if _, err := c.db.DB.NewUpdate().Model(apiToken).Column("last_used_at").WherePK().Exec(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return c.GetUser(apiToken.UserID)
+}
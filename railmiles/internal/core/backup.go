@@ -0,0 +1,676 @@
+package core
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+	"io"
+	"strings"
+	"time"
+)
+
+// BackupFormatVersion is incremented whenever the structure of a Backup changes. Backups with a newer format version
+// than this cannot be restored.
+//
+// Version 2 added stations and station aliases. Version 3 added legs. Version 4 added claims. Version 5 added tickets.
+// Version 6 added whether distances were inferred. Version 7 added planned arrival times. Version 8 added the service
+// details of cached leg distances.
+const BackupFormatVersion = 8
+
+// Backup is a complete copy of everything in the database that can't be recreated. Sessions, jobs, their events and
+// their uploads are not included.
+//
+// The records in a backup use their own types instead of the database models so that the format doesn't change when
+// a model does.
+type Backup struct {
+	FormatVersion      int       `json:"formatVersion"`
+	CreatedAt          time.Time `json:"createdAt"`
+	StationDataVersion string    `json:"stationDataVersion"`
+	Migrations         []string  `json:"migrations"`
+
+	Users     []*backupUser          `json:"users"`
+	APITokens []*backupAPIToken      `json:"apiTokens"`
+	Journeys  []*backupJourney       `json:"journeys"`
+	Routes    []*backupRoute         `json:"routes"`
+	Legs      []*backupLeg           `json:"legs"`
+	Claims    []*backupClaim         `json:"claims"`
+	Tickets   []*backupTicket        `json:"tickets"`
+	LegCache  []*backupLegCacheEntry `json:"legCache"`
+	// Stations only contains stations that have been added or changed by an admin, since the rest come from the
+	// station seed data.
+	Stations       []*backupStation      `json:"stations"`
+	StationAliases []*backupStationAlias `json:"stationAliases"`
+}
+
+type backupUser struct {
+	ID             uuid.UUID `json:"id"`
+	Username       string    `json:"username"`
+	PasswordHash   string    `json:"passwordHash"`
+	IsAdmin        bool      `json:"isAdmin"`
+	ShareTokenHash *string   `json:"shareTokenHash"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+type backupAPIToken struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"userID"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"tokenHash"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type backupJourney struct {
+	ID       uuid.UUID  `json:"id"`
+	UserID   uuid.UUID  `json:"userID"`
+	From     string     `json:"from"`
+	To       string     `json:"to"`
+	Via      []string   `json:"via"`
+	Distance float32    `json:"distance"`
+	Date     time.Time  `json:"date"`
+	ReturnID *uuid.UUID `json:"returnID"`
+	// ManualDistance is missing from backups made before it was added, in which case it is worked out from whether
+	// the journey has any calling points.
+	ManualDistance   *bool      `json:"manualDistance,omitempty"`
+	InferredDistance bool       `json:"inferredDistance,omitempty"`
+	TicketID         *uuid.UUID `json:"ticketID,omitempty"`
+	// PlannedArrival is missing from backups before version 7, in which case it is taken from the last leg.
+	PlannedArrival *time.Time `json:"plannedArrival,omitempty"`
+}
+
+type backupRoute struct {
+	JourneyID uuid.UUID `json:"journeyID"`
+	UserID    uuid.UUID `json:"userID"`
+	Sequence  int       `json:"sequence"`
+	Station   string    `json:"station"`
+}
+
+type backupLeg struct {
+	JourneyID          uuid.UUID  `json:"journeyID"`
+	UserID             uuid.UUID  `json:"userID"`
+	Sequence           int        `json:"sequence"`
+	From               string     `json:"from"`
+	To                 string     `json:"to"`
+	Distance           float32    `json:"distance"`
+	Inferred           bool       `json:"inferred,omitempty"`
+	CallingPoints      []string   `json:"callingPoints"`
+	ServiceUID         string     `json:"serviceUID"`
+	Operator           string     `json:"operator"`
+	Headcode           string     `json:"headcode"`
+	ScheduledDeparture *time.Time `json:"scheduledDeparture"`
+	ActualDeparture    *time.Time `json:"actualDeparture"`
+	ScheduledArrival   *time.Time `json:"scheduledArrival"`
+	ActualArrival      *time.Time `json:"actualArrival"`
+}
+
+type backupClaim struct {
+	JourneyID uuid.UUID `json:"journeyID"`
+	UserID    uuid.UUID `json:"userID"`
+	Status    string    `json:"status"`
+	Amount    int       `json:"amount"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type backupTicket struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"userID"`
+	Fare      int       `json:"fare"`
+	Type      string    `json:"type"`
+	Railcard  string    `json:"railcard"`
+	Reference string    `json:"reference"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type backupLegCacheEntry struct {
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	CallingPoints string    `json:"callingPoints"`
+	Distance      float32   `json:"distance"`
+	Hits          int       `json:"hits"`
+	ServiceUID    string    `json:"serviceUID"`
+	Operator      string    `json:"operator"`
+	Headcode      string    `json:"headcode"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type backupStation struct {
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Lat       float32   `json:"lat"`
+	Lon       float32   `json:"lon"`
+	Country   string    `json:"country"`
+	Region    string    `json:"region"`
+	County    string    `json:"county"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type backupStationAlias struct {
+	Alias string `json:"alias"`
+	Code  string `json:"code"`
+}
+
+// CreateBackup reads the entire contents of the database into a Backup.
+func (c *Core) CreateBackup() (*Backup, error) {
+	migrations, err := c.db.AppliedMigrations()
+	if err != nil {
+		return nil, util.Wrap(err, "fetching applied migrations")
+	}
+
+	var (
+		users     []*db.User
+		apiTokens []*db.APIToken
+		journeys  []*db.Journey
+		routes    []*db.Route
+		legs      []*db.Leg
+		claims    []*db.Claim
+		tickets   []*db.Ticket
+		legCache  []*db.LegCacheEntry
+		stations  []*db.Station
+		aliases   []*db.StationAlias
+	)
+
+	// Reading everything inside one transaction means that the backup is consistent even if something is written
+	// part way through.
+	err = c.inTx(func(tx bun.Tx) error {
+		ctx := context.Background()
+		if err := tx.NewSelect().Model(&users).Order("created_at").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching users")
+		}
+		if err := tx.NewSelect().Model(&apiTokens).Order("created_at").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching API tokens")
+		}
+		if err := tx.NewSelect().Model(&journeys).Order("date", "id").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching journeys")
+		}
+		if err := tx.NewSelect().Model(&routes).Order("journey_id", "sequence").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching routes")
+		}
+		if err := tx.NewSelect().Model(&legs).Order("journey_id", "sequence").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching legs")
+		}
+		if err := tx.NewSelect().Model(&claims).Order("journey_id").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching claims")
+		}
+		if err := tx.NewSelect().Model(&tickets).Order("id").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching tickets")
+		}
+		if err := tx.NewSelect().Model(&legCache).Order("from", "to", "calling_points").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching leg cache")
+		}
+		if err := tx.NewSelect().Model(&stations).Where("custom = true").Order("code").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching stations")
+		}
+		if err := tx.NewSelect().Model(&aliases).Order("alias").Scan(ctx); err != nil {
+			return util.Wrap(err, "fetching station aliases")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stationShortcode := func(x *db.StationName) string {
+		return x.Shortcode
+	}
+
+	return &Backup{
+		FormatVersion:      BackupFormatVersion,
+		CreatedAt:          time.Now().UTC(),
+		StationDataVersion: StationDataVersion(),
+		Migrations:         migrations,
+		Users: util.Map(users, func(x *db.User) *backupUser {
+			return &backupUser{
+				ID:             x.ID,
+				Username:       x.Username,
+				PasswordHash:   x.PasswordHash,
+				IsAdmin:        x.IsAdmin,
+				ShareTokenHash: x.ShareTokenHash,
+				CreatedAt:      x.CreatedAt,
+			}
+		}),
+		APITokens: util.Map(apiTokens, func(x *db.APIToken) *backupAPIToken {
+			return &backupAPIToken{
+				ID:         x.ID,
+				UserID:     x.UserID,
+				Name:       x.Name,
+				TokenHash:  x.TokenHash,
+				CreatedAt:  x.CreatedAt,
+				LastUsedAt: x.LastUsedAt,
+			}
+		}),
+		Journeys: util.Map(journeys, func(x *db.Journey) *backupJourney {
+			return &backupJourney{
+				ID:               x.ID,
+				UserID:           x.UserID,
+				From:             x.From.Shortcode,
+				To:               x.To.Shortcode,
+				Via:              util.Map(x.Via, stationShortcode),
+				Distance:         x.Distance,
+				Date:             x.Date,
+				ReturnID:         x.ReturnID,
+				ManualDistance:   &x.ManualDistance,
+				InferredDistance: x.InferredDistance,
+				TicketID:         x.TicketID,
+				PlannedArrival:   x.PlannedArrival,
+			}
+		}),
+		Routes: util.Map(routes, func(x *db.Route) *backupRoute {
+			return &backupRoute{
+				JourneyID: x.JourneyID,
+				UserID:    x.UserID,
+				Sequence:  x.Sequence,
+				Station:   x.Station,
+			}
+		}),
+		Legs: util.Map(legs, func(x *db.Leg) *backupLeg {
+			return &backupLeg{
+				JourneyID:          x.JourneyID,
+				UserID:             x.UserID,
+				Sequence:           x.Sequence,
+				From:               x.From,
+				To:                 x.To,
+				Distance:           x.Distance,
+				Inferred:           x.Inferred,
+				CallingPoints:      x.CallingPoints,
+				ServiceUID:         x.ServiceUID,
+				Operator:           x.Operator,
+				Headcode:           x.Headcode,
+				ScheduledDeparture: x.ScheduledDeparture,
+				ActualDeparture:    x.ActualDeparture,
+				ScheduledArrival:   x.ScheduledArrival,
+				ActualArrival:      x.ActualArrival,
+			}
+		}),
+		Claims: util.Map(claims, func(x *db.Claim) *backupClaim {
+			return &backupClaim{
+				JourneyID: x.JourneyID,
+				UserID:    x.UserID,
+				Status:    string(x.Status),
+				Amount:    x.Amount,
+				UpdatedAt: x.UpdatedAt,
+			}
+		}),
+		Tickets: util.Map(tickets, func(x *db.Ticket) *backupTicket {
+			return &backupTicket{
+				ID:        x.ID,
+				UserID:    x.UserID,
+				Fare:      x.Fare,
+				Type:      x.Type,
+				Railcard:  x.Railcard,
+				Reference: x.Reference,
+				UpdatedAt: x.UpdatedAt,
+			}
+		}),
+		LegCache: util.Map(legCache, func(x *db.LegCacheEntry) *backupLegCacheEntry {
+			return &backupLegCacheEntry{
+				From:          x.From,
+				To:            x.To,
+				CallingPoints: x.CallingPoints,
+				Distance:      x.Distance,
+				Hits:          x.Hits,
+				ServiceUID:    x.ServiceUID,
+				Operator:      x.Operator,
+				Headcode:      x.Headcode,
+				UpdatedAt:     x.UpdatedAt,
+			}
+		}),
+		Stations: util.Map(stations, func(x *db.Station) *backupStation {
+			return &backupStation{
+				Code:      x.Code,
+				Name:      x.Name,
+				Lat:       x.Lat,
+				Lon:       x.Lon,
+				Country:   x.Country,
+				Region:    x.Region,
+				County:    x.County,
+				UpdatedAt: x.UpdatedAt,
+			}
+		}),
+		StationAliases: util.Map(aliases, func(x *db.StationAlias) *backupStationAlias {
+			return &backupStationAlias{Alias: x.Alias, Code: x.Code}
+		}),
+	}, nil
+}
+
+// Write writes a gzip-compressed JSON copy of the backup to w.
+func (b *Backup) Write(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	if err := json.NewEncoder(gw).Encode(b); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// ReadBackup reads a backup created by (*Backup).Write.
+func ReadBackup(r io.Reader) (*Backup, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backup: %w", err)
+	}
+	defer gr.Close()
+
+	b := new(Backup)
+	if err := json.NewDecoder(gr).Decode(b); err != nil {
+		return nil, fmt.Errorf("unable to read backup: %w", err)
+	}
+
+	if b.FormatVersion < 1 || b.FormatVersion > BackupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version %d (this version of railmiles supports up to %d)", b.FormatVersion, BackupFormatVersion)
+	}
+
+	if b.FormatVersion < 7 {
+		lastLegs := make(map[uuid.UUID]*backupLeg)
+		for _, leg := range b.Legs {
+			if last := lastLegs[leg.JourneyID]; last == nil || leg.Sequence > last.Sequence {
+				lastLegs[leg.JourneyID] = leg
+			}
+		}
+		for _, journey := range b.Journeys {
+			if leg := lastLegs[journey.ID]; leg != nil {
+				journey.PlannedArrival = leg.ScheduledArrival
+			}
+		}
+	}
+
+	return b, nil
+}
+
+// RestoreBackup copies the contents of a backup into the database, which must already be migrated and must not
+// contain any users or journeys. Nothing is saved unless every record is inserted successfully and the restored data
+// passes the checks in checkIntegrity.
+func (c *Core) RestoreBackup(b *Backup) error {
+	known := db.KnownMigrations()
+	for _, name := range b.Migrations {
+		if !slices.Contains(known, name) {
+			return fmt.Errorf("backup was made by a newer version of railmiles (unknown migration %s)", name)
+		}
+	}
+
+	if b.StationDataVersion != StationDataVersion() {
+		slog.Warn("backup was made with a different station dataset", "backup", b.StationDataVersion, "current", StationDataVersion())
+	}
+
+	err := c.inTx(func(tx bun.Tx) error {
+		ctx := context.Background()
+
+		var n int
+		if err := tx.NewRaw(`SELECT (SELECT count(*) FROM "railmiles_users") + (SELECT count(*) FROM "railmiles_journeys_v2")`).Scan(ctx, &n); err != nil {
+			return util.Wrap(err, "checking database is empty")
+		}
+		if n != 0 {
+			return errors.New("database is not empty (backups can only be restored into a new database)")
+		}
+
+		err := insertInChunks(tx, util.Map(b.Users, func(x *backupUser) *db.User {
+			return &db.User{
+				ID:             x.ID,
+				Username:       x.Username,
+				PasswordHash:   x.PasswordHash,
+				IsAdmin:        x.IsAdmin,
+				ShareTokenHash: x.ShareTokenHash,
+				CreatedAt:      x.CreatedAt,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring users")
+		}
+
+		err = insertInChunks(tx, util.Map(b.APITokens, func(x *backupAPIToken) *db.APIToken {
+			return &db.APIToken{
+				ID:         x.ID,
+				UserID:     x.UserID,
+				Name:       x.Name,
+				TokenHash:  x.TokenHash,
+				CreatedAt:  x.CreatedAt,
+				LastUsedAt: x.LastUsedAt,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring API tokens")
+		}
+
+		stationName := func(x string) *db.StationName {
+			return &db.StationName{Shortcode: x}
+		}
+
+		hasRoute := make(map[uuid.UUID]bool)
+		for _, route := range b.Routes {
+			hasRoute[route.JourneyID] = true
+		}
+
+		err = insertInChunks(tx, util.Map(b.Journeys, func(x *backupJourney) *db.Journey {
+			manualDistance := !hasRoute[x.ID]
+			if x.ManualDistance != nil {
+				manualDistance = *x.ManualDistance
+			}
+			return &db.Journey{
+				ID:               x.ID,
+				UserID:           x.UserID,
+				From:             stationName(x.From),
+				To:               stationName(x.To),
+				Via:              util.Map(x.Via, stationName),
+				Distance:         x.Distance,
+				Date:             x.Date,
+				ReturnID:         x.ReturnID,
+				ManualDistance:   manualDistance,
+				InferredDistance: x.InferredDistance,
+				TicketID:         x.TicketID,
+				PlannedArrival:   x.PlannedArrival,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring journeys")
+		}
+
+		err = insertInChunks(tx, util.Map(b.Routes, func(x *backupRoute) *db.Route {
+			return &db.Route{
+				JourneyID: x.JourneyID,
+				UserID:    x.UserID,
+				Sequence:  x.Sequence,
+				Station:   x.Station,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring routes")
+		}
+
+		err = insertInChunks(tx, util.Map(b.Legs, func(x *backupLeg) *db.Leg {
+			return &db.Leg{
+				JourneyID:          x.JourneyID,
+				UserID:             x.UserID,
+				Sequence:           x.Sequence,
+				From:               x.From,
+				To:                 x.To,
+				Distance:           x.Distance,
+				Inferred:           x.Inferred,
+				CallingPoints:      x.CallingPoints,
+				ServiceUID:         x.ServiceUID,
+				Operator:           x.Operator,
+				Headcode:           x.Headcode,
+				ScheduledDeparture: x.ScheduledDeparture,
+				ActualDeparture:    x.ActualDeparture,
+				ScheduledArrival:   x.ScheduledArrival,
+				ActualArrival:      x.ActualArrival,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring legs")
+		}
+
+		err = insertInChunks(tx, util.Map(b.Claims, func(x *backupClaim) *db.Claim {
+			return &db.Claim{
+				JourneyID: x.JourneyID,
+				UserID:    x.UserID,
+				Status:    db.ClaimStatus(x.Status),
+				Amount:    x.Amount,
+				UpdatedAt: x.UpdatedAt,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring claims")
+		}
+
+		err = insertInChunks(tx, util.Map(b.Tickets, func(x *backupTicket) *db.Ticket {
+			return &db.Ticket{
+				ID:        x.ID,
+				UserID:    x.UserID,
+				Fare:      x.Fare,
+				Type:      x.Type,
+				Railcard:  x.Railcard,
+				Reference: x.Reference,
+				UpdatedAt: x.UpdatedAt,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring tickets")
+		}
+
+		err = insertInChunks(tx, util.Map(b.LegCache, func(x *backupLegCacheEntry) *db.LegCacheEntry {
+			return &db.LegCacheEntry{
+				From:          x.From,
+				To:            x.To,
+				CallingPoints: x.CallingPoints,
+				Distance:      x.Distance,
+				Hits:          x.Hits,
+				ServiceUID:    x.ServiceUID,
+				Operator:      x.Operator,
+				Headcode:      x.Headcode,
+				UpdatedAt:     x.UpdatedAt,
+			}
+		}))
+		if err != nil {
+			return util.Wrap(err, "restoring leg cache")
+		}
+
+		// The stations table has already been filled with the seed data, so stations from the backup replace
+		// whatever is there. Backups made before stations were included don't have any to restore.
+		if len(b.Stations) != 0 {
+			stations := util.Map(b.Stations, func(x *backupStation) *db.Station {
+				return &db.Station{
+					Code:      x.Code,
+					Name:      x.Name,
+					Lat:       x.Lat,
+					Lon:       x.Lon,
+					Country:   x.Country,
+					Region:    x.Region,
+					County:    x.County,
+					Custom:    true,
+					UpdatedAt: x.UpdatedAt,
+				}
+			})
+			if _, err := tx.NewInsert().Model(&stations).On("CONFLICT (code) DO UPDATE").Exec(ctx); err != nil {
+				return util.Wrap(err, "restoring stations")
+			}
+		}
+
+		if b.StationAliases != nil {
+			if _, err := tx.NewDelete().Model((*db.StationAlias)(nil)).Where("1 = 1").Exec(ctx); err != nil {
+				return util.Wrap(err, "removing existing station aliases")
+			}
+			err = insertInChunks(tx, util.Map(b.StationAliases, func(x *backupStationAlias) *db.StationAlias {
+				return &db.StationAlias{Alias: x.Alias, Code: x.Code}
+			}))
+			if err != nil {
+				return util.Wrap(err, "restoring station aliases")
+			}
+		}
+
+		// Backups made before legs were added don't have any, so they're worked out from the journeys instead. This
+		// is done after the stations are restored so that custom stations can be located.
+		if err := db.SplitJourneysIntoLegs(ctx, tx); err != nil {
+			return util.Wrap(err, "splitting journeys into legs")
+		}
+
+		return checkIntegrity(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.loadStations()
+}
+
+// insertInChunks inserts rows in batches small enough to stay under SQLite's limit on the number of parameters in a
+// single query.
+func insertInChunks[T any](idb bun.IDB, rows []T) error {
+	const chunkSize = 500
+	for i := 0; i < len(rows); i += chunkSize {
+		chunk := rows[i:min(i+chunkSize, len(rows))]
+		if _, err := idb.NewInsert().Model(&chunk).Exec(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIntegrity makes sure that every return journey, route, leg and claim refers to a journey that exists and belongs
+// to the same user, that return journeys link to each other, and that every ticket used by a journey exists.
+func checkIntegrity(idb bun.IDB) error {
+	checks := []struct {
+		query   string
+		message string
+	}{
+		{
+			`SELECT j."id" FROM "railmiles_journeys_v2" j LEFT JOIN "railmiles_users" u ON u."id" = j."user_id" WHERE u."id" IS NULL`,
+			"journey %s belongs to a user that does not exist",
+		},
+		{
+			`SELECT j."id" FROM "railmiles_journeys_v2" j LEFT JOIN "railmiles_journeys_v2" r ON r."id" = j."return_id" AND r."user_id" = j."user_id" WHERE j."return_id" IS NOT NULL AND r."id" IS NULL`,
+			"journey %s has a return journey that does not exist",
+		},
+		{
+			`SELECT j."id" FROM "railmiles_journeys_v2" j JOIN "railmiles_journeys_v2" r ON r."id" = j."return_id" WHERE r."return_id" IS NULL OR r."return_id" != j."id"`,
+			"journey %s has a return journey that does not link back to it",
+		},
+		{
+			`SELECT DISTINCT r."journey_id" FROM "railmiles_routes_v3" r LEFT JOIN "railmiles_journeys_v2" j ON j."id" = r."journey_id" AND j."user_id" = r."user_id" WHERE j."id" IS NULL`,
+			"route for journey %s does not have a matching journey",
+		},
+		{
+			`SELECT DISTINCT l."journey_id" FROM "railmiles_legs" l LEFT JOIN "railmiles_journeys_v2" j ON j."id" = l."journey_id" AND j."user_id" = l."user_id" WHERE j."id" IS NULL`,
+			"legs for journey %s do not have a matching journey",
+		},
+		{
+			`SELECT c."journey_id" FROM "railmiles_claims" c LEFT JOIN "railmiles_journeys_v2" j ON j."id" = c."journey_id" AND j."user_id" = c."user_id" WHERE j."id" IS NULL`,
+			"claim for journey %s does not have a matching journey",
+		},
+		{
+			`SELECT j."id" FROM "railmiles_journeys_v2" j LEFT JOIN "railmiles_tickets" t ON t."id" = j."ticket_id" AND t."user_id" = j."user_id" WHERE j."ticket_id" IS NOT NULL AND t."id" IS NULL`,
+			"journey %s refers to a ticket that does not exist",
+		},
+		{
+			`SELECT t."id" FROM "railmiles_api_tokens" t LEFT JOIN "railmiles_users" u ON u."id" = t."user_id" WHERE u."id" IS NULL`,
+			"API token %s belongs to a user that does not exist",
+		},
+	}
+
+	const maxProblems = 10
+
+	var problems []string
+	for _, check := range checks {
+		var ids []string
+		if err := idb.NewRaw(check.query).Scan(context.Background(), &ids); err != nil {
+			return util.Wrap(err, "checking integrity")
+		}
+		for _, id := range ids {
+			problems = append(problems, fmt.Sprintf(check.message, id))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if len(problems) > maxProblems {
+		problems = append(problems[:maxProblems], fmt.Sprintf("and %d more problems", len(problems)-maxProblems))
+	}
+	return fmt.Errorf("backup failed integrity checks: %s", strings.Join(problems, "; "))
+}
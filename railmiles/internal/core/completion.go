@@ -0,0 +1,145 @@
+package core
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+	"strings"
+)
+
+// CompletionGroup counts how many of the stations in an area a user has been to. A station is visited if a journey
+// called at or passed through it.
+type CompletionGroup struct {
+	Name     string `json:"name"`
+	Country  string `json:"country,omitempty"`
+	Total    int    `json:"total"`
+	Visited  int    `json:"visited"`
+	CalledAt int    `json:"calledAt"`
+}
+
+func (cg *CompletionGroup) add(visited, calledAt bool) {
+	cg.Total += 1
+	if visited {
+		cg.Visited += 1
+	}
+	if calledAt {
+		cg.CalledAt += 1
+	}
+}
+
+// StationCompletion is the proportion of stations a user has visited, overall and split by country and by region.
+// Stations that don't have a country or region in the station data only count towards the overall total.
+type StationCompletion struct {
+	Overall   *CompletionGroup   `json:"overall"`
+	Countries []*CompletionGroup `json:"countries"`
+	Regions   []*CompletionGroup `json:"regions"`
+}
+
+// GetStationCompletion works out how many of the stations in the station dataset a user has visited.
+func (c *Core) GetStationCompletion(userID uuid.UUID) (*StationCompletion, error) {
+	stats, err := c.GetStationStats(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	visits := make(map[string]*StationStats)
+	for _, ss := range stats {
+		visits[ss.Shortcode] = ss
+	}
+
+	var (
+		res       = &StationCompletion{Overall: &CompletionGroup{Name: "All stations"}}
+		countries = make(map[string]*CompletionGroup)
+		regions   = make(map[[2]string]*CompletionGroup)
+	)
+
+	for code, details := range allStations() {
+		var visited, calledAt bool
+		if ss, found := visits[code]; found {
+			visited = true
+			calledAt = ss.CalledAt != 0
+		}
+
+		res.Overall.add(visited, calledAt)
+
+		if details.Country != "" {
+			group, found := countries[details.Country]
+			if !found {
+				group = &CompletionGroup{Name: details.Country}
+				countries[details.Country] = group
+			}
+			group.add(visited, calledAt)
+		}
+
+		if details.Region != "" {
+			key := [2]string{details.Country, details.Region}
+			group, found := regions[key]
+			if !found {
+				group = &CompletionGroup{Name: details.Region, Country: details.Country}
+				regions[key] = group
+			}
+			group.add(visited, calledAt)
+		}
+	}
+
+	for _, group := range countries {
+		res.Countries = append(res.Countries, group)
+	}
+	for _, group := range regions {
+		res.Regions = append(res.Regions, group)
+	}
+
+	byName := func(a, b *CompletionGroup) int {
+		if x := strings.Compare(a.Country, b.Country); x != 0 {
+			return x
+		}
+		return strings.Compare(a.Name, b.Name)
+	}
+	slices.SortFunc(res.Countries, byName)
+	slices.SortFunc(res.Regions, byName)
+
+	return res, nil
+}
+
+// UnvisitedStationsGeoJSON returns every station in the station dataset that a user hasn't visited as a GeoJSON
+// feature collection of points.
+func (c *Core) UnvisitedStationsGeoJSON(userID uuid.UUID) (string, error) {
+	stats, err := c.GetStationStats(userID)
+	if err != nil {
+		return "", err
+	}
+
+	visited := make(map[string]bool)
+	for _, ss := range stats {
+		visited[ss.Shortcode] = true
+	}
+
+	stations := allStations()
+	codes := make([]string, 0, len(stations))
+	for code := range stations {
+		if !visited[code] {
+			codes = append(codes, code)
+		}
+	}
+	slices.Sort(codes)
+
+	features := make([]any, 0, len(codes))
+	for _, code := range codes {
+		details := stations[code]
+		props := map[string]any{"name": code + " " + details.Name, "type": "unvisited"}
+		if details.Region != "" {
+			props["region"] = details.Region
+		}
+		features = append(features, map[string]any{
+			"type":       "Feature",
+			"properties": props,
+			"geometry":   map[string]any{"type": "Point", "coordinates": []float32{details.Lon, details.Lat}},
+		})
+	}
+
+	o, err := json.Marshal(map[string]any{"type": "FeatureCollection", "features": features})
+	if err != nil {
+		return "", err
+	}
+	return string(o), nil
+}
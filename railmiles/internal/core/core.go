@@ -1,52 +1,60 @@
 package core
 
 import (
-	_ "embed"
-	"encoding/json"
+	"context"
 	"github.com/codemicro/railmiles/railmiles/internal/config"
 	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
 )
 
 type Core struct {
 	config *config.Config
 	db     *db.DB
+
+	distanceProvider DistanceProvider
+	jobs             *jobRunner
 }
 
-func New(conf *config.Config, database *db.DB) *Core {
-	return &Core{
+func New(conf *config.Config, database *db.DB) (*Core, error) {
+	dp, err := newDistanceProvider(conf)
+	if err != nil {
+		return nil, util.Wrap(err, "creating distance provider")
+	}
+
+	c := &Core{
 		config: conf,
 		db:     database,
+
+		distanceProvider: dp,
+		jobs:             newJobRunner(),
 	}
-}
 
-//go:embed stationData.json
-var stationDataRaw []byte
+	// Any changes to the station data included in this build need copying into the database.
+	if err := c.inTx(func(tx bun.Tx) error { return db.SeedStations(context.Background(), tx) }); err != nil {
+		return nil, util.Wrap(err, "seeding stations")
+	}
 
-type StationDetail struct {
-	Name string
-	Lat  float32
-	Lon  float32
-}
+	if err := c.loadStations(); err != nil {
+		return nil, util.Wrap(err, "loading stations")
+	}
 
-var (
-	stationData map[string]*StationDetail
-)
+	if err := loadCoastline(); err != nil {
+		return nil, util.Wrap(err, "loading coastline")
+	}
 
-func init() {
-	_ = json.Unmarshal(stationDataRaw, &stationData)
+	return c, nil
 }
 
-func GetStationName(short string) string {
-	x := short
-	if ff, found := stationData[short]; found {
-		x = ff.Name
-	}
-	return x
+// inTx runs fn inside a database transaction, which is committed if fn returns nil and rolled back otherwise. Since
+// the database only has one connection, fn must only use tx to make queries.
+func (c *Core) inTx(fn func(tx bun.Tx) error) error {
+	return c.db.DB.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		return fn(tx)
+	})
 }
 
-func GetStationDetail(short string) *StationDetail {
-	if x, found := stationData[short]; found {
-		return x
-	}
-	return nil
+// SetDistanceProvider replaces the DistanceProvider chosen by the configuration file.
+func (c *Core) SetDistanceProvider(dp DistanceProvider) {
+	c.distanceProvider = dp
 }
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateRange limits journeys to those that occurred at or after Start and before End. Either may be zero to leave that
+// end of the range open.
+//
+// Journey dates are calendar dates stored as midnight UTC, so the bounds of a DateRange are also midnight UTC.
+type DateRange struct {
+	Start time.Time `json:"start,omitzero"`
+	End   time.Time `json:"end,omitzero"`
+}
+
+func (dr DateRange) IsZero() bool {
+	return dr.Start.IsZero() && dr.End.IsZero()
+}
+
+// Period is a named range of dates. As well as the constants below, a year ("2024"), a calendar month ("2024-03") or
+// a rail financial year ("fy2024", running from 1 April 2024 to 31 March 2025) may be used.
+type Period string
+
+const (
+	AllTime               Period = "all-time"
+	LastMonth             Period = "last-month"
+	YearToDate            Period = "year-to-date"
+	PreviousYear          Period = "previous-year"
+	FinancialYear         Period = "financial-year"
+	PreviousFinancialYear Period = "previous-financial-year"
+)
+
+var (
+	periodYearRegexp          = regexp.MustCompile(`^\d{4}$`)
+	periodMonthRegexp         = regexp.MustCompile(`^\d{4}-\d{2}$`)
+	periodFinancialYearRegexp = regexp.MustCompile(`^fy(\d{4})$`)
+)
+
+// date returns midnight UTC on the given calendar date.
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// financialYearStart returns the first day of the rail financial year that d falls in. Financial years start on the
+// 1st of April.
+func financialYearStart(d time.Time) time.Time {
+	year := d.Year()
+	if d.Month() < time.April {
+		year -= 1
+	}
+	return date(year, time.April, 1)
+}
+
+// Today returns the current date in loc as midnight UTC, for comparison against journey dates.
+func Today(loc *time.Location) time.Time {
+	now := time.Now().In(loc)
+	return date(now.Year(), now.Month(), now.Day())
+}
+
+// Range works out the dates covered by a period. Periods relative to the current date (such as LastMonth) use the
+// current date in loc.
+//
+// The first day of LastMonth (the same date a month ago) and of YearToDate are included. This matches the SQL these
+// periods replaced, which compared "date" > date('now', ...) and so also included them, since stored dates have a time
+// after them and sort after the bare date.
+func (p Period) Range(loc *time.Location) (DateRange, error) {
+	today := Today(loc)
+
+	switch p {
+	case AllTime, "":
+		return DateRange{}, nil
+	case LastMonth:
+		return DateRange{Start: today.AddDate(0, -1, 0)}, nil
+	case YearToDate:
+		return DateRange{Start: date(today.Year(), time.January, 1)}, nil
+	case PreviousYear:
+		return DateRange{Start: date(today.Year()-1, time.January, 1), End: date(today.Year(), time.January, 1)}, nil
+	case FinancialYear:
+		return DateRange{Start: financialYearStart(today)}, nil
+	case PreviousFinancialYear:
+		start := financialYearStart(today)
+		return DateRange{Start: start.AddDate(-1, 0, 0), End: start}, nil
+	}
+
+	x := strings.ToLower(string(p))
+
+	if periodYearRegexp.MatchString(x) {
+		year, _ := strconv.Atoi(x)
+		return DateRange{Start: date(year, time.January, 1), End: date(year+1, time.January, 1)}, nil
+	}
+
+	if periodMonthRegexp.MatchString(x) {
+		start, err := time.Parse("2006-01", x)
+		if err != nil {
+			return DateRange{}, fmt.Errorf("invalid month %#v", x)
+		}
+		return DateRange{Start: start, End: start.AddDate(0, 1, 0)}, nil
+	}
+
+	if m := periodFinancialYearRegexp.FindStringSubmatch(x); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		return DateRange{Start: date(year, time.April, 1), End: date(year+1, time.April, 1)}, nil
+	}
+
+	return DateRange{}, fmt.Errorf("unknown period %#v", string(p))
+}
+
+// ParseTimezone loads a timezone by its IANA name, such as Europe/London. If tz is blank, UTC is returned.
+func ParseTimezone(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %#v", tz)
+	}
+	return loc, nil
+}
+
+// ParseDateRange builds a DateRange from user input. A period is worked out with Period.Range, and is then narrowed
+// by from and to, which are dates in the form YYYY-MM-DD. Both from and to are inclusive. Any of period, from and to
+// may be blank.
+func ParseDateRange(period, from, to string, loc *time.Location) (DateRange, error) {
+	dr, err := Period(period).Range(loc)
+	if err != nil {
+		return DateRange{}, err
+	}
+
+	if from != "" {
+		start, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return DateRange{}, fmt.Errorf("invalid from date %#v (expected YYYY-MM-DD)", from)
+		}
+		if start.After(dr.Start) {
+			dr.Start = start
+		}
+	}
+
+	if to != "" {
+		end, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return DateRange{}, fmt.Errorf("invalid to date %#v (expected YYYY-MM-DD)", to)
+		}
+		end = end.AddDate(0, 0, 1)
+		if dr.End.IsZero() || end.Before(dr.End) {
+			dr.End = end
+		}
+	}
+
+	if !dr.Start.IsZero() && !dr.End.IsZero() && !dr.Start.Before(dr.End) {
+		return DateRange{}, errors.New("date range is empty (the start must be before the end)")
+	}
+
+	return dr, nil
+}
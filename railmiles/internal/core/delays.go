@@ -0,0 +1,364 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+	"time"
+)
+
+// DelayRepayThresholds are the delays, in minutes, at which the Delay Repay schemes run by most train operators pay
+// out. Longer delays are compensated with a larger share of the ticket price.
+var DelayRepayThresholds = []int{15, 30, 60, 120}
+
+type JourneyDelay struct {
+	// Minutes is how late the journey arrived at its destination. It is never negative.
+	Minutes int `json:"minutes"`
+	// Threshold is the largest of DelayRepayThresholds that Minutes meets, or zero if it doesn't meet any.
+	Threshold int `json:"threshold"`
+}
+
+// plannedArrival returns when a journey made up of legs is due to arrive at its destination, or nil if that isn't
+// known.
+func plannedArrival(legs []*db.Leg) *time.Time {
+	if len(legs) == 0 {
+		return nil
+	}
+	return legs[len(legs)-1].ScheduledArrival
+}
+
+// journeyDelay works out the delay of a journey from when it actually arrived at the end of its last leg. Delay Repay
+// only counts the delay at the final destination, so a late connection that is made up for later doesn't count. The
+// delay is measured from the planned arrival of the journey instead of the scheduled arrival of the last leg, since a
+// missed connection means the last leg is a later train than planned. nil is returned if the delay isn't known.
+func journeyDelay(journey *db.Journey, legs []*db.Leg) *JourneyDelay {
+	if journey.PlannedArrival == nil || len(legs) == 0 {
+		return nil
+	}
+
+	actualArrival := legs[len(legs)-1].ActualArrival
+	if actualArrival == nil {
+		return nil
+	}
+
+	minutes := max(0, int(actualArrival.Sub(*journey.PlannedArrival).Minutes()))
+	jd := &JourneyDelay{Minutes: minutes}
+	for _, threshold := range DelayRepayThresholds {
+		if minutes >= threshold {
+			jd.Threshold = threshold
+		}
+	}
+	return jd
+}
+
+func (c *Core) GetJourneyDelay(journey *db.Journey) (*JourneyDelay, error) {
+	legs, err := c.GetLegs(journey.ID)
+	if err != nil {
+		return nil, err
+	}
+	return journeyDelay(journey, legs), nil
+}
+
+// GetJourneyDelays returns the delay of each of journeys, keyed by journey ID. Journeys with an unknown delay are left
+// out.
+func (c *Core) GetJourneyDelays(journeys []*db.Journey) (map[uuid.UUID]*JourneyDelay, error) {
+	legs, err := c.getLegsByJourney(journeys)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[uuid.UUID]*JourneyDelay)
+	for _, journey := range journeys {
+		if delay := journeyDelay(journey, legs[journey.ID]); delay != nil {
+			res[journey.ID] = delay
+		}
+	}
+	return res, nil
+}
+
+// arrivalRefreshWindow is how long after a journey RefreshArrivals keeps looking for its actual arrival times. Delay
+// Repay has to be claimed within 28 days of travelling, so there's no point in looking for longer than that.
+const arrivalRefreshWindow = 28 * 24 * time.Hour
+
+// awaitingArrivals narrows a query on legs to those that are part of recent journeys, were made on a known service and
+// don't have an actual arrival time yet.
+func awaitingArrivals(q *bun.SelectQuery, now time.Time) *bun.SelectQuery {
+	return q.
+		Where(`"leg"."service_uid" IS NOT NULL`).
+		Where(`"leg"."actual_arrival" IS NULL`).
+		Where(`"leg"."journey_id" IN (SELECT "id" FROM "railmiles_journeys_v2" WHERE "date" BETWEEN ? AND ?)`, now.Add(-arrivalRefreshWindow), now)
+}
+
+// GetUsersAwaitingArrivals returns the IDs of the users that have legs that RefreshArrivals could update.
+func (c *Core) GetUsersAwaitingArrivals() ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := awaitingArrivals(c.db.DB.NewSelect().Model((*db.Leg)(nil)), time.Now().UTC()).
+		Distinct().
+		Column("leg.user_id").
+		Scan(context.Background(), &ids)
+	return ids, err
+}
+
+// RefreshArrivals fetches the actual departure and arrival times of the recent legs of a user that don't have them
+// yet, since a journey that was logged before it was made won't have had them when it was saved. Any other service
+// details that were missing are filled in at the same time, which is how legs whose distance came from the leg cache
+// get their scheduled times. The number of legs that were updated is returned.
+//
+// Legs that the distance provider doesn't have actual times for yet are left to be tried again later. If every lookup
+// fails because the distance provider is unavailable, an error wrapping ErrProviderUnavailable is returned.
+func (c *Core) RefreshArrivals(ctx context.Context, userID uuid.UUID, statusChan chan *util.SSEItem) (int, error) {
+	now := time.Now().UTC()
+
+	var legs []*db.Leg
+	err := awaitingArrivals(c.db.DB.NewSelect().Model(&legs), now).
+		Where(`"leg"."user_id" = ?`, userID).
+		Where(`"leg"."scheduled_arrival" IS NULL OR "leg"."scheduled_arrival" < ?`, now).
+		Order("journey_id", "sequence").
+		Scan(context.Background())
+	if err != nil {
+		return 0, util.Wrap(err, "fetching legs")
+	}
+
+	if len(legs) == 0 {
+		return 0, nil
+	}
+
+	var journeys []*db.Journey
+	err = c.db.DB.NewSelect().
+		Model(&journeys).
+		Where(`"journey"."id" IN (?)`, bun.In(util.Map(legs, func(x *db.Leg) uuid.UUID { return x.JourneyID }))).
+		Scan(context.Background())
+	if err != nil {
+		return 0, util.Wrap(err, "fetching journeys")
+	}
+	journeysMap := make(map[uuid.UUID]*db.Journey)
+	for _, journey := range journeys {
+		journeysMap[journey.ID] = journey
+	}
+
+	var updated, unavailable int
+	for _, leg := range legs {
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+
+		journey := journeysMap[leg.JourneyID]
+		if journey == nil {
+			continue
+		}
+
+		util.SendSSE(statusChan, "status", fmt.Sprintf("Fetching times of service %s (for leg %s->%s on %s)", leg.ServiceUID, leg.From, leg.To, journey.Date.Format(time.DateOnly)))
+
+		dist, err := c.distanceProvider.ServiceDistance(ctx, leg.ServiceUID, leg.From, leg.To, journey.Date)
+		if err != nil {
+			if ctx.Err() != nil {
+				return updated, ctx.Err()
+			}
+			if !errors.Is(err, ErrNoDistances) {
+				slog.Warn("unable to fetch service details", "service", leg.ServiceUID, "err", err)
+			}
+			if errors.Is(err, ErrProviderUnavailable) {
+				unavailable += 1
+			}
+			continue
+		}
+		if len(dist.Legs) == 0 || dist.Legs[0].ActualArrival == nil {
+			continue
+		}
+
+		if err := c.updateLegTimes(journey, leg, dist.Legs[0]); err != nil {
+			return updated, util.Wrap(err, "updating leg %d of journey %s", leg.Sequence, journey.ID)
+		}
+		updated += 1
+	}
+
+	if unavailable == len(legs) {
+		return 0, fmt.Errorf("%w: unable to fetch details of any services", ErrProviderUnavailable)
+	}
+
+	return updated, nil
+}
+
+// updateLegTimes saves the actual times from details, a leg fetched from the distance provider, to leg. Service
+// details that leg didn't have are copied from details too. If the planned arrival of journey wasn't known and leg is
+// its last leg, it is set from the scheduled arrival.
+func (c *Core) updateLegTimes(journey *db.Journey, leg, details *db.Leg) error {
+	leg.ActualDeparture = details.ActualDeparture
+	leg.ActualArrival = details.ActualArrival
+	if leg.Operator == "" {
+		leg.Operator = details.Operator
+	}
+	if leg.Headcode == "" {
+		leg.Headcode = details.Headcode
+	}
+	if leg.ScheduledDeparture == nil {
+		leg.ScheduledDeparture = details.ScheduledDeparture
+	}
+	if leg.ScheduledArrival == nil {
+		leg.ScheduledArrival = details.ScheduledArrival
+	}
+
+	return c.inTx(func(tx bun.Tx) error {
+		_, err := tx.NewUpdate().
+			Model(leg).
+			Column("operator", "headcode", "scheduled_departure", "actual_departure", "scheduled_arrival", "actual_arrival").
+			WherePK().
+			Exec(context.Background())
+		if err != nil {
+			return err
+		}
+
+		if journey.PlannedArrival != nil || leg.ScheduledArrival == nil {
+			return nil
+		}
+
+		var count int
+		count, err = tx.NewSelect().Model((*db.Leg)(nil)).Where("journey_id = ?", journey.ID).Count(context.Background())
+		if err != nil {
+			return err
+		}
+		if leg.Sequence != count-1 {
+			return nil
+		}
+
+		_, err = tx.NewUpdate().
+			Model((*db.Journey)(nil)).
+			Set("planned_arrival = ?", leg.ScheduledArrival).
+			Where("id = ?", journey.ID).
+			Exec(context.Background())
+		return err
+	})
+}
+
+type DelayedJourney struct {
+	Journey *db.Journey `json:"journey"`
+	// Delay is nil if the delay of the journey isn't known.
+	Delay *JourneyDelay `json:"delay"`
+	Claim *db.Claim     `json:"claim"`
+}
+
+// GetDelayedJourneys returns every journey a user has made that was delayed enough to claim Delay Repay, along with
+// any other journey that a claim has been recorded for, most recent first. Journeys without a claim are given one with
+// the status db.ClaimNotClaimed.
+func (c *Core) GetDelayedJourneys(userID uuid.UUID) ([]*DelayedJourney, error) {
+	// Only the last leg of a journey matters, see journeyDelay.
+	var lastLegs []*db.Leg
+	err := c.db.DB.NewSelect().
+		Model(&lastLegs).
+		Where(`"leg"."user_id" = ?`, userID).
+		Where(`"leg"."actual_arrival" IS NOT NULL`).
+		Where(`"leg"."sequence" = (SELECT max("sequence") FROM "railmiles_legs" AS "last" WHERE "last"."journey_id" = "leg"."journey_id")`).
+		Scan(context.Background())
+	if err != nil {
+		return nil, util.Wrap(err, "fetching last legs")
+	}
+
+	var claims []*db.Claim
+	if err := c.db.DB.NewSelect().Model(&claims).Where("user_id = ?", userID).Scan(context.Background()); err != nil {
+		return nil, util.Wrap(err, "fetching claims")
+	}
+
+	var (
+		lastLegsMap = make(map[uuid.UUID]*db.Leg)
+		claimsMap   = make(map[uuid.UUID]*db.Claim)
+		ids         []uuid.UUID
+	)
+	for _, leg := range lastLegs {
+		lastLegsMap[leg.JourneyID] = leg
+		ids = append(ids, leg.JourneyID)
+	}
+	for _, claim := range claims {
+		claimsMap[claim.JourneyID] = claim
+		if lastLegsMap[claim.JourneyID] == nil {
+			ids = append(ids, claim.JourneyID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var journeys []*db.Journey
+	err = c.db.DB.NewSelect().
+		Model(&journeys).
+		Where(`"journey"."id" IN (?)`, bun.In(ids)).
+		Where(`"journey"."user_id" = ?`, userID).
+		Order("date DESC", "id").
+		Scan(context.Background())
+	if err != nil {
+		return nil, util.Wrap(err, "fetching delayed journeys")
+	}
+
+	var res []*DelayedJourney
+	for _, journey := range journeys {
+		var delay *JourneyDelay
+		if leg := lastLegsMap[journey.ID]; leg != nil {
+			delay = journeyDelay(journey, []*db.Leg{leg})
+		}
+
+		claim := claimsMap[journey.ID]
+		if claim == nil {
+			if delay == nil || delay.Threshold == 0 {
+				continue
+			}
+			claim = &db.Claim{JourneyID: journey.ID, Status: db.ClaimNotClaimed}
+		}
+
+		res = append(res, &DelayedJourney{
+			Journey: journey,
+			Delay:   delay,
+			Claim:   claim,
+		})
+	}
+	PopulateFullStationNames(util.Map(res, func(x *DelayedJourney) *db.Journey { return x.Journey }))
+	return res, nil
+}
+
+func (c *Core) GetClaim(userID, journeyID uuid.UUID) (*db.Claim, error) {
+	claim := new(db.Claim)
+	err := c.db.DB.NewSelect().Model(claim).Where("journey_id = ?", journeyID).Where("user_id = ?", userID).Scan(context.Background())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return claim, nil
+}
+
+// ErrInvalidClaim is wrapped by the errors returned when a claim can't be saved because of a problem with it.
+var ErrInvalidClaim = errors.New("invalid claim")
+
+// PutClaim saves the Delay Repay claim for a journey. If the journey doesn't exist, sql.ErrNoRows is returned.
+func (c *Core) PutClaim(claim *db.Claim) error {
+	switch claim.Status {
+	case db.ClaimNotClaimed, db.ClaimSubmitted, db.ClaimPaid:
+	default:
+		return fmt.Errorf("%w: unknown status %#v", ErrInvalidClaim, claim.Status)
+	}
+
+	if claim.Amount < 0 {
+		return fmt.Errorf("%w: amount cannot be negative", ErrInvalidClaim)
+	}
+
+	journey, err := c.GetJourney(claim.UserID, claim.JourneyID)
+	if err != nil {
+		return util.Wrap(err, "fetching journey")
+	}
+	if journey == nil {
+		return sql.ErrNoRows
+	}
+
+	claim.UpdatedAt = time.Now().UTC()
+	_, err = c.db.DB.NewInsert().
+		Model(claim).
+		On("CONFLICT (journey_id) DO UPDATE").
+		Exec(context.Background())
+	return err
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/config"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"strings"
+	"time"
+)
+
+type DistanceWithRoute struct {
+	Distance float32
+	Route    []string
+	// Inferred is set when some or all of the distance was calculated from previously recorded journeys instead of
+	// being provided by the DistanceProvider.
+	Inferred bool
+	// KnownLegs lists the previously recorded legs used to infer the distance, in the form FROM->TO.
+	KnownLegs []string
+	// Legs describes each service travelled on. The JourneyID, UserID and Sequence of each leg are not set.
+	// DistanceProvider implementations only need to set the service details of a leg.
+	Legs []*db.Leg
+}
+
+func (dwr *DistanceWithRoute) Add(dw2 *DistanceWithRoute) {
+	dwr.Distance += dw2.Distance
+	dwr.Route = append(dwr.Route, dw2.Route...)
+	dwr.Inferred = dwr.Inferred || dw2.Inferred
+	dwr.KnownLegs = append(dwr.KnownLegs, dw2.KnownLegs...)
+	dwr.Legs = append(dwr.Legs, dw2.Legs...)
+}
+
+// DistanceProvider is a source of train service and mileage data. If a method fails because the source can't be
+// reached or is temporarily having problems, the returned error should wrap ErrProviderUnavailable so that the lookup
+// can be tried again later. Any other error is treated as a failure of that lookup alone.
+type DistanceProvider interface {
+	// SearchServices returns the UIDs of passenger services that run between from and to on the given date, most
+	// likely candidate first.
+	SearchServices(ctx context.Context, from, to string, date time.Time) ([]string, error)
+	// ServiceDistance returns the distance travelled on service uid between from and to, and the stations in between.
+	// If the service has no mileage data, ErrNoDistances is returned. If details of the service such as its operator
+	// are available, they are returned as a single leg.
+	ServiceDistance(ctx context.Context, uid, from, to string, date time.Time) (*DistanceWithRoute, error)
+}
+
+var ErrNoDistances = errors.New("no distances available")
+
+// ErrProviderUnavailable is wrapped by the errors returned by GetRouteDistance when the DistanceProvider could not be
+// queried and the distance could not be inferred from previous journeys instead. Trying again later may succeed.
+var ErrProviderUnavailable = errors.New("distance provider unavailable")
+
+type DistanceProviderConstructor func(conf *config.Config) (DistanceProvider, error)
+
+var distanceProviders = make(map[string]DistanceProviderConstructor)
+
+// RegisterDistanceProvider makes a DistanceProvider available for selection by name in the configuration file.
+func RegisterDistanceProvider(name string, constructor DistanceProviderConstructor) {
+	if _, found := distanceProviders[name]; found {
+		panic(fmt.Sprintf("distance provider %s registered twice", name))
+	}
+	distanceProviders[name] = constructor
+}
+
+func newDistanceProvider(conf *config.Config) (DistanceProvider, error) {
+	constructor, found := distanceProviders[conf.DistanceProvider]
+	if !found {
+		return nil, fmt.Errorf("unknown distance provider %#v", conf.DistanceProvider)
+	}
+	return constructor(conf)
+}
+
+// GetRouteDistance works out the distance travelled between each station in turn. If ctx is cancelled, any
+// outstanding requests to the DistanceProvider are aborted and the context's error is returned.
+func (c *Core) GetRouteDistance(ctx context.Context, stations []string, inputServices []string, date time.Time, statusChan chan *util.SSEItem) (*DistanceWithRoute, error) {
+	var (
+		services = make([][]string, len(stations)-1)
+		legs     = make([]*DistanceWithRoute, len(stations)-1)
+		graph    mileageGraph
+	)
+
+	// inferLeg is used when the DistanceProvider cannot give us a distance for a leg. If no distance can be inferred
+	// from previous journeys, cause is returned.
+	inferLeg := func(i int, cause error) (*DistanceWithRoute, error) {
+		if graph == nil {
+			var err error
+			graph, err = c.buildMileageGraph()
+			if err != nil {
+				return nil, util.Wrap(err, "building mileage graph")
+			}
+		}
+
+		dist := graph.shortestPath(stations[i], stations[i+1])
+		if dist == nil {
+			return nil, cause
+		}
+
+		util.SendSSE(statusChan, "status", fmt.Sprintf("Inferred distance for leg %s->%s using known legs %s", stations[i], stations[i+1], strings.Join(dist.KnownLegs, ", ")))
+		return dist, nil
+	}
+
+	for i := 0; i < len(stations)-1; i += 1 {
+		cached, err := c.lookupLegCache(stations[i], stations[i+1], inputServices[i])
+		if err != nil {
+			return nil, util.Wrap(err, "checking leg cache for %s->%s", stations[i], stations[i+1])
+		}
+		if cached != nil {
+			util.SendSSE(statusChan, "status", fmt.Sprintf("Using cached distance for leg %s->%s", stations[i], stations[i+1]))
+			legs[i] = cached
+			continue
+		}
+
+		if inputServices[i] != "" {
+			services[i] = []string{inputServices[i]}
+			continue
+		}
+
+		util.SendSSE(statusChan, "status", fmt.Sprintf("Searching for services for leg %s->%s", stations[i], stations[i+1]))
+		possibleUIDs, err := c.distanceProvider.SearchServices(ctx, stations[i], stations[i+1], date)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil && len(possibleUIDs) == 0 {
+			err = errors.New("no route found")
+		}
+		if err != nil {
+			legs[i], err = inferLeg(i, fmt.Errorf("search for service %s->%s: %w", stations[i], stations[i+1], err))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		services[i] = possibleUIDs
+	}
+
+	var total DistanceWithRoute
+	for i := 0; i < len(stations)-1; i += 1 {
+		if i != 0 {
+			total.Route = append(total.Route, stations[i])
+		}
+
+		dist := legs[i]
+		if dist == nil {
+			var providerErr error
+			for _, serv := range services[i] {
+				util.SendSSE(statusChan, "status", fmt.Sprintf("Fetching distance for service %s (for leg %s->%s)", serv, stations[i], stations[i+1]))
+
+				d, err := c.distanceProvider.ServiceDistance(ctx, serv, stations[i], stations[i+1], date)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if err != nil {
+					if errors.Is(err, ErrNoDistances) {
+						continue
+					}
+					// Another candidate service may still work if this one couldn't be read, but not if the provider
+					// is unavailable.
+					providerErr = fmt.Errorf("fetching distance for service %s: %w", serv, err)
+					if errors.Is(err, ErrProviderUnavailable) {
+						break
+					}
+					continue
+				}
+				dist = d
+				break
+			}
+
+			if dist == nil {
+				if providerErr == nil {
+					providerErr = util.UserError(fmt.Errorf("no distance information provided for %s -> %s (tried %s) - manual distance required", stations[i], stations[i+1], strings.Join(services[i], ", ")))
+				}
+
+				var err error
+				dist, err = inferLeg(i, providerErr)
+				if err != nil {
+					return nil, err
+				}
+			} else if err := c.storeLegCache(stations[i], stations[i+1], dist); err != nil {
+				return nil, util.Wrap(err, "caching distance for %s->%s", stations[i], stations[i+1])
+			}
+		}
+
+		if len(dist.Legs) == 0 {
+			dist.Legs = []*db.Leg{{ServiceUID: inputServices[i]}}
+		}
+		leg := dist.Legs[0]
+		leg.From, leg.To, leg.Distance, leg.CallingPoints = stations[i], stations[i+1], dist.Distance, dist.Route
+		leg.Inferred = dist.Inferred
+
+		total.Add(dist)
+	}
+
+	return &total, nil
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type ExportFormat string
+
+const (
+	ExportCSV  ExportFormat = "csv"
+	ExportJSON ExportFormat = "json"
+	ExportGPX  ExportFormat = "gpx"
+	ExportKML  ExportFormat = "kml"
+)
+
+func ParseExportFormat(x string) (ExportFormat, error) {
+	switch f := ExportFormat(strings.ToLower(x)); f {
+	case ExportCSV, ExportJSON, ExportGPX, ExportKML:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown export format %#v (expected csv, json, gpx or kml)", x)
+}
+
+func (ef ExportFormat) ContentType() string {
+	switch ef {
+	case ExportJSON:
+		return "application/json"
+	case ExportGPX:
+		return "application/gpx+xml"
+	case ExportKML:
+		return "application/vnd.google-earth.kml+xml"
+	}
+	return "text/csv"
+}
+
+type ExportedJourney struct {
+	*db.Journey
+	CallingPoints []*db.StationName `json:"callingPoints"`
+}
+
+var exportCSVHeader = []string{"id", "date", "from", "from_name", "to", "to_name", "via", "via_names", "distance", "calling_points", "calling_point_names", "return_id"}
+
+// ExportJourneys writes every journey a user made in a date range to w, oldest first.
+func (c *Core) ExportJourneys(w io.Writer, userID uuid.UUID, format ExportFormat, dr DateRange) error {
+	journeys, err := c.GetJourneys(&GetJourneysArgs{UserID: userID, JourneyFilter: JourneyFilter{DateRange: dr}, Ascending: true})
+	if err != nil {
+		return util.Wrap(err, "fetching journeys")
+	}
+
+	callingPoints, err := c.getAllCallingPoints(userID)
+	if err != nil {
+		return util.Wrap(err, "fetching calling points")
+	}
+
+	return writeExport(w, format, journeys, callingPoints)
+}
+
+// ExportJourney writes a single journey to w.
+func (c *Core) ExportJourney(w io.Writer, journey *db.Journey, format ExportFormat) error {
+	route, err := c.GetCallingPoints(journey.ID)
+	if err != nil {
+		return util.Wrap(err, "fetching calling points")
+	}
+
+	return writeExport(w, format, []*db.Journey{journey}, map[uuid.UUID][]string{journey.ID: route})
+}
+
+func writeExport(w io.Writer, format ExportFormat, journeys []*db.Journey, callingPoints map[uuid.UUID][]string) error {
+	PopulateFullStationNames(journeys)
+
+	exported := func(journey *db.Journey) *ExportedJourney {
+		return &ExportedJourney{
+			Journey: journey,
+			CallingPoints: util.Map(callingPoints[journey.ID], func(x string) *db.StationName {
+				return &db.StationName{Shortcode: x, Full: GetStationName(x)}
+			}),
+		}
+	}
+
+	switch format {
+	case ExportJSON:
+		if _, err := w.Write([]byte("[")); err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		for i, journey := range journeys {
+			if i != 0 {
+				if _, err := w.Write([]byte(",")); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(exported(journey)); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write([]byte("]\n"))
+		return err
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return err
+		}
+		for _, journey := range journeys {
+			ej := exported(journey)
+
+			var returnID string
+			if journey.ReturnID != nil {
+				returnID = journey.ReturnID.String()
+			}
+
+			shortcodes := func(x []*db.StationName) string {
+				return strings.Join(util.Map(x, func(y *db.StationName) string { return y.Shortcode }), ";")
+			}
+			names := func(x []*db.StationName) string {
+				return strings.Join(util.Map(x, func(y *db.StationName) string { return y.Full }), ";")
+			}
+
+			err := cw.Write([]string{
+				journey.ID.String(),
+				journey.Date.UTC().Format("2006-01-02"),
+				journey.From.Shortcode,
+				journey.From.Full,
+				journey.To.Shortcode,
+				journey.To.Full,
+				shortcodes(journey.Via),
+				names(journey.Via),
+				strconv.FormatFloat(float64(journey.Distance), 'f', 2, 32),
+				shortcodes(ej.CallingPoints),
+				names(ej.CallingPoints),
+				returnID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case ExportGPX:
+		return writeGPX(w, journeys, callingPoints)
+	case ExportKML:
+		return writeKML(w, journeys, callingPoints)
+	}
+
+	return fmt.Errorf("unknown export format %#v", format)
+}
+
+// getAllCallingPoints returns the calling points of every journey a user has made, keyed by journey ID.
+func (c *Core) getAllCallingPoints(userID uuid.UUID) (map[uuid.UUID][]string, error) {
+	var routeParts []*db.Route
+	err := c.db.DB.NewSelect().
+		Model(&routeParts).
+		Where("user_id = ?", userID).
+		Order("journey_id", "sequence").
+		Scan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[uuid.UUID][]string)
+	for _, part := range routeParts {
+		res[part.JourneyID] = append(res[part.JourneyID], part.Station)
+	}
+	return res, nil
+}
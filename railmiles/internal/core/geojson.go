@@ -7,67 +7,47 @@ import (
 )
 
 func (c *Core) GenerateJourneyGeoJSON(journeys []*db.Journey, includeIntermediaries bool) string {
-	var stations [][2]string
-	{
-		for _, journey := range journeys {
-			stations = append(stations, [2]string{journey.To.Shortcode, ""}, [2]string{journey.From.Shortcode, ""})
-			if includeIntermediaries {
-				for _, sn := range journey.Via {
-					stations = append(stations, [2]string{sn.Shortcode, "intermediary"})
-				}
-			}
-		}
-		stations = util.Deduplicate(stations)
-	}
+	stations := journeyStations(journeys, includeIntermediaries)
 
 	var res []any
 
-journeyLoop:
+	legs, _ := c.getLegsByJourney(journeys)
+
 	for _, journey := range journeys {
-		feature := make(map[string]any)
-		feature["type"] = "LineString"
-		feature["properties"] = map[string]string{"id": journey.ID.String()}
-
-		routeStations := []string{journey.From.Shortcode}
-		routeStations = append(routeStations, util.Map(journey.Via, func(x *db.StationName) string {
-			return x.Shortcode
-		})...)
-		routeStations = append(routeStations, journey.To.Shortcode)
-
-		route, _ := c.GetCallingPoints(journey.ID)
-
-		if len(route) == 0 && len(journey.Via) != 0 {
-			// This likely means that the journey had calling points listed as well as a manual distance, hence no auto
-			// route was inserted into the database. This check allows us to fit the line to the calling points so we
-			// don't end up with a line that goes direct between A and B without passing through C or D.
-			route = make([]string, len(journey.Via))
-			for i, x := range journey.Via {
-				route[i] = x.Shortcode
+		if len(legs[journey.ID]) == 0 {
+			route, _ := c.GetCallingPoints(journey.ID)
+
+			coords := journeyLine(journey, route)
+			if coords == nil {
+				continue
 			}
+
+			feature := make(map[string]any)
+			feature["type"] = "LineString"
+			feature["properties"] = map[string]any{"id": journey.ID.String()}
+			feature["coordinates"] = coords
+			res = append(res, feature)
+			continue
 		}
 
-		route = append([]string{journey.From.Shortcode}, route...)
-		route = append(route, journey.To.Shortcode)
-
-		route = append(route, routeStations[len(routeStations)-1])
-
-		var coords [][2]float32
-		{
-			last := len(route) - 1
-			for i, point := range route {
-				details := GetStationDetail(point)
-				if details == nil {
-					if i == 0 || i == last {
-						continue journeyLoop
-					}
-					continue
-				}
-				coords = append(coords, [2]float32{details.Lon, details.Lat})
+		// Each leg is drawn separately so that changes of train are visible.
+		for _, leg := range legs[journey.ID] {
+			coords := legLine(leg)
+			if coords == nil {
+				continue
+			}
+
+			props := map[string]any{"id": journey.ID.String(), "leg": leg.Sequence}
+			if leg.ServiceUID != "" {
+				props["service"] = leg.ServiceUID
 			}
-		}
 
-		feature["coordinates"] = smoothLine(coords)
-		res = append(res, feature)
+			feature := make(map[string]any)
+			feature["type"] = "LineString"
+			feature["properties"] = props
+			feature["coordinates"] = coords
+			res = append(res, feature)
+		}
 	}
 
 	for _, station := range stations {
@@ -93,6 +73,86 @@ journeyLoop:
 	return string(o)
 }
 
+// journeyStations returns the shortcodes of the stations that journeys start and end at, each paired with a station
+// type. Intermediary stations are included with the type "intermediary" if includeIntermediaries is set.
+func journeyStations(journeys []*db.Journey, includeIntermediaries bool) [][2]string {
+	var stations [][2]string
+	for _, journey := range journeys {
+		stations = append(stations, [2]string{journey.To.Shortcode, ""}, [2]string{journey.From.Shortcode, ""})
+		if includeIntermediaries {
+			for _, sn := range journey.Via {
+				stations = append(stations, [2]string{sn.Shortcode, "intermediary"})
+			}
+		}
+	}
+	return util.Deduplicate(stations)
+}
+
+// journeyLine returns a smoothed line following a journey through its calling points as a series of [lon, lat]
+// coordinates. If the location of the first or last station isn't known, nil is returned.
+func journeyLine(journey *db.Journey, callingPoints []string) [][2]float32 {
+	routeStations := []string{journey.From.Shortcode}
+	routeStations = append(routeStations, util.Map(journey.Via, func(x *db.StationName) string {
+		return x.Shortcode
+	})...)
+	routeStations = append(routeStations, journey.To.Shortcode)
+
+	route := callingPoints
+
+	if len(route) == 0 && len(journey.Via) != 0 {
+		// This likely means that the journey had calling points listed as well as a manual distance, hence no auto
+		// route was inserted into the database. This check allows us to fit the line to the calling points so we
+		// don't end up with a line that goes direct between A and B without passing through C or D.
+		route = make([]string, len(journey.Via))
+		for i, x := range journey.Via {
+			route[i] = x.Shortcode
+		}
+	}
+
+	route = append([]string{journey.From.Shortcode}, route...)
+	route = append(route, journey.To.Shortcode)
+
+	route = append(route, routeStations[len(routeStations)-1])
+
+	var coords [][2]float32
+	{
+		last := len(route) - 1
+		for i, point := range route {
+			details := GetStationDetail(point)
+			if details == nil {
+				if i == 0 || i == last {
+					return nil
+				}
+				continue
+			}
+			coords = append(coords, [2]float32{details.Lon, details.Lat})
+		}
+	}
+
+	return smoothLine(coords)
+}
+
+// legLine returns a smoothed line following a leg through its calling points as a series of [lon, lat] coordinates. If
+// the location of either end of the leg isn't known, nil is returned.
+func legLine(leg *db.Leg) [][2]float32 {
+	route := append([]string{leg.From}, leg.CallingPoints...)
+	route = append(route, leg.To)
+
+	var coords [][2]float32
+	for i, point := range route {
+		details := GetStationDetail(point)
+		if details == nil {
+			if i == 0 || i == len(route)-1 {
+				return nil
+			}
+			continue
+		}
+		coords = append(coords, [2]float32{details.Lon, details.Lat})
+	}
+
+	return smoothLine(coords)
+}
+
 func smoothLine(coords [][2]float32) [][2]float32 {
 	// Chaikin’s curve algorithm
 
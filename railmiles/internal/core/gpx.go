@@ -0,0 +1,222 @@
+package core
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/google/uuid"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// mapTrack is a journey that has been resolved into a line on the map, shared by the GPX and KML writers.
+type mapTrack struct {
+	journey *db.Journey
+	coords  [][2]float32
+}
+
+func (mt *mapTrack) name() string {
+	return fmt.Sprintf("%s to %s (%s)", mt.journey.From.Full, mt.journey.To.Full, mt.journey.Date.UTC().Format("2006-01-02"))
+}
+
+func (mt *mapTrack) description() string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatFloat(float64(mt.journey.Distance), 'f', 1, 32))
+	sb.WriteString(" miles")
+	if len(mt.journey.Via) != 0 {
+		sb.WriteString(" via ")
+		for i, via := range mt.journey.Via {
+			if i != 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(via.Full)
+		}
+	}
+	return sb.String()
+}
+
+// mapTracks resolves the line of each journey. Journeys that can't be drawn because the location of their first or
+// last station isn't known are skipped.
+func mapTracks(journeys []*db.Journey, callingPoints map[uuid.UUID][]string) []*mapTrack {
+	var res []*mapTrack
+	for _, journey := range journeys {
+		coords := journeyLine(journey, callingPoints[journey.ID])
+		if coords == nil {
+			continue
+		}
+		res = append(res, &mapTrack{journey: journey, coords: coords})
+	}
+	return res
+}
+
+// mapStations returns each station that journeys call at once, paired with its type as in journeyStations. Stations
+// that are both the end of one journey and an intermediary of another are treated as the end of a journey.
+func mapStations(journeys []*db.Journey) [][2]string {
+	var (
+		res  [][2]string
+		seen = make(map[string]int)
+	)
+	for _, station := range journeyStations(journeys, true) {
+		if i, found := seen[station[0]]; found {
+			if station[1] == "" {
+				res[i][1] = ""
+			}
+			continue
+		}
+		seen[station[0]] = len(res)
+		res = append(res, station)
+	}
+	return res
+}
+
+func formatCoord(x float32) string {
+	return strconv.FormatFloat(float64(x), 'f', 6, 32)
+}
+
+type gpxDocument struct {
+	XMLName   xml.Name      `xml:"gpx"`
+	Namespace string        `xml:"xmlns,attr"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Waypoints []gpxWaypoint `xml:"wpt"`
+	Tracks    []gpxTrack    `xml:"trk"`
+}
+
+type gpxWaypoint struct {
+	Lat  string `xml:"lat,attr"`
+	Lon  string `xml:"lon,attr"`
+	Name string `xml:"name"`
+	Type string `xml:"type,omitempty"`
+}
+
+type gpxTrack struct {
+	Name        string     `xml:"name"`
+	Description string     `xml:"desc"`
+	Points      []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat string `xml:"lat,attr"`
+	Lon string `xml:"lon,attr"`
+}
+
+// writeGPX writes journeys as a GPX 1.1 document, with one track per journey and one waypoint per station.
+func writeGPX(w io.Writer, journeys []*db.Journey, callingPoints map[uuid.UUID][]string) error {
+	doc := &gpxDocument{
+		Namespace: "http://www.topografix.com/GPX/1/1",
+		Version:   "1.1",
+		Creator:   "railmiles",
+	}
+
+	for _, station := range mapStations(journeys) {
+		details := GetStationDetail(station[0])
+		if details == nil {
+			continue
+		}
+		doc.Waypoints = append(doc.Waypoints, gpxWaypoint{
+			Lat:  formatCoord(details.Lat),
+			Lon:  formatCoord(details.Lon),
+			Name: station[0] + " " + details.Name,
+			Type: station[1],
+		})
+	}
+
+	for _, track := range mapTracks(journeys, callingPoints) {
+		t := gpxTrack{
+			Name:        track.name(),
+			Description: track.description(),
+		}
+		for _, coord := range track.coords {
+			t.Points = append(t.Points, gpxPoint{Lat: formatCoord(coord[1]), Lon: formatCoord(coord[0])})
+		}
+		doc.Tracks = append(doc.Tracks, t)
+	}
+
+	return writeXML(w, doc)
+}
+
+type kmlDocument struct {
+	XMLName   xml.Name    `xml:"kml"`
+	Namespace string      `xml:"xmlns,attr"`
+	Name      string      `xml:"Document>name"`
+	Folders   []kmlFolder `xml:"Document>Folder"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	TimeStamp   *kmlTimeStamp  `xml:"TimeStamp,omitempty"`
+	Point       *kmlPoint      `xml:"Point,omitempty"`
+	LineString  *kmlLineString `xml:"LineString,omitempty"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlLineString struct {
+	Tessellate  int    `xml:"tessellate"`
+	Coordinates string `xml:"coordinates"`
+}
+
+func kmlCoordinates(coords ...[2]float32) string {
+	parts := make([]string, len(coords))
+	for i, coord := range coords {
+		parts[i] = formatCoord(coord[0]) + "," + formatCoord(coord[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+// writeKML writes journeys as a KML document containing a folder of journey lines and a folder of stations.
+func writeKML(w io.Writer, journeys []*db.Journey, callingPoints map[uuid.UUID][]string) error {
+	journeyFolder := kmlFolder{Name: "Journeys"}
+	for _, track := range mapTracks(journeys, callingPoints) {
+		journeyFolder.Placemarks = append(journeyFolder.Placemarks, kmlPlacemark{
+			Name:        track.name(),
+			Description: track.description(),
+			TimeStamp:   &kmlTimeStamp{When: track.journey.Date.UTC().Format("2006-01-02")},
+			LineString:  &kmlLineString{Tessellate: 1, Coordinates: kmlCoordinates(track.coords...)},
+		})
+	}
+
+	stationFolder := kmlFolder{Name: "Stations"}
+	for _, station := range mapStations(journeys) {
+		details := GetStationDetail(station[0])
+		if details == nil {
+			continue
+		}
+		stationFolder.Placemarks = append(stationFolder.Placemarks, kmlPlacemark{
+			Name:  station[0] + " " + details.Name,
+			Point: &kmlPoint{Coordinates: kmlCoordinates([2]float32{details.Lon, details.Lat})},
+		})
+	}
+
+	return writeXML(w, &kmlDocument{
+		Namespace: "http://www.opengis.net/kml/2.2",
+		Name:      "railmiles",
+		Folders:   []kmlFolder{journeyFolder, stationFolder},
+	})
+}
+
+func writeXML(w io.Writer, doc any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
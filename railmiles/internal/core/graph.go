@@ -0,0 +1,198 @@
+package core
+
+import (
+	"container/heap"
+	"context"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"golang.org/x/exp/slices"
+	"strings"
+)
+
+type mileageEdge struct {
+	to       string
+	distance float32
+	// route is the list of stations passed between the two ends of the edge.
+	route []string
+	// source is the known leg that this edge was derived from, in the form FROM->TO.
+	source string
+}
+
+// mileageGraph is an undirected graph of stations, where edges are weighted with the distance in miles between two
+// stations as previously recorded in the database.
+type mileageGraph map[string][]*mileageEdge
+
+func (mg mileageGraph) addEdge(from, to string, distance float32, route []string, source string) {
+	reversedRoute := make([]string, len(route))
+	copy(reversedRoute, route)
+	slices.Reverse(reversedRoute)
+
+	mg[from] = append(mg[from], &mileageEdge{to: to, distance: distance, route: route, source: source})
+	mg[to] = append(mg[to], &mileageEdge{to: from, distance: distance, route: reversedRoute, source: source})
+}
+
+// addKnownPath adds a path of stations with a known total distance to the graph. As well as an edge between the two
+// ends of the path, the distance is split between each pair of adjacent stations in proportion to the straight line
+// distance between them, so that journeys that only cover part of the path can also be inferred.
+func (mg mileageGraph) addKnownPath(path []string, distance float32) {
+	if len(path) < 2 || distance <= 0 {
+		return
+	}
+
+	from, to := path[0], path[len(path)-1]
+	if from == to {
+		return
+	}
+
+	source := from + "->" + to
+	mg.addEdge(from, to, distance, path[1:len(path)-1], source)
+
+	if len(path) == 2 {
+		return
+	}
+
+	var (
+		segments = make([]float64, len(path)-1)
+		total    float64
+	)
+	for i := 0; i < len(path)-1; i += 1 {
+		a, b := GetStationDetail(path[i]), GetStationDetail(path[i+1])
+		if a == nil || b == nil {
+			return
+		}
+		segments[i] = util.HaversineMiles(a.Lat, a.Lon, b.Lat, b.Lon)
+		total += segments[i]
+	}
+
+	if total == 0 {
+		return
+	}
+
+	for i, seg := range segments {
+		mg.addEdge(path[i], path[i+1], float32(seg/total)*distance, nil, source)
+	}
+}
+
+// buildMileageGraph creates a mileageGraph from every cached leg and the legs of every logged journey. Journeys from
+// all users are included, since the distance between two stations doesn't depend on who travelled it. Legs with
+// inferred distances are left out so that estimates aren't built on top of other estimates.
+func (c *Core) buildMileageGraph() (mileageGraph, error) {
+	graph := make(mileageGraph)
+
+	legs, err := c.GetLegCache()
+	if err != nil {
+		return nil, util.Wrap(err, "reading leg cache")
+	}
+
+	for _, leg := range legs {
+		path := []string{strings.ToUpper(leg.From)}
+		path = append(path, leg.Route()...)
+		path = append(path, strings.ToUpper(leg.To))
+		graph.addKnownPath(path, leg.Distance)
+	}
+
+	var journeyLegs []*db.Leg
+	if err := c.db.DB.NewSelect().Model(&journeyLegs).Where("NOT inferred").Scan(context.Background()); err != nil {
+		return nil, util.Wrap(err, "reading legs")
+	}
+
+	for _, leg := range journeyLegs {
+		path := []string{strings.ToUpper(leg.From)}
+		path = append(path, leg.CallingPoints...)
+		path = append(path, strings.ToUpper(leg.To))
+		graph.addKnownPath(path, leg.Distance)
+	}
+
+	return graph, nil
+}
+
+// shortestPath finds the shortest distance between two stations using Dijkstra's algorithm. If there is no path
+// between the two, nil is returned.
+func (mg mileageGraph) shortestPath(from, to string) *DistanceWithRoute {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+
+	if _, found := mg[from]; !found {
+		return nil
+	}
+
+	type visit struct {
+		distance float32
+		previous string
+		via      *mileageEdge
+	}
+
+	visited := make(map[string]*visit)
+	best := map[string]*visit{from: {}}
+
+	pq := &stationQueue{{station: from}}
+	for pq.Len() != 0 {
+		current := heap.Pop(pq).(*queuedStation)
+		if _, done := visited[current.station]; done {
+			continue
+		}
+		visited[current.station] = best[current.station]
+
+		if current.station == to {
+			break
+		}
+
+		for _, edge := range mg[current.station] {
+			if _, done := visited[edge.to]; done {
+				continue
+			}
+			dist := current.distance + edge.distance
+			if b, found := best[edge.to]; !found || dist < b.distance {
+				best[edge.to] = &visit{distance: dist, previous: current.station, via: edge}
+				heap.Push(pq, &queuedStation{station: edge.to, distance: dist})
+			}
+		}
+	}
+
+	end, found := visited[to]
+	if !found {
+		return nil
+	}
+
+	res := &DistanceWithRoute{
+		Distance: end.distance,
+		Inferred: true,
+	}
+
+	for station := to; station != from; station = visited[station].previous {
+		v := visited[station]
+		var part []string
+		part = append(part, v.via.route...)
+		if station != to {
+			part = append(part, station)
+		}
+		res.Route = append(part, res.Route...)
+		res.KnownLegs = append([]string{v.via.source}, res.KnownLegs...)
+	}
+
+	res.KnownLegs = util.Deduplicate(res.KnownLegs)
+
+	return res
+}
+
+type queuedStation struct {
+	station  string
+	distance float32
+}
+
+type stationQueue []*queuedStation
+
+func (sq stationQueue) Len() int           { return len(sq) }
+func (sq stationQueue) Less(i, j int) bool { return sq[i].distance < sq[j].distance }
+func (sq stationQueue) Swap(i, j int)      { sq[i], sq[j] = sq[j], sq[i] }
+
+func (sq *stationQueue) Push(x any) {
+	*sq = append(*sq, x.(*queuedStation))
+}
+
+func (sq *stationQueue) Pop() any {
+	old := *sq
+	n := len(old)
+	x := old[n-1]
+	*sq = old[:n-1]
+	return x
+}
@@ -0,0 +1,393 @@
+package core
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportColumns holds the names of the CSV columns that each field of a journey is read from. Only the date, from and
+// to columns are required to be present in the file.
+type ImportColumns struct {
+	Date     string
+	From     string
+	To       string
+	Via      string
+	Service  string
+	Distance string
+}
+
+var DefaultImportColumns = ImportColumns{
+	Date:     "date",
+	From:     "from",
+	To:       "to",
+	Via:      "via",
+	Service:  "service",
+	Distance: "distance",
+}
+
+// ParseImportColumns reads a column mapping in the form "field=Column Name,field=Column Name". Any fields that aren't
+// mentioned keep their default column names.
+func ParseImportColumns(mapping string) (*ImportColumns, error) {
+	cols := DefaultImportColumns
+	if strings.TrimSpace(mapping) == "" {
+		return &cols, nil
+	}
+
+	for _, part := range strings.Split(mapping, ",") {
+		field, column, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid column mapping %#v (expected field=column)", part)
+		}
+		column = strings.TrimSpace(column)
+
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "date":
+			cols.Date = column
+		case "from":
+			cols.From = column
+		case "to":
+			cols.To = column
+		case "via":
+			cols.Via = column
+		case "service":
+			cols.Service = column
+		case "distance":
+			cols.Distance = column
+		default:
+			return nil, fmt.Errorf("unknown field %#v in column mapping", field)
+		}
+	}
+
+	return &cols, nil
+}
+
+type ImportRowStatus string
+
+const (
+	ImportRowImported  ImportRowStatus = "imported"
+	ImportRowDuplicate ImportRowStatus = "duplicate"
+	ImportRowFailed    ImportRowStatus = "failed"
+	// ImportRowPending is used for rows that would be imported if this wasn't a dry run.
+	ImportRowPending ImportRowStatus = "pending"
+)
+
+type ImportRow struct {
+	Line      int             `json:"line"`
+	Status    ImportRowStatus `json:"status"`
+	Message   string          `json:"message,omitempty"`
+	JourneyID *uuid.UUID      `json:"journeyID,omitempty"`
+	Date      time.Time       `json:"date"`
+	Stations  []string        `json:"stations"`
+	Services  []string        `json:"services"`
+	Distance  float32         `json:"distance"`
+}
+
+type ImportReport struct {
+	DryRun     bool         `json:"dryRun"`
+	Imported   int          `json:"imported"`
+	Pending    int          `json:"pending"`
+	Duplicates int          `json:"duplicates"`
+	Failed     int          `json:"failed"`
+	Rows       []*ImportRow `json:"rows"`
+}
+
+func (ir *ImportReport) add(row *ImportRow) {
+	switch row.Status {
+	case ImportRowImported:
+		ir.Imported += 1
+	case ImportRowPending:
+		ir.Pending += 1
+	case ImportRowDuplicate:
+		ir.Duplicates += 1
+	case ImportRowFailed:
+		ir.Failed += 1
+	}
+	ir.Rows = append(ir.Rows, row)
+}
+
+var importDateFormats = []string{
+	"2006-01-02",
+	"02/01/2006",
+	"2/1/2006",
+	"02/01/06",
+	time.RFC3339,
+}
+
+func parseImportDate(x string) (time.Time, error) {
+	x = strings.TrimSpace(x)
+	for _, format := range importDateFormats {
+		if t, err := time.Parse(format, x); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date %#v (expected YYYY-MM-DD or DD/MM/YYYY)", x)
+}
+
+// splitImportList splits a cell containing multiple values, which may be separated by semicolons, commas, slashes or
+// spaces.
+func splitImportList(x string) []string {
+	return strings.FieldsFunc(x, func(r rune) bool {
+		return r == ';' || r == ',' || r == '/' || r == ' '
+	})
+}
+
+// journeyKey identifies a journey for the purposes of deduplication.
+func journeyKey(date time.Time, stations []string) string {
+	return date.UTC().Format("2006-01-02") + " " + strings.ToUpper(strings.Join(stations, " "))
+}
+
+// ImportJourneys reads journeys from a CSV file and saves them for a user. The first row of the file must be a header
+// row. Rows without a distance are looked up with GetRouteDistance. Rows that match an existing journey (or an earlier
+// row in the same file) by date and stations are skipped.
+//
+// If dryRun is set, nothing is saved and no distances are looked up.
+//
+// Problems with individual rows are recorded in the report. If the distance provider is unavailable, the import stops
+// with an error wrapping ErrProviderUnavailable instead, so that it can be retried. Rows that were already imported are
+// then skipped as duplicates.
+func (c *Core) ImportJourneys(ctx context.Context, userID uuid.UUID, r io.Reader, cols *ImportColumns, dryRun bool, statusChan chan *util.SSEItem) (*ImportReport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, util.UserError(errors.New("CSV file is empty"))
+		}
+		return nil, util.UserError(fmt.Errorf("unable to read CSV header: %w", err))
+	}
+
+	columnIndex := make(map[string]int)
+	for i, name := range header {
+		columnIndex[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	lookup := func(name string) int {
+		if i, found := columnIndex[strings.ToLower(name)]; found && name != "" {
+			return i
+		}
+		return -1
+	}
+
+	var (
+		dateCol     = lookup(cols.Date)
+		fromCol     = lookup(cols.From)
+		toCol       = lookup(cols.To)
+		viaCol      = lookup(cols.Via)
+		serviceCol  = lookup(cols.Service)
+		distanceCol = lookup(cols.Distance)
+	)
+
+	for name, i := range map[string]int{cols.Date: dateCol, cols.From: fromCol, cols.To: toCol} {
+		if i == -1 {
+			return nil, util.UserError(fmt.Errorf("CSV file has no %#v column", name))
+		}
+	}
+
+	existing, err := c.GetJourneys(&GetJourneysArgs{UserID: userID})
+	if err != nil {
+		return nil, util.Wrap(err, "fetching existing journeys")
+	}
+
+	seen := make(map[string]uuid.UUID)
+	for _, journey := range existing {
+		stations := []string{journey.From.Shortcode}
+		for _, via := range journey.Via {
+			stations = append(stations, via.Shortcode)
+		}
+		stations = append(stations, journey.To.Shortcode)
+		seen[journeyKey(journey.Date, stations)] = journey.ID
+	}
+
+	report := &ImportReport{DryRun: dryRun}
+
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, util.UserError(fmt.Errorf("unable to read CSV: %w", err))
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := &ImportRow{Line: line}
+
+		cell := func(i int) string {
+			if i == -1 || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := parseImportRow(row, cell(dateCol), cell(fromCol), cell(toCol), cell(viaCol), cell(serviceCol), cell(distanceCol)); err != nil {
+			row.Status = ImportRowFailed
+			row.Message = err.Error()
+			report.add(row)
+			continue
+		}
+
+		if err := c.checkImportStations(userID, row); err != nil {
+			var use *UnknownStationError
+			if !errors.As(err, &use) {
+				return nil, err
+			}
+			row.Status = ImportRowFailed
+			row.Message = err.Error()
+			report.add(row)
+			continue
+		}
+
+		key := journeyKey(row.Date, row.Stations)
+		if id, found := seen[key]; found {
+			row.Status = ImportRowDuplicate
+			if id != uuid.Nil {
+				row.JourneyID = &id
+			}
+			report.add(row)
+			continue
+		}
+
+		if dryRun {
+			row.Status = ImportRowPending
+			if row.Distance == 0 {
+				row.Message = "distance will be looked up"
+			}
+			seen[key] = uuid.Nil
+			report.add(row)
+			continue
+		}
+
+		util.SendSSE(statusChan, "status", fmt.Sprintf("Importing line %d (%s)", row.Line, strings.Join(row.Stations, "->")))
+
+		journeyID, err := c.importRow(ctx, userID, row, statusChan)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, ErrProviderUnavailable) {
+				return nil, fmt.Errorf("importing line %d (%d rows imported before this): %w", row.Line, report.Imported, err)
+			}
+			row.Status = ImportRowFailed
+			row.Message = err.Error()
+			report.add(row)
+			continue
+		}
+
+		row.Status = ImportRowImported
+		row.JourneyID = &journeyID
+		seen[key] = journeyID
+		report.add(row)
+	}
+
+	return report, nil
+}
+
+func parseImportRow(row *ImportRow, date, from, to, via, services, distance string) error {
+	var err error
+	row.Date, err = parseImportDate(date)
+	if err != nil {
+		return err
+	}
+
+	if row.Date.After(time.Now()) {
+		return errors.New("date occurs in the future")
+	}
+
+	if from == "" || to == "" {
+		return errors.New("from and to stations are required")
+	}
+
+	row.Stations = append(row.Stations, strings.ToUpper(from))
+	for _, station := range splitImportList(via) {
+		row.Stations = append(row.Stations, strings.ToUpper(station))
+	}
+	row.Stations = append(row.Stations, strings.ToUpper(to))
+
+	row.Services = splitImportList(services)
+	switch len(row.Services) {
+	case 0:
+		row.Services = make([]string, len(row.Stations)-1)
+	case len(row.Stations) - 1:
+	default:
+		return fmt.Errorf("expected %d service UIDs (one per leg) but got %d", len(row.Stations)-1, len(row.Services))
+	}
+
+	if distance != "" {
+		d, err := strconv.ParseFloat(distance, 32)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid distance %#v", distance)
+		}
+		row.Distance = float32(d)
+	}
+
+	return nil
+}
+
+// checkImportStations replaces the station codes in row with the CRS codes of the stations they refer to.
+func (c *Core) checkImportStations(userID uuid.UUID, row *ImportRow) error {
+	for i, station := range row.Stations {
+		code, err := c.CheckStationCode(userID, station)
+		if err != nil {
+			return err
+		}
+		row.Stations[i] = code
+	}
+	return nil
+}
+
+func (c *Core) importRow(ctx context.Context, userID uuid.UUID, row *ImportRow, statusChan chan *util.SSEItem) (uuid.UUID, error) {
+	var (
+		route          []string
+		legs           []*db.Leg
+		manualDistance = row.Distance != 0
+		inferred       bool
+	)
+	if !manualDistance {
+		// GetRouteDistance expects a service for every station, including the last.
+		dist, err := c.GetRouteDistance(ctx, row.Stations, append(row.Services, ""), row.Date, statusChan)
+		if err != nil {
+			return uuid.UUID{}, err
+		}
+		row.Distance = dist.Distance
+		route = dist.Route
+		legs = dist.Legs
+		inferred = dist.Inferred
+	} else {
+		legs = ManualLegs(row.Stations, row.Services, row.Distance)
+	}
+
+	journey := &db.Journey{
+		ID:     uuid.New(),
+		UserID: userID,
+		From:   &db.StationName{Shortcode: row.Stations[0]},
+		To:     &db.StationName{Shortcode: row.Stations[len(row.Stations)-1]},
+		Via: util.Map(row.Stations[1:len(row.Stations)-1], func(x string) *db.StationName {
+			return &db.StationName{Shortcode: x}
+		}),
+		Distance:         row.Distance,
+		Date:             row.Date,
+		ManualDistance:   manualDistance,
+		InferredDistance: inferred,
+	}
+
+	if err := c.CreateJourney(journey, route, legs, false); err != nil {
+		return uuid.UUID{}, util.Wrap(err, "saving journey")
+	}
+
+	return journey.ID, nil
+}
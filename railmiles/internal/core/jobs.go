@@ -0,0 +1,528 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+	"sync"
+	"time"
+)
+
+const (
+	jobMaxAttempts   = 5
+	jobRetryBackoff  = 30 * time.Second
+	jobPollInterval  = 5 * time.Second
+	jobRetentionTime = 7 * 24 * time.Hour
+
+	// jobWorkersPerLane is the number of jobs from each lane that can run at the same time.
+	jobWorkersPerLane = 2
+)
+
+// JobLane decides which workers run a kind of job. Each lane has its own workers, so jobs in one lane are never held up
+// by jobs in another.
+type JobLane int
+
+const (
+	// JobLaneInteractive is for jobs that someone is waiting on the result of, such as adding a journey.
+	JobLaneInteractive JobLane = iota
+	// JobLaneBackground is for jobs that may take a long time, such as imports. Jobs of unknown kinds are also picked
+	// up by this lane so that they can be failed.
+	JobLaneBackground
+)
+
+// JobHandler does the work for a job. Progress can be reported by sending to status. The returned string is stored
+// as the result of the job.
+//
+// If the returned error wraps ErrProviderUnavailable, the job is retried later. ctx is cancelled if the job is cancelled
+// with CancelJob, in which case the handler should return as soon as possible without saving anything.
+type JobHandler func(ctx context.Context, job *db.Job, status chan *util.SSEItem) (string, error)
+
+type jobRunner struct {
+	handlers map[string]JobHandler
+	lanes    map[string]JobLane
+	wake     map[JobLane]chan struct{}
+
+	// runningLock must be held when moving a job out of the queued state.
+	runningLock sync.Mutex
+	running     map[uuid.UUID]context.CancelFunc
+
+	subscriberLock sync.Mutex
+	subscribers    map[uuid.UUID][]chan *db.JobEvent
+}
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{
+		handlers: make(map[string]JobHandler),
+		lanes:    make(map[string]JobLane),
+		wake: map[JobLane]chan struct{}{
+			JobLaneInteractive: make(chan struct{}, 1),
+			JobLaneBackground:  make(chan struct{}, 1),
+		},
+		running:     make(map[uuid.UUID]context.CancelFunc),
+		subscribers: make(map[uuid.UUID][]chan *db.JobEvent),
+	}
+}
+
+// RegisterJobHandler sets the function used to run jobs of the given kind, and the lane that they're run in. All
+// handlers must be registered before StartJobRunner is called.
+func (c *Core) RegisterJobHandler(kind string, lane JobLane, handler JobHandler) {
+	if _, found := c.jobs.handlers[kind]; found {
+		panic(fmt.Sprintf("job handler %s registered twice", kind))
+	}
+	c.jobs.handlers[kind] = handler
+	c.jobs.lanes[kind] = lane
+}
+
+// interactiveKinds returns the kinds of job that have been registered in the interactive lane.
+func (jr *jobRunner) interactiveKinds() []string {
+	var kinds []string
+	for kind, lane := range jr.lanes {
+		if lane == JobLaneInteractive {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// EnqueueJob stores a new job to be run in the background. payload is encoded as JSON and can be read by the handler
+// with DecodeJobPayload.
+func (c *Core) EnqueueJob(userID uuid.UUID, kind string, payload any) (*db.Job, error) {
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, util.Wrap(err, "encoding job payload")
+	}
+
+	now := time.Now().UTC()
+	job := &db.Job{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Kind:      kind,
+		Payload:   string(encodedPayload),
+		State:     db.JobQueued,
+		RunAfter:  now,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if _, err := c.db.DB.NewInsert().Model(job).Exec(context.Background()); err != nil {
+		return nil, err
+	}
+
+	// Kinds without a handler are picked up by the background lane.
+	lane, found := c.jobs.lanes[kind]
+	if !found {
+		lane = JobLaneBackground
+	}
+
+	select {
+	case c.jobs.wake[lane] <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+func DecodeJobPayload(job *db.Job, target any) error {
+	return json.Unmarshal([]byte(job.Payload), target)
+}
+
+func (c *Core) GetJob(userID, id uuid.UUID) (*db.Job, error) {
+	job := new(db.Job)
+	if err := c.db.DB.NewSelect().Model(job).Where("id = ?", id).Where("user_id = ?", userID).Scan(context.Background()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetPendingJob returns a job of the given kind belonging to a user that is queued or running, or nil if there isn't
+// one.
+func (c *Core) GetPendingJob(userID uuid.UUID, kind string) (*db.Job, error) {
+	job := new(db.Job)
+	err := c.db.DB.NewSelect().
+		Model(job).
+		Where("user_id = ?", userID).
+		Where("kind = ?", kind).
+		Where("state IN (?, ?)", db.JobQueued, db.JobRunning).
+		Limit(1).
+		Scan(context.Background())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetJobEvents returns every event recorded for a job with an ID greater than after, oldest first.
+func (c *Core) GetJobEvents(jobID uuid.UUID, after int64) ([]*db.JobEvent, error) {
+	var events []*db.JobEvent
+	err := c.db.DB.NewSelect().
+		Model(&events).
+		Where("job_id = ?", jobID).
+		Where("id > ?", after).
+		Order("id").
+		Scan(context.Background())
+	return events, err
+}
+
+// SubscribeJob returns a channel that receives events for a job as they're recorded. The channel is closed once the
+// job is finished. Events may be dropped if the receiver falls behind, so GetJobEvents should be used to fill in any
+// gaps. The returned function must be called once the subscription is no longer required.
+func (c *Core) SubscribeJob(id uuid.UUID) (<-chan *db.JobEvent, func()) {
+	ch := make(chan *db.JobEvent, 32)
+
+	c.jobs.subscriberLock.Lock()
+	c.jobs.subscribers[id] = append(c.jobs.subscribers[id], ch)
+	c.jobs.subscriberLock.Unlock()
+
+	return ch, func() {
+		c.jobs.subscriberLock.Lock()
+		defer c.jobs.subscriberLock.Unlock()
+		subs := c.jobs.subscribers[id]
+		for i, sub := range subs {
+			if sub == ch {
+				c.jobs.subscribers[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+		if len(c.jobs.subscribers[id]) == 0 {
+			delete(c.jobs.subscribers, id)
+		}
+	}
+}
+
+func (c *Core) publishJobEvent(event *db.JobEvent) {
+	c.jobs.subscriberLock.Lock()
+	defer c.jobs.subscriberLock.Unlock()
+	for _, ch := range c.jobs.subscribers[event.JobID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (c *Core) closeJobSubscribers(id uuid.UUID) {
+	c.jobs.subscriberLock.Lock()
+	defer c.jobs.subscriberLock.Unlock()
+	for _, ch := range c.jobs.subscribers[id] {
+		close(ch)
+	}
+	delete(c.jobs.subscribers, id)
+}
+
+func (c *Core) recordJobEvent(jobID uuid.UUID, event, message string) {
+	je := &db.JobEvent{
+		JobID:     jobID,
+		Event:     event,
+		Message:   message,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := c.db.DB.NewInsert().Model(je).Exec(context.Background()); err != nil {
+		slog.Error("unable to record job event", "job", jobID, "err", err)
+		return
+	}
+	c.publishJobEvent(je)
+}
+
+// StartJobRunner starts running queued jobs in the background. Any jobs that were running when the process last
+// stopped are requeued.
+func (c *Core) StartJobRunner() error {
+	var interrupted []*db.Job
+	if err := c.db.DB.NewSelect().Model(&interrupted).Where("state = ?", db.JobRunning).Scan(context.Background()); err != nil {
+		return util.Wrap(err, "fetching interrupted jobs")
+	}
+
+	for _, job := range interrupted {
+		job.State = db.JobQueued
+		job.UpdatedAt = time.Now().UTC()
+		if _, err := c.db.DB.NewUpdate().Model(job).Column("state", "updated_at").WherePK().Exec(context.Background()); err != nil {
+			return util.Wrap(err, "requeueing job %s", job.ID)
+		}
+		c.recordJobEvent(job.ID, "status", "Job was interrupted by a restart and has been requeued")
+	}
+
+	if err := c.pruneJobs(); err != nil {
+		return util.Wrap(err, "pruning old jobs")
+	}
+
+	for _, lane := range []JobLane{JobLaneInteractive, JobLaneBackground} {
+		for i := 0; i < jobWorkersPerLane; i += 1 {
+			go c.runJobs(lane)
+		}
+	}
+
+	return nil
+}
+
+// CreateUpload stores a file for a job to process and returns its ID, which should be passed to the job in its
+// payload. Uploads are removed along with old jobs, or can be removed sooner with DeleteUpload.
+func (c *Core) CreateUpload(userID uuid.UUID, content []byte) (uuid.UUID, error) {
+	upload := &db.Upload{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Content:   content,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := c.db.DB.NewInsert().Model(upload).Exec(context.Background()); err != nil {
+		return uuid.UUID{}, err
+	}
+	return upload.ID, nil
+}
+
+// GetUpload returns the content of a file stored with CreateUpload, or nil if it doesn't exist.
+func (c *Core) GetUpload(userID, id uuid.UUID) ([]byte, error) {
+	upload := new(db.Upload)
+	if err := c.db.DB.NewSelect().Model(upload).Where("id = ?", id).Where("user_id = ?", userID).Scan(context.Background()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return upload.Content, nil
+}
+
+func (c *Core) DeleteUpload(userID, id uuid.UUID) error {
+	_, err := c.db.DB.NewDelete().Model((*db.Upload)(nil)).Where("id = ?", id).Where("user_id = ?", userID).Exec(context.Background())
+	return err
+}
+
+func (c *Core) pruneJobs() error {
+	cutoff := time.Now().UTC().Add(-jobRetentionTime)
+
+	_, err := c.db.DB.NewDelete().
+		Model((*db.JobEvent)(nil)).
+		Where(`"job_id" IN (SELECT "id" FROM "railmiles_jobs" WHERE "state" IN (?, ?, ?) AND "updated_at" < ?)`, db.JobDone, db.JobFailed, db.JobCancelled, cutoff).
+		Exec(context.Background())
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.DB.NewDelete().
+		Model((*db.Job)(nil)).
+		Where("state IN (?, ?, ?)", db.JobDone, db.JobFailed, db.JobCancelled).
+		Where("updated_at < ?", cutoff).
+		Exec(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// Any job that used an upload this old has either finished or run out of retries by now.
+	_, err = c.db.DB.NewDelete().
+		Model((*db.Upload)(nil)).
+		Where("created_at < ?", cutoff).
+		Exec(context.Background())
+	return err
+}
+
+// runJobs runs queued jobs from a lane one at a time until the process stops.
+func (c *Core) runJobs(lane JobLane) {
+	for {
+		job, err := c.nextJob(lane)
+		if err != nil {
+			slog.Error("unable to fetch next job", "err", err)
+		}
+
+		if job == nil {
+			select {
+			case <-c.jobs.wake[lane]:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		c.runJob(job)
+	}
+}
+
+// nextJob returns the queued job in a lane that should be run next, or nil if there aren't any. Another worker may
+// claim the job before this one does.
+func (c *Core) nextJob(lane JobLane) (*db.Job, error) {
+	job := new(db.Job)
+	q := c.db.DB.NewSelect().
+		Model(job).
+		Where("state = ?", db.JobQueued).
+		Where("run_after <= ?", time.Now().UTC()).
+		Order("run_after", "created_at").
+		Limit(1)
+
+	interactive := c.jobs.interactiveKinds()
+	if lane == JobLaneInteractive {
+		if len(interactive) == 0 {
+			return nil, nil
+		}
+		q = q.Where("kind IN (?)", bun.In(interactive))
+	} else if len(interactive) != 0 {
+		q = q.Where("kind NOT IN (?)", bun.In(interactive))
+	}
+
+	if err := q.Scan(context.Background()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+func (c *Core) saveJob(job *db.Job) {
+	job.UpdatedAt = time.Now().UTC()
+	if _, err := c.db.DB.NewUpdate().Model(job).WherePK().Exec(context.Background()); err != nil {
+		slog.Error("unable to save job", "job", job.ID, "err", err)
+	}
+}
+
+func (c *Core) runJob(job *db.Job) {
+	handler, found := c.jobs.handlers[job.Kind]
+	if !found {
+		job.State = db.JobFailed
+		job.Error = fmt.Sprintf("unknown job kind %#v", job.Kind)
+		c.saveJob(job)
+		c.recordJobEvent(job.ID, "error", job.Error)
+		c.closeJobSubscribers(job.ID)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	claimed, err := c.claimJob(job, cancel)
+	if err != nil {
+		slog.Error("unable to claim job", "job", job.ID, "err", err)
+		return
+	}
+	if !claimed {
+		// claimed by another worker or cancelled in the meantime
+		return
+	}
+
+	defer func() {
+		c.jobs.runningLock.Lock()
+		delete(c.jobs.running, job.ID)
+		c.jobs.runningLock.Unlock()
+	}()
+
+	status := make(chan *util.SSEItem, 16)
+	drained := make(chan struct{})
+	go func() {
+		for item := range status {
+			c.recordJobEvent(job.ID, item.Event, item.Message)
+		}
+		close(drained)
+	}()
+
+	result, err := handler(ctx, job, status)
+	close(status)
+	<-drained
+
+	if err != nil && ctx.Err() != nil {
+		job.State = db.JobCancelled
+		job.Error = ""
+		c.saveJob(job)
+		c.recordJobEvent(job.ID, "cancelled", "Cancelled")
+		c.closeJobSubscribers(job.ID)
+		return
+	}
+
+	if err == nil {
+		job.State = db.JobDone
+		job.Result = result
+		job.Error = ""
+		c.saveJob(job)
+		c.recordJobEvent(job.ID, "finished", result)
+		c.closeJobSubscribers(job.ID)
+		return
+	}
+
+	job.Error = err.Error()
+
+	if errors.Is(err, ErrProviderUnavailable) && job.Attempts < jobMaxAttempts {
+		backoff := jobRetryBackoff * time.Duration(1<<(job.Attempts-1))
+		job.State = db.JobQueued
+		job.RunAfter = time.Now().UTC().Add(backoff)
+		c.saveJob(job)
+		c.recordJobEvent(job.ID, "status", fmt.Sprintf("Attempt %d failed (%s), retrying in %s", job.Attempts, err.Error(), backoff))
+		return
+	}
+
+	job.State = db.JobFailed
+	c.saveJob(job)
+	c.recordJobEvent(job.ID, "error", err.Error())
+	c.closeJobSubscribers(job.ID)
+}
+
+// claimJob marks a queued job as running. If the job is no longer queued, false is returned.
+func (c *Core) claimJob(job *db.Job, cancel context.CancelFunc) (bool, error) {
+	c.jobs.runningLock.Lock()
+	defer c.jobs.runningLock.Unlock()
+
+	job.State = db.JobRunning
+	job.Attempts += 1
+	job.UpdatedAt = time.Now().UTC()
+
+	res, err := c.db.DB.NewUpdate().Model(job).WherePK().Where("state = ?", db.JobQueued).Exec(context.Background())
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	c.jobs.running[job.ID] = cancel
+	return true, nil
+}
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job already finished")
+)
+
+// CancelJob stops a job from running. If the job is currently running, its context is cancelled and the job is marked
+// as cancelled once the handler returns.
+func (c *Core) CancelJob(userID, id uuid.UUID) error {
+	c.jobs.runningLock.Lock()
+	defer c.jobs.runningLock.Unlock()
+
+	job, err := c.GetJob(userID, id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return ErrJobNotFound
+	}
+	if job.Finished() {
+		return ErrJobFinished
+	}
+
+	if cancel, found := c.jobs.running[id]; found {
+		cancel()
+		return nil
+	}
+
+	job.State = db.JobCancelled
+	job.UpdatedAt = time.Now().UTC()
+	res, err := c.db.DB.NewUpdate().Model(job).Column("state", "updated_at").WherePK().Where("state = ?", db.JobQueued).Exec(context.Background())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Only running jobs can leave the queued state without holding runningLock, and those are handled above.
+		return ErrJobFinished
+	}
+
+	c.recordJobEvent(id, "cancelled", "Cancelled")
+	c.closeJobSubscribers(id)
+	return nil
+}
@@ -8,35 +8,131 @@ import (
 	"github.com/codemicro/railmiles/railmiles/internal/util"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
 	"golang.org/x/exp/slices"
+	"math"
+	"strings"
 )
 
-type timeSince uint8
+// StationRole is the part a station plays in a journey, for use with JourneyFilter.
+type StationRole string
 
 const (
-	AllTime timeSince = iota
-	LastMonth
-	YearToDate
+	// AnyRole matches a station anywhere in a journey.
+	AnyRole     StationRole = ""
+	Origin      StationRole = "origin"
+	Destination StationRole = "destination"
+	// Via matches stations entered by the user as part of the route of a journey.
+	Via StationRole = "via"
+	// CallingPoint matches stations that a journey stopped at or passed through between its origin and destination,
+	// including via stations.
+	CallingPoint StationRole = "calling"
 )
 
-func (ts timeSince) SQLDuration() (string, error) {
-	var dur string
-	switch ts {
-	case AllTime:
-	case LastMonth:
-		dur = "-1 month"
-	case YearToDate:
-		dur = "start of year"
-	default:
-		return "", fmt.Errorf("unknown timeSince %d", ts)
+func ParseStationRole(x string) (StationRole, error) {
+	switch r := StationRole(strings.ToLower(x)); r {
+	case AnyRole, Origin, Destination, Via, CallingPoint:
+		return r, nil
 	}
-	return dur, nil
+	return "", fmt.Errorf("unknown station role %#v (expected origin, destination, via or calling)", x)
+}
+
+// JourneyFilter limits the journeys returned by GetJourneys and counted by GetJourneyStats. The zero value matches
+// every journey.
+type JourneyFilter struct {
+	DateRange
+	Station     string
+	StationRole StationRole
+	// MinDistance and MaxDistance are in miles and are inclusive. Zero leaves that end of the range open.
+	MinDistance float32
+	MaxDistance float32
+	// HasReturn and ManualDistance are ignored if nil.
+	HasReturn      *bool
+	ManualDistance *bool
+}
+
+func (jf *JourneyFilter) Validate() error {
+	if jf.MinDistance < 0 || jf.MaxDistance < 0 {
+		return errors.New("distances cannot be negative")
+	}
+	if jf.MaxDistance != 0 && jf.MinDistance > jf.MaxDistance {
+		return errors.New("minimum distance is greater than the maximum distance")
+	}
+	return nil
+}
+
+func (jf *JourneyFilter) apply(q *bun.SelectQuery) *bun.SelectQuery {
+	q = whereInDateRange(q, jf.DateRange)
+
+	if jf.Station != "" {
+		const (
+			isVia  = `EXISTS (SELECT 1 FROM json_each("journey"."via") WHERE "value" = ?)`
+			isCall = `EXISTS (SELECT 1 FROM "railmiles_routes_v3" AS "route" WHERE "route"."journey_id" = "journey"."id" AND "route"."station" = ?)`
+		)
+		station := strings.ToUpper(jf.Station)
+		switch jf.StationRole {
+		case Origin:
+			q = q.Where(`"journey"."from" = ?`, station)
+		case Destination:
+			q = q.Where(`"journey"."to" = ?`, station)
+		case Via:
+			q = q.Where(isVia, station)
+		case CallingPoint:
+			// Journeys with manual distances don't have calling points stored, so via stations have to be checked too.
+			q = q.Where("("+isVia+" OR "+isCall+")", station, station)
+		default:
+			q = q.Where(`("journey"."from" = ? OR "journey"."to" = ? OR `+isVia+" OR "+isCall+")", station, station, station, station)
+		}
+	}
+
+	if jf.MinDistance != 0 {
+		q = q.Where(`"journey"."distance" >= ?`, jf.MinDistance)
+	}
+
+	if jf.MaxDistance != 0 {
+		q = q.Where(`"journey"."distance" <= ?`, jf.MaxDistance)
+	}
+
+	if jf.HasReturn != nil {
+		if *jf.HasReturn {
+			q = q.Where(`"journey"."return_id" IS NOT NULL`)
+		} else {
+			q = q.Where(`"journey"."return_id" IS NULL`)
+		}
+	}
+
+	if jf.ManualDistance != nil {
+		q = q.Where(`"journey"."manual_distance" = ?`, *jf.ManualDistance)
+	}
+
+	return q
+}
+
+type JourneySort string
+
+const (
+	SortByDate     JourneySort = "date"
+	SortByDistance JourneySort = "distance"
+)
+
+func ParseJourneySort(x string) (JourneySort, error) {
+	switch s := JourneySort(strings.ToLower(x)); s {
+	case SortByDate, SortByDistance:
+		return s, nil
+	case "":
+		return SortByDate, nil
+	}
+	return "", fmt.Errorf("unknown sort %#v (expected date or distance)", x)
 }
 
 type GetJourneysArgs struct {
-	Since  timeSince
-	Offset int
-	Limit  int
+	UserID uuid.UUID
+	JourneyFilter
+	// SortBy defaults to SortByDate. Journeys are sorted in descending order unless Ascending is set.
+	SortBy    JourneySort
+	Ascending bool
+	Offset    int
+	Limit     int
 }
 
 func (c *Core) GetJourneys(args *GetJourneysArgs) ([]*db.Journey, error) {
@@ -44,23 +140,27 @@ func (c *Core) GetJourneys(args *GetJourneysArgs) ([]*db.Journey, error) {
 
 	q := c.db.DB.NewSelect().
 		Model(&journeys).
-		OrderExpr(`"journey"."date" DESC`)
+		Where(`"journey"."user_id" = ?`, args.UserID)
 
-	if args.Offset != 0 {
-		q = q.Offset(args.Offset)
+	direction := "DESC"
+	if args.Ascending {
+		direction = "ASC"
 	}
 
-	if args.Limit != 0 {
-		q = q.Limit(args.Limit)
+	if args.SortBy == SortByDistance {
+		q = q.OrderExpr(`"journey"."distance" ` + direction)
 	}
+	// The ID is a tiebreaker so that journeys don't move between pages.
+	q = q.OrderExpr(`"journey"."date" ` + direction).OrderExpr(`"journey"."id" ` + direction)
 
-	dur, err := args.Since.SQLDuration()
-	if err != nil {
-		return nil, util.Wrap(err, "getting journeys")
+	q = args.JourneyFilter.apply(q)
+
+	if args.Offset != 0 {
+		q = q.Offset(args.Offset)
 	}
 
-	if dur != "" {
-		q = q.Where(`"journey"."date" > date('now', ?)`, dur)
+	if args.Limit != 0 {
+		q = q.Limit(args.Limit)
 	}
 
 	if err := q.Scan(context.Background()); err != nil {
@@ -72,28 +172,47 @@ func (c *Core) GetJourneys(args *GetJourneysArgs) ([]*db.Journey, error) {
 type JourneyStats struct {
 	Count int     `json:"count"`
 	Miles float32 `json:"miles"`
+	// Spend is the total fare paid for the journeys, in pence. Journeys without a ticket recorded don't count towards
+	// it or towards PencePerMile.
+	Spend        int     `json:"spend,omitempty"`
+	PencePerMile float32 `json:"pencePerMile,omitempty"`
 }
 
-func (c *Core) GetJourneyStats(since timeSince) (*JourneyStats, error) {
+func (c *Core) GetJourneyStats(userID uuid.UUID, filter *JourneyFilter) (*JourneyStats, error) {
 	q := c.db.DB.NewSelect().
 		Model((*db.Journey)(nil)).
-		ColumnExpr("sum(distance), count(*)")
+		ColumnExpr(`sum("journey"."distance"), count(*)`).
+		ColumnExpr(`coalesce(sum(`+ticketShare+`), 0.0)`).
+		ColumnExpr(`coalesce(sum(CASE WHEN "ticket"."id" IS NOT NULL THEN "journey"."distance" END), 0.0)`).
+		Join(ticketJoin).
+		Where(`"journey"."user_id" = ?`, userID)
 
-	dur, err := since.SQLDuration()
-	if err != nil {
-		return nil, util.Wrap(err, "getting journey stats")
+	q = filter.apply(q)
+
+	var (
+		js          = new(JourneyStats)
+		spend       float64
+		costedMiles float32
+	)
+	if err := q.Scan(context.Background(), &js.Miles, &js.Count, &spend, &costedMiles); err != nil {
+		return nil, fmt.Errorf("querying total miles: %w", err)
 	}
+	js.Spend = int(math.Round(spend))
+	js.PencePerMile = pencePerMile(spend, costedMiles)
+
+	return js, nil
+}
 
-	if dur != "" {
-		q = q.Where(`"journey"."date" > date('now', ?)`, dur)
+func whereInDateRange(q *bun.SelectQuery, dr DateRange) *bun.SelectQuery {
+	if !dr.Start.IsZero() {
+		q = q.Where(`"journey"."date" >= ?`, dr.Start.UTC())
 	}
 
-	js := new(JourneyStats)
-	if err := q.Scan(context.Background(), &js.Miles, &js.Count); err != nil {
-		return nil, fmt.Errorf("querying total miles: %w", err)
+	if !dr.End.IsZero() {
+		q = q.Where(`"journey"."date" < ?`, dr.End.UTC())
 	}
 
-	return js, nil
+	return q
 }
 
 func PopulateFullStationNames(journeys []*db.Journey) {
@@ -106,9 +225,13 @@ func PopulateFullStationNames(journeys []*db.Journey) {
 	}
 }
 
-func (c *Core) GetJourney(id uuid.UUID) (*db.Journey, error) {
+func (c *Core) GetJourney(userID, id uuid.UUID) (*db.Journey, error) {
+	return getJourney(c.db.DB, userID, id)
+}
+
+func getJourney(idb bun.IDB, userID, id uuid.UUID) (*db.Journey, error) {
 	j := new(db.Journey)
-	err := c.db.DB.NewSelect().Model(j).Where("id = ?", id).Scan(context.Background(), j)
+	err := idb.NewSelect().Model(j).Where("id = ?", id).Where("user_id = ?", userID).Scan(context.Background(), j)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -118,43 +241,107 @@ func (c *Core) GetJourney(id uuid.UUID) (*db.Journey, error) {
 	return j, nil
 }
 
-func (c *Core) DeleteJourney(id uuid.UUID) error {
-	_, err := c.db.DB.NewDelete().Model((*db.Journey)(nil)).Where("id = ?", id).Exec(context.Background())
-	if err != nil {
-		return err
-	}
-	_, err = c.db.DB.NewUpdate().Model((*db.Journey)(nil)).Set("return_id = null").Where("return_id = ?", id).Exec(context.Background())
-	if err != nil {
-		return err
+// DeleteJourney removes a journey, its calling points, its legs and any claim made for it. If the journey is the
+// return of another, that journey is updated to no longer refer to it. The ticket used for the journey is removed
+// unless it is shared with the return.
+func (c *Core) DeleteJourney(userID, id uuid.UUID) error {
+	return c.inTx(func(tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*db.Journey)(nil)).Where("id = ?", id).Where("user_id = ?", userID).Exec(context.Background())
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().Model((*db.Journey)(nil)).Set("return_id = null").Where("return_id = ?", id).Where("user_id = ?", userID).Exec(context.Background())
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model((*db.Route)(nil)).Where("journey_id = ?", id).Where("user_id = ?", userID).Exec(context.Background())
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model((*db.Leg)(nil)).Where("journey_id = ?", id).Where("user_id = ?", userID).Exec(context.Background())
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model((*db.Claim)(nil)).Where("journey_id = ?", id).Where("user_id = ?", userID).Exec(context.Background())
+		if err != nil {
+			return err
+		}
+		return deleteUnusedTickets(tx, userID)
+	})
+}
+
+// CreateJourney saves a new journey along with its calling points and legs. If createReturn is set, a return journey
+// is created as well. Either everything is saved or nothing is.
+func (c *Core) CreateJourney(journey *db.Journey, route []string, legs []*db.Leg, createReturn bool) error {
+	if journey.PlannedArrival == nil {
+		journey.PlannedArrival = plannedArrival(legs)
 	}
-	_, err = c.db.DB.NewDelete().Model((*db.Route)(nil)).Where("journey_id = ?", id).Exec(context.Background())
-	return err
+
+	return c.inTx(func(tx bun.Tx) error {
+		if err := insertJourney(tx, journey); err != nil {
+			return util.Wrap(err, "inserting journey")
+		}
+
+		if len(route) != 0 {
+			if err := insertRoute(tx, journey.UserID, journey.ID, route); err != nil {
+				return util.Wrap(err, "inserting route")
+			}
+		}
+
+		if len(legs) != 0 {
+			if err := insertLegs(tx, journey.UserID, journey.ID, legs); err != nil {
+				return util.Wrap(err, "inserting legs")
+			}
+		}
+
+		if createReturn {
+			if _, err := createReturnJourney(tx, journey.UserID, journey.ID); err != nil {
+				return util.Wrap(err, "creating return journey")
+			}
+		}
+
+		return nil
+	})
 }
 
-func (c *Core) InsertJourney(journey *db.Journey) error {
-	_, err := c.db.DB.NewInsert().Model(journey).Exec(context.Background())
+func insertJourney(idb bun.IDB, journey *db.Journey) error {
+	_, err := idb.NewInsert().Model(journey).Exec(context.Background())
 	return err
 }
 
-func (c *Core) UpdateJourney(journey *db.Journey) error {
-	_, err := c.db.DB.NewUpdate().Model(journey).WherePK().Exec(context.Background())
+func updateJourney(idb bun.IDB, journey *db.Journey) error {
+	_, err := idb.NewUpdate().Model(journey).WherePK().Where("user_id = ?", journey.UserID).Exec(context.Background())
 	return err
 }
 
 var ErrReturnAlreadyExists = errors.New("return journey already exists")
 
-func (c *Core) CreateReturnJourney(id uuid.UUID) (uuid.UUID, error) {
+func (c *Core) CreateReturnJourney(userID, id uuid.UUID) (uuid.UUID, error) {
+	var newID uuid.UUID
+	err := c.inTx(func(tx bun.Tx) error {
+		var err error
+		newID, err = createReturnJourney(tx, userID, id)
+		return err
+	})
+	return newID, err
+}
+
+func createReturnJourney(idb bun.IDB, userID, id uuid.UUID) (uuid.UUID, error) {
 	sourceJourney := new(db.Journey)
-	if err := c.db.DB.NewSelect().Model(sourceJourney).Where("id = ?", id).Scan(context.Background()); err != nil {
+	if err := idb.NewSelect().Model(sourceJourney).Where("id = ?", id).Where("user_id = ?", userID).Scan(context.Background()); err != nil {
 		return uuid.UUID{}, err
 	}
 	if sourceJourney.ReturnID != nil {
 		return uuid.UUID{}, ErrReturnAlreadyExists
 	}
-	calls, err := c.GetCallingPoints(id)
+	calls, err := getCallingPoints(idb, id)
 	if err != nil {
 		return uuid.UUID{}, err
 	}
+	var legs []*db.Leg
+	if err := idb.NewSelect().Model(&legs).Where("journey_id = ?", id).Order("sequence").Scan(context.Background()); err != nil {
+		return uuid.UUID{}, err
+	}
 
 	var newJourney *db.Journey
 	{
@@ -172,20 +359,121 @@ func (c *Core) CreateReturnJourney(id uuid.UUID) (uuid.UUID, error) {
 	slices.Reverse(newJourney.Via)
 	newJourney.ID = uuid.New()
 	newJourney.ReturnID = &sourceJourney.ID
-	if err := c.InsertJourney(newJourney); err != nil {
+	// The outbound journey may have been made on a single ticket, so the ticket has to be shared explicitly.
+	newJourney.TicketID = nil
+	// The return is made on different trains, see reverseLegs.
+	newJourney.PlannedArrival = nil
+	if err := insertJourney(idb, newJourney); err != nil {
 		return uuid.UUID{}, err
 	}
 	if len(calls) != 0 {
 		slices.Reverse(calls)
-		if err := c.InsertRoute(newJourney.ID, calls); err != nil {
+		if err := insertRoute(idb, userID, newJourney.ID, calls); err != nil {
+			return uuid.UUID{}, err
+		}
+	}
+	if len(legs) != 0 {
+		if err := insertLegs(idb, userID, newJourney.ID, reverseLegs(legs)); err != nil {
 			return uuid.UUID{}, err
 		}
 	}
 
 	sourceJourney.ReturnID = &newJourney.ID
-	if err := c.UpdateJourney(sourceJourney); err != nil {
+	if err := updateJourney(idb, sourceJourney); err != nil {
 		return uuid.UUID{}, err
 	}
 
 	return newJourney.ID, nil
 }
+
+// EditJourney saves changes made to a journey. If replaceRoute is set, the calling points and legs stored for the
+// journey are replaced with route and legs. Otherwise, if the distance has changed, the distances of the legs are
+// scaled to match. The planned arrival of the journey is kept, unless it wasn't known before and legs now gives it.
+//
+// If the journey has a return, the return is updated to match: stations are swapped and reversed, the distance is
+// copied, and the date is changed if it was the same as the original date of this journey.
+func (c *Core) EditJourney(journey *db.Journey, route []string, legs []*db.Leg, replaceRoute bool) error {
+	return c.inTx(func(tx bun.Tx) error {
+		return editJourney(tx, journey, route, legs, replaceRoute)
+	})
+}
+
+func editJourney(idb bun.IDB, journey *db.Journey, route []string, legs []*db.Leg, routeChanged bool) error {
+	existing, err := getJourney(idb, journey.UserID, journey.ID)
+	if err != nil {
+		return util.Wrap(err, "fetching existing journey")
+	}
+	if existing == nil {
+		return sql.ErrNoRows
+	}
+
+	journey.PlannedArrival = existing.PlannedArrival
+	if journey.PlannedArrival == nil && routeChanged {
+		journey.PlannedArrival = plannedArrival(legs)
+	}
+
+	if err := updateJourney(idb, journey); err != nil {
+		return util.Wrap(err, "updating journey")
+	}
+
+	if routeChanged {
+		if err := replaceRoute(idb, journey.UserID, journey.ID, route); err != nil {
+			return util.Wrap(err, "replacing route")
+		}
+		if err := replaceLegs(idb, journey.UserID, journey.ID, legs); err != nil {
+			return util.Wrap(err, "replacing legs")
+		}
+	} else if journey.Distance != existing.Distance {
+		if err := rescaleLegs(idb, journey.UserID, journey.ID, journey.Distance); err != nil {
+			return util.Wrap(err, "rescaling legs")
+		}
+	}
+
+	if journey.ReturnID == nil {
+		return nil
+	}
+
+	returnJourney, err := getJourney(idb, journey.UserID, *journey.ReturnID)
+	if err != nil {
+		return util.Wrap(err, "fetching return journey")
+	}
+	if returnJourney == nil {
+		return nil
+	}
+
+	returnJourney.From, returnJourney.To = journey.To, journey.From
+	returnJourney.Via = nil
+	if len(journey.Via) != 0 {
+		returnJourney.Via = make([]*db.StationName, len(journey.Via))
+		copy(returnJourney.Via, journey.Via)
+		slices.Reverse(returnJourney.Via)
+	}
+	returnJourney.Distance = journey.Distance
+	returnJourney.ManualDistance = journey.ManualDistance
+	returnJourney.InferredDistance = journey.InferredDistance
+	if returnJourney.Date.Equal(existing.Date) {
+		returnJourney.Date = journey.Date
+	}
+
+	if err := updateJourney(idb, returnJourney); err != nil {
+		return util.Wrap(err, "updating return journey")
+	}
+
+	if routeChanged {
+		reversedRoute := make([]string, len(route))
+		copy(reversedRoute, route)
+		slices.Reverse(reversedRoute)
+		if err := replaceRoute(idb, journey.UserID, returnJourney.ID, reversedRoute); err != nil {
+			return util.Wrap(err, "replacing return route")
+		}
+		if err := replaceLegs(idb, journey.UserID, returnJourney.ID, reverseLegs(legs)); err != nil {
+			return util.Wrap(err, "replacing return legs")
+		}
+	} else if journey.Distance != existing.Distance {
+		if err := rescaleLegs(idb, journey.UserID, returnJourney.ID, journey.Distance); err != nil {
+			return util.Wrap(err, "rescaling return legs")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"golang.org/x/exp/slices"
+	"strings"
+	"time"
+)
+
+// lookupLegCache returns a previously resolved distance for the leg from->to, or nil if there isn't one that can be
+// trusted. Entries recorded in the opposite direction are used in reverse.
+//
+// If a service UID was given, the cached entry is only used if every train we've seen on this leg took the same
+// route, since the service could otherwise have taken a different path to the one we'd pick. The UID is kept on the
+// returned leg, along with the operator and headcode if the cached distance was fetched for that same service. Any
+// other details of the service are left to be filled in by RefreshArrivals.
+func (c *Core) lookupLegCache(from, to, serviceUID string) (*DistanceWithRoute, error) {
+	var entries []*db.LegCacheEntry
+	err := c.db.DB.NewSelect().
+		Model(&entries).
+		Where(`("from" = ? AND "to" = ?) OR ("from" = ? AND "to" = ?)`, from, to, to, from).
+		Scan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	type candidate struct {
+		route     []string
+		distance  float32
+		hits      int
+		updatedAt time.Time
+		// latest is the entry for this route that was most recently updated.
+		latest *db.LegCacheEntry
+	}
+
+	candidates := make(map[string]*candidate)
+	for _, entry := range entries {
+		route := entry.Route()
+		if !strings.EqualFold(entry.From, from) {
+			slices.Reverse(route)
+		}
+		key := strings.Join(route, ",")
+
+		if cand, found := candidates[key]; found {
+			cand.hits += entry.Hits
+			if entry.UpdatedAt.After(cand.updatedAt) {
+				cand.distance = entry.Distance
+				cand.updatedAt = entry.UpdatedAt
+				cand.latest = entry
+			}
+		} else {
+			candidates[key] = &candidate{
+				route:     route,
+				distance:  entry.Distance,
+				hits:      entry.Hits,
+				updatedAt: entry.UpdatedAt,
+				latest:    entry,
+			}
+		}
+	}
+
+	if serviceUID != "" && len(candidates) != 1 {
+		return nil, nil
+	}
+
+	var best *candidate
+	for _, cand := range candidates {
+		if best == nil || cand.hits > best.hits || (cand.hits == best.hits && cand.updatedAt.After(best.updatedAt)) {
+			best = cand
+		}
+	}
+
+	dist := &DistanceWithRoute{
+		Distance: best.distance,
+		Route:    best.route,
+	}
+	if serviceUID != "" {
+		leg := &db.Leg{ServiceUID: serviceUID}
+		if strings.EqualFold(best.latest.ServiceUID, serviceUID) {
+			leg.Operator = best.latest.Operator
+			leg.Headcode = best.latest.Headcode
+		}
+		dist.Legs = []*db.Leg{leg}
+	}
+	return dist, nil
+}
+
+func (c *Core) storeLegCache(from, to string, dist *DistanceWithRoute) error {
+	entry := &db.LegCacheEntry{
+		From:          strings.ToUpper(from),
+		To:            strings.ToUpper(to),
+		CallingPoints: strings.Join(dist.Route, ","),
+		Distance:      dist.Distance,
+		Hits:          1,
+		UpdatedAt:     time.Now().UTC(),
+	}
+	if len(dist.Legs) == 1 {
+		entry.ServiceUID = dist.Legs[0].ServiceUID
+		entry.Operator = dist.Legs[0].Operator
+		entry.Headcode = dist.Legs[0].Headcode
+	}
+	_, err := c.db.DB.NewInsert().
+		Model(entry).
+		On(`CONFLICT ("from", "to", "calling_points") DO UPDATE`).
+		Set(`"distance" = EXCLUDED."distance"`).
+		Set(`"hits" = "leg_cache_entry"."hits" + 1`).
+		Set(`"service_uid" = EXCLUDED."service_uid"`).
+		Set(`"operator" = EXCLUDED."operator"`).
+		Set(`"headcode" = EXCLUDED."headcode"`).
+		Set(`"updated_at" = EXCLUDED."updated_at"`).
+		Exec(context.Background())
+	return err
+}
+
+func (c *Core) GetLegCache() ([]*db.LegCacheEntry, error) {
+	var entries []*db.LegCacheEntry
+	err := c.db.DB.NewSelect().Model(&entries).Order("from", "to").Scan(context.Background())
+	return entries, err
+}
+
+// InvalidateLegCache removes every cached distance between two stations, in both directions. The number of entries
+// removed is returned.
+func (c *Core) InvalidateLegCache(from, to string) (int, error) {
+	res, err := c.db.DB.NewDelete().
+		Model((*db.LegCacheEntry)(nil)).
+		Where(`("from" = ? AND "to" = ?) OR ("from" = ? AND "to" = ?)`, from, to, to, from).
+		Exec(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"context"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slices"
+	"strings"
+)
+
+func (c *Core) GetLegs(journeyID uuid.UUID) ([]*db.Leg, error) {
+	var legs []*db.Leg
+	err := c.db.DB.NewSelect().Model(&legs).Where("journey_id = ?", journeyID).Order("sequence").Scan(context.Background())
+	return legs, err
+}
+
+// getLegsByJourney returns the legs of each of journeys, keyed by journey ID.
+func (c *Core) getLegsByJourney(journeys []*db.Journey) (map[uuid.UUID][]*db.Leg, error) {
+	res := make(map[uuid.UUID][]*db.Leg)
+	if len(journeys) == 0 {
+		return res, nil
+	}
+
+	var legs []*db.Leg
+	err := c.db.DB.NewSelect().
+		Model(&legs).
+		Where("journey_id IN (?)", bun.In(util.Map(journeys, func(x *db.Journey) uuid.UUID { return x.ID }))).
+		Order("journey_id", "sequence").
+		Scan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, leg := range legs {
+		res[leg.JourneyID] = append(res[leg.JourneyID], leg)
+	}
+	return res, nil
+}
+
+func insertLegs(idb bun.IDB, userID, journeyID uuid.UUID, legs []*db.Leg) error {
+	var rows []*db.Leg
+	for i, leg := range legs {
+		x := *leg
+		x.JourneyID = journeyID
+		x.UserID = userID
+		x.Sequence = i
+		rows = append(rows, &x)
+	}
+	_, err := idb.NewInsert().Model(&rows).Exec(context.Background())
+	return err
+}
+
+// replaceLegs removes all legs stored for a journey and replaces them with legs.
+func replaceLegs(idb bun.IDB, userID, journeyID uuid.UUID, legs []*db.Leg) error {
+	_, err := idb.NewDelete().Model((*db.Leg)(nil)).Where("journey_id = ?", journeyID).Where("user_id = ?", userID).Exec(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(legs) == 0 {
+		return nil
+	}
+	return insertLegs(idb, userID, journeyID, legs)
+}
+
+// reverseLegs returns the legs of the return of a journey. The distances and calling points are kept, but the
+// services are not, since the return will have been made on different trains.
+func reverseLegs(legs []*db.Leg) []*db.Leg {
+	res := make([]*db.Leg, len(legs))
+	for i, leg := range legs {
+		callingPoints := slices.Clone(leg.CallingPoints)
+		slices.Reverse(callingPoints)
+
+		res[len(legs)-1-i] = &db.Leg{
+			From:          leg.To,
+			To:            leg.From,
+			Distance:      leg.Distance,
+			Inferred:      leg.Inferred,
+			CallingPoints: callingPoints,
+		}
+	}
+	return res
+}
+
+func locateStation(code string) (float32, float32, bool) {
+	if details := GetStationDetail(code); details != nil {
+		return details.Lat, details.Lon, true
+	}
+	return 0, 0, false
+}
+
+// ManualLegs splits a journey with a manually entered distance into legs. services contains the service UID used for
+// each leg, if known. The distance of each leg is estimated from the distance between its stations, so unless there is
+// only one leg, the legs are marked as inferred and aren't used to infer the distances of other journeys.
+func ManualLegs(stations, services []string, distance float32) []*db.Leg {
+	legs := db.BuildLegs(stations, nil, distance, locateStation)
+	for i, leg := range legs {
+		if i < len(services) {
+			leg.ServiceUID = services[i]
+		}
+	}
+	return legs
+}
+
+// rescaleLegs changes the distances of the legs of a journey so that they add up to distance, keeping them in the
+// same proportion to each other.
+func rescaleLegs(idb bun.IDB, userID, journeyID uuid.UUID, distance float32) error {
+	var legs []*db.Leg
+	if err := idb.NewSelect().Model(&legs).Where("journey_id = ?", journeyID).Where("user_id = ?", userID).Scan(context.Background()); err != nil {
+		return err
+	}
+
+	var total float32
+	for _, leg := range legs {
+		total += leg.Distance
+	}
+
+	for _, leg := range legs {
+		if total == 0 {
+			leg.Distance = distance / float32(len(legs))
+		} else {
+			leg.Distance = leg.Distance / total * distance
+		}
+		if _, err := idb.NewUpdate().Model(leg).Column("distance").WherePK().Exec(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// atocNames maps the ATOC codes of current and recent train operating companies to their names.
+var atocNames = map[string]string{
+	"AW": "Transport for Wales",
+	"CC": "c2c",
+	"CH": "Chiltern Railways",
+	"CS": "Caledonian Sleeper",
+	"EM": "East Midlands Railway",
+	"ES": "Eurostar",
+	"GC": "Grand Central",
+	"GN": "Great Northern",
+	"GR": "LNER",
+	"GW": "Great Western Railway",
+	"GX": "Gatwick Express",
+	"HT": "Hull Trains",
+	"HX": "Heathrow Express",
+	"IL": "Island Line",
+	"LD": "Lumo",
+	"LE": "Greater Anglia",
+	"LM": "West Midlands Trains",
+	"LO": "London Overground",
+	"ME": "Merseyrail",
+	"NT": "Northern",
+	"SE": "Southeastern",
+	"SN": "Southern",
+	"SR": "ScotRail",
+	"SW": "South Western Railway",
+	"TL": "Thameslink",
+	"TP": "TransPennine Express",
+	"VT": "Avanti West Coast",
+	"XC": "CrossCountry",
+	"XR": "Elizabeth line",
+}
+
+// OperatorName returns the name of the train operating company with the given ATOC code. If the code isn't known, it
+// is returned as-is.
+func OperatorName(code string) string {
+	if name, found := atocNames[code]; found {
+		return name
+	}
+	return code
+}
+
+type OperatorMileage struct {
+	// Operator is blank for legs where the operator isn't known.
+	Operator string  `json:"operator"`
+	Name     string  `json:"name"`
+	Distance float32 `json:"distance"`
+	Legs     int     `json:"legs"`
+}
+
+// GetOperatorMileage returns the distance a user has travelled with each train operating company, furthest first.
+func (c *Core) GetOperatorMileage(userID uuid.UUID, filter *JourneyFilter) ([]*OperatorMileage, error) {
+	var res []*OperatorMileage
+	err := c.db.DB.NewSelect().
+		ColumnExpr(`coalesce("leg"."operator", '') AS "operator"`).
+		ColumnExpr(`sum("leg"."distance") AS "distance"`).
+		ColumnExpr(`count(*) AS "legs"`).
+		TableExpr(`"railmiles_legs" AS "leg"`).
+		Where(`"leg"."journey_id" IN (?)`, filter.apply(c.db.DB.NewSelect().Model((*db.Journey)(nil)).Column("id").Where("user_id = ?", userID))).
+		Group("operator").
+		Scan(context.Background(), &res)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, om := range res {
+		if om.Operator == "" {
+			om.Name = "Unknown"
+		} else {
+			om.Name = OperatorName(om.Operator)
+		}
+	}
+
+	slices.SortFunc(res, func(a, b *OperatorMileage) int {
+		switch {
+		case a.Distance > b.Distance:
+			return -1
+		case a.Distance < b.Distance:
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return res, nil
+}
@@ -0,0 +1,278 @@
+package core
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// mapCanvas is something that a map can be drawn onto. All coordinates are in pixels from the top left corner.
+type mapCanvas interface {
+	background(col color.RGBA)
+	polygon(points [][2]float64, fill, stroke color.RGBA)
+	polyline(points [][2]float64, width float64, stroke color.RGBA)
+	circle(centre [2]float64, radius float64, fill, stroke color.RGBA)
+	// text draws s with its bottom left corner at pos.
+	text(pos [2]float64, s string, size float64, col color.RGBA)
+	// textWidth estimates how wide text drawn with the same arguments would be.
+	textWidth(s string, size float64) float64
+	encode(w io.Writer) error
+}
+
+type svgCanvas struct {
+	width, height int
+	sb            strings.Builder
+}
+
+func newSVGCanvas(width, height int) *svgCanvas {
+	return &svgCanvas{width: width, height: height}
+}
+
+func svgColour(col color.RGBA) string {
+	return fmt.Sprintf("rgba(%d,%d,%d,%.3f)", col.R, col.G, col.B, float64(col.A)/255)
+}
+
+func svgPoints(points [][2]float64) string {
+	parts := make([]string, len(points))
+	for i, p := range points {
+		parts[i] = fmt.Sprintf("%.1f,%.1f", p[0], p[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (sc *svgCanvas) background(col color.RGBA) {
+	fmt.Fprintf(&sc.sb, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", svgColour(col))
+}
+
+func (sc *svgCanvas) polygon(points [][2]float64, fill, stroke color.RGBA) {
+	fmt.Fprintf(&sc.sb, `<polygon points="%s" fill="%s" stroke="%s" stroke-width="1"/>`+"\n", svgPoints(points), svgColour(fill), svgColour(stroke))
+}
+
+func (sc *svgCanvas) polyline(points [][2]float64, width float64, stroke color.RGBA) {
+	fmt.Fprintf(&sc.sb, `<polyline points="%s" fill="none" stroke="%s" stroke-width="%.1f" stroke-linecap="round" stroke-linejoin="round"/>`+"\n", svgPoints(points), svgColour(stroke), width)
+}
+
+func (sc *svgCanvas) circle(centre [2]float64, radius float64, fill, stroke color.RGBA) {
+	fmt.Fprintf(&sc.sb, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s" stroke="%s" stroke-width="1.5"/>`+"\n", centre[0], centre[1], radius, svgColour(fill), svgColour(stroke))
+}
+
+func (sc *svgCanvas) text(pos [2]float64, s string, size float64, col color.RGBA) {
+	fmt.Fprintf(&sc.sb, `<text x="%.1f" y="%.1f" font-family="sans-serif" font-size="%.0f" fill="%s" stroke="white" stroke-width="3" paint-order="stroke">`, pos[0], pos[1], size, svgColour(col))
+	_ = xml.EscapeText(&sc.sb, []byte(s))
+	sc.sb.WriteString("</text>\n")
+}
+
+func (sc *svgCanvas) textWidth(s string, size float64) float64 {
+	// roughly the average width of a character in common sans-serif fonts
+	return float64(len([]rune(s))) * size * 0.55
+}
+
+func (sc *svgCanvas) encode(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n%s</svg>\n", sc.width, sc.height, sc.width, sc.height, sc.sb.String())
+	return err
+}
+
+// pngCanvas is a very small rasteriser. There's no anti-aliasing for filled polygons and text is drawn with a built-in
+// bitmap font that only has capital letters.
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPNGCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+// blend draws col over the pixel at x, y with its alpha scaled by coverage, which should be between 0 and 1.
+func (pc *pngCanvas) blend(x, y int, col color.RGBA, coverage float64) {
+	if !(image.Point{X: x, Y: y}.In(pc.img.Rect)) || coverage <= 0 {
+		return
+	}
+	a := float64(col.A) / 255 * min(coverage, 1)
+	dst := pc.img.RGBAAt(x, y)
+	mix := func(s, d uint8) uint8 {
+		return uint8(math.Round(float64(s)*a + float64(d)*(1-a)))
+	}
+	pc.img.SetRGBA(x, y, color.RGBA{
+		R: mix(col.R, dst.R),
+		G: mix(col.G, dst.G),
+		B: mix(col.B, dst.B),
+		A: uint8(math.Round(255*a + float64(dst.A)*(1-a))),
+	})
+}
+
+func (pc *pngCanvas) background(col color.RGBA) {
+	for y := pc.img.Rect.Min.Y; y < pc.img.Rect.Max.Y; y += 1 {
+		for x := pc.img.Rect.Min.X; x < pc.img.Rect.Max.X; x += 1 {
+			pc.img.SetRGBA(x, y, col)
+		}
+	}
+}
+
+func (pc *pngCanvas) polygon(points [][2]float64, fill, stroke color.RGBA) {
+	// Scanline fill using the even-odd rule
+	for y := pc.img.Rect.Min.Y; y < pc.img.Rect.Max.Y; y += 1 {
+		sy := float64(y) + 0.5
+		var xs []float64
+		for i := range points {
+			a, b := points[i], points[(i+1)%len(points)]
+			if (a[1] <= sy && b[1] > sy) || (b[1] <= sy && a[1] > sy) {
+				xs = append(xs, a[0]+(sy-a[1])/(b[1]-a[1])*(b[0]-a[0]))
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			for x := int(math.Ceil(xs[i] - 0.5)); float64(x)+0.5 < xs[i+1]; x += 1 {
+				pc.blend(x, y, fill, 1)
+			}
+		}
+	}
+
+	pc.polyline(append(points, points[0]), 1, stroke)
+}
+
+func (pc *pngCanvas) polyline(points [][2]float64, width float64, stroke color.RGBA) {
+	// Each pixel is only drawn once, at the coverage of the segment it's closest to, so that translucent lines don't
+	// get darker where segments join.
+	coverage := make(map[image.Point]float64)
+	half := width / 2
+
+	for i := 0; i+1 < len(points); i += 1 {
+		a, b := points[i], points[i+1]
+		minX := int(math.Floor(min(a[0], b[0]) - half - 1))
+		maxX := int(math.Ceil(max(a[0], b[0]) + half + 1))
+		minY := int(math.Floor(min(a[1], b[1]) - half - 1))
+		maxY := int(math.Ceil(max(a[1], b[1]) + half + 1))
+
+		for y := minY; y <= maxY; y += 1 {
+			for x := minX; x <= maxX; x += 1 {
+				d := distanceToSegment([2]float64{float64(x) + 0.5, float64(y) + 0.5}, a, b)
+				if c := half + 0.5 - d; c > 0 {
+					p := image.Point{X: x, Y: y}
+					coverage[p] = max(coverage[p], c)
+				}
+			}
+		}
+	}
+
+	for p, c := range coverage {
+		pc.blend(p.X, p.Y, stroke, c)
+	}
+}
+
+func distanceToSegment(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if l := dx*dx + dy*dy; l != 0 {
+		t = max(0, min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/l))
+	}
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
+
+func (pc *pngCanvas) circle(centre [2]float64, radius float64, fill, stroke color.RGBA) {
+	for y := int(centre[1] - radius - 2); y <= int(centre[1]+radius+2); y += 1 {
+		for x := int(centre[0] - radius - 2); x <= int(centre[0]+radius+2); x += 1 {
+			d := math.Hypot(float64(x)+0.5-centre[0], float64(y)+0.5-centre[1])
+			pc.blend(x, y, fill, radius+0.5-d)
+			pc.blend(x, y, stroke, 0.75+0.5-math.Abs(d-radius))
+		}
+	}
+}
+
+func bitmapFontScale(size float64) int {
+	return max(1, int(math.Round(size/8)))
+}
+
+func (pc *pngCanvas) textWidth(s string, size float64) float64 {
+	return float64(len([]rune(s)) * 6 * bitmapFontScale(size))
+}
+
+func (pc *pngCanvas) text(pos [2]float64, s string, size float64, col color.RGBA) {
+	scale := bitmapFontScale(size)
+	x0, y0 := int(pos[0]), int(pos[1])-7*scale
+
+	draw := func(offsetX, offsetY int, col color.RGBA) {
+		for i, r := range []rune(strings.ToUpper(s)) {
+			glyph, found := bitmapFont[r]
+			if !found {
+				continue
+			}
+			for row, line := range glyph {
+				for column, bit := range line {
+					if bit != '1' {
+						continue
+					}
+					for dy := 0; dy < scale; dy += 1 {
+						for dx := 0; dx < scale; dx += 1 {
+							pc.blend(x0+offsetX+(i*6+column)*scale+dx, y0+offsetY+row*scale+dy, col, 1)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// white halo so text can be read over lines
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	for _, offset := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		draw(offset[0], offset[1], white)
+	}
+	draw(0, 0, col)
+}
+
+func (pc *pngCanvas) encode(w io.Writer) error {
+	return png.Encode(w, pc.img)
+}
+
+// bitmapFont is a 5x7 pixel font. Characters that aren't included are drawn as spaces.
+var bitmapFont = map[rune][7]string{
+	'A':  {"01110", "10001", "10001", "11111", "10001", "10001", "10001"},
+	'B':  {"11110", "10001", "10001", "11110", "10001", "10001", "11110"},
+	'C':  {"01110", "10001", "10000", "10000", "10000", "10001", "01110"},
+	'D':  {"11110", "10001", "10001", "10001", "10001", "10001", "11110"},
+	'E':  {"11111", "10000", "10000", "11110", "10000", "10000", "11111"},
+	'F':  {"11111", "10000", "10000", "11110", "10000", "10000", "10000"},
+	'G':  {"01110", "10001", "10000", "10111", "10001", "10001", "01111"},
+	'H':  {"10001", "10001", "10001", "11111", "10001", "10001", "10001"},
+	'I':  {"01110", "00100", "00100", "00100", "00100", "00100", "01110"},
+	'J':  {"00111", "00010", "00010", "00010", "00010", "10010", "01100"},
+	'K':  {"10001", "10010", "10100", "11000", "10100", "10010", "10001"},
+	'L':  {"10000", "10000", "10000", "10000", "10000", "10000", "11111"},
+	'M':  {"10001", "11011", "10101", "10101", "10001", "10001", "10001"},
+	'N':  {"10001", "10001", "11001", "10101", "10011", "10001", "10001"},
+	'O':  {"01110", "10001", "10001", "10001", "10001", "10001", "01110"},
+	'P':  {"11110", "10001", "10001", "11110", "10000", "10000", "10000"},
+	'Q':  {"01110", "10001", "10001", "10001", "10101", "10010", "01101"},
+	'R':  {"11110", "10001", "10001", "11110", "10100", "10010", "10001"},
+	'S':  {"01111", "10000", "10000", "01110", "00001", "00001", "11110"},
+	'T':  {"11111", "00100", "00100", "00100", "00100", "00100", "00100"},
+	'U':  {"10001", "10001", "10001", "10001", "10001", "10001", "01110"},
+	'V':  {"10001", "10001", "10001", "10001", "10001", "01010", "00100"},
+	'W':  {"10001", "10001", "10001", "10101", "10101", "10101", "01010"},
+	'X':  {"10001", "10001", "01010", "00100", "01010", "10001", "10001"},
+	'Y':  {"10001", "10001", "01010", "00100", "00100", "00100", "00100"},
+	'Z':  {"11111", "00001", "00010", "00100", "01000", "10000", "11111"},
+	'0':  {"01110", "10001", "10011", "10101", "11001", "10001", "01110"},
+	'1':  {"00100", "01100", "00100", "00100", "00100", "00100", "01110"},
+	'2':  {"01110", "10001", "00001", "00010", "00100", "01000", "11111"},
+	'3':  {"11111", "00010", "00100", "00010", "00001", "10001", "01110"},
+	'4':  {"00010", "00110", "01010", "10010", "11111", "00010", "00010"},
+	'5':  {"11111", "10000", "11110", "00001", "00001", "10001", "01110"},
+	'6':  {"00110", "01000", "10000", "11110", "10001", "10001", "01110"},
+	'7':  {"11111", "00001", "00010", "00100", "01000", "01000", "01000"},
+	'8':  {"01110", "10001", "10001", "01110", "10001", "10001", "01110"},
+	'9':  {"01110", "10001", "10001", "01111", "00001", "00010", "01100"},
+	'-':  {"00000", "00000", "00000", "11111", "00000", "00000", "00000"},
+	'.':  {"00000", "00000", "00000", "00000", "00000", "01100", "01100"},
+	',':  {"00000", "00000", "00000", "00000", "01100", "00100", "01000"},
+	'\'': {"01100", "00100", "01000", "00000", "00000", "00000", "00000"},
+	'&':  {"01100", "10010", "10100", "01000", "10101", "10010", "01101"},
+	'(':  {"00010", "00100", "01000", "01000", "01000", "00100", "00010"},
+	')':  {"01000", "00100", "00010", "00010", "00010", "00100", "01000"},
+	'/':  {"00001", "00010", "00010", "00100", "01000", "01000", "10000"},
+}
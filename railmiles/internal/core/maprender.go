@@ -0,0 +1,234 @@
+package core
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+)
+
+// gbCoastlineRaw is a simplified outline of Great Britain, Anglesey and the Isle of Wight as a list of rings of
+// [lon, lat] coordinates.
+//
+//go:embed gbCoastline.json
+var gbCoastlineRaw []byte
+
+// gbCoastline is decoded from gbCoastlineRaw by loadCoastline when the core is created.
+var gbCoastline [][][2]float64
+
+func loadCoastline() error {
+	var rings [][][2]float64
+	if err := json.Unmarshal(gbCoastlineRaw, &rings); err != nil {
+		return err
+	}
+	gbCoastline = rings
+	return nil
+}
+
+type MapFormat string
+
+const (
+	MapSVG MapFormat = "svg"
+	MapPNG MapFormat = "png"
+)
+
+func ParseMapFormat(x string) (MapFormat, error) {
+	switch f := MapFormat(strings.ToLower(x)); f {
+	case MapSVG, MapPNG:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown map format %#v (expected svg or png)", x)
+}
+
+func (mf MapFormat) ContentType() string {
+	if mf == MapPNG {
+		return "image/png"
+	}
+	return "image/svg+xml"
+}
+
+const (
+	MaxMapSize = 4000
+	minMapSize = 100
+)
+
+type MapOptions struct {
+	Format MapFormat
+	Width  int
+	Height int
+	// Labels causes the name of every station that a journey starts or ends at to be drawn.
+	Labels    bool
+	DateRange DateRange
+}
+
+func (mo *MapOptions) Validate() error {
+	if mo.Width < minMapSize || mo.Width > MaxMapSize || mo.Height < minMapSize || mo.Height > MaxMapSize {
+		return fmt.Errorf("map width and height must be between %d and %d pixels", minMapSize, MaxMapSize)
+	}
+	return nil
+}
+
+var (
+	mapSeaColour     = color.RGBA{R: 0xdb, G: 0xea, B: 0xfe, A: 0xff}
+	mapLandColour    = color.RGBA{R: 0xf8, G: 0xf9, B: 0xfa, A: 0xff}
+	mapCoastColour   = color.RGBA{R: 0x94, G: 0xa3, B: 0xb8, A: 0xff}
+	mapJourneyColour = color.RGBA{R: 0xdc, G: 0x35, B: 0x45, A: 0xb0}
+	mapStationColour = color.RGBA{R: 0x21, G: 0x25, B: 0x29, A: 0xff}
+	mapWhite         = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+)
+
+// mapProjection converts [lon, lat] coordinates into pixels using an equirectangular projection centred on the area
+// being drawn.
+type mapProjection struct {
+	lonScale         float64
+	scale            float64
+	offsetX, offsetY float64
+	minLon, maxLat   float64
+}
+
+// newMapProjection fits the area between the given bounds into an image of the given size, with a margin around the
+// edge.
+func newMapProjection(minLon, minLat, maxLon, maxLat float64, width, height int) *mapProjection {
+	const minSpan = 0.5 // degrees
+
+	if d := minSpan - (maxLon - minLon); d > 0 {
+		minLon -= d / 2
+		maxLon += d / 2
+	}
+	if d := minSpan - (maxLat - minLat); d > 0 {
+		minLat -= d / 2
+		maxLat += d / 2
+	}
+
+	lonPad, latPad := (maxLon-minLon)*0.1, (maxLat-minLat)*0.1
+	minLon, maxLon, minLat, maxLat = minLon-lonPad, maxLon+lonPad, minLat-latPad, maxLat+latPad
+
+	mp := &mapProjection{
+		lonScale: math.Cos((minLat + maxLat) / 2 * math.Pi / 180),
+		minLon:   minLon,
+		maxLat:   maxLat,
+	}
+
+	spanX := (maxLon - minLon) * mp.lonScale
+	spanY := maxLat - minLat
+	mp.scale = min(float64(width)/spanX, float64(height)/spanY)
+	mp.offsetX = (float64(width) - spanX*mp.scale) / 2
+	mp.offsetY = (float64(height) - spanY*mp.scale) / 2
+
+	return mp
+}
+
+func (mp *mapProjection) project(lon, lat float64) [2]float64 {
+	return [2]float64{
+		mp.offsetX + (lon-mp.minLon)*mp.lonScale*mp.scale,
+		mp.offsetY + (mp.maxLat-lat)*mp.scale,
+	}
+}
+
+// RenderJourneyMap draws every journey a user made in opts.DateRange onto a map of Great Britain and
+// writes it to w as an SVG or PNG image. The lines are the same as those in the GeoJSON used by the web interface.
+func (c *Core) RenderJourneyMap(w io.Writer, userID uuid.UUID, opts *MapOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	journeys, err := c.GetJourneys(&GetJourneysArgs{UserID: userID, JourneyFilter: JourneyFilter{DateRange: opts.DateRange}, Ascending: true})
+	if err != nil {
+		return util.Wrap(err, "fetching journeys")
+	}
+	PopulateFullStationNames(journeys)
+
+	callingPoints, err := c.getAllCallingPoints(userID)
+	if err != nil {
+		return util.Wrap(err, "fetching calling points")
+	}
+
+	tracks := mapTracks(journeys, callingPoints)
+
+	var stations []*StationDetail
+	for _, station := range journeyStations(journeys, false) {
+		if details := GetStationDetail(station[0]); details != nil {
+			stations = append(stations, details)
+		}
+	}
+
+	// Default to showing the whole of GB, but zoom in on the journeys if there are any.
+	minLon, minLat, maxLon, maxLat := -6.5, 49.9, 1.8, 58.7
+	if len(stations) != 0 {
+		minLon, minLat, maxLon, maxLat = math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+		extend := func(lon, lat float64) {
+			minLon, maxLon = min(minLon, lon), max(maxLon, lon)
+			minLat, maxLat = min(minLat, lat), max(maxLat, lat)
+		}
+		for _, station := range stations {
+			extend(float64(station.Lon), float64(station.Lat))
+		}
+		for _, track := range tracks {
+			for _, coord := range track.coords {
+				extend(float64(coord[0]), float64(coord[1]))
+			}
+		}
+	}
+
+	proj := newMapProjection(minLon, minLat, maxLon, maxLat, opts.Width, opts.Height)
+
+	var canvas mapCanvas
+	switch opts.Format {
+	case MapPNG:
+		canvas = newPNGCanvas(opts.Width, opts.Height)
+	default:
+		canvas = newSVGCanvas(opts.Width, opts.Height)
+	}
+
+	// Lines and text are scaled with the size of the image so that large images don't look spindly.
+	unit := max(1, float64(min(opts.Width, opts.Height))/500)
+
+	canvas.background(mapSeaColour)
+
+	for _, ring := range gbCoastline {
+		points := make([][2]float64, len(ring))
+		for i, coord := range ring {
+			points[i] = proj.project(coord[0], coord[1])
+		}
+		canvas.polygon(points, mapLandColour, mapCoastColour)
+	}
+
+	for _, track := range tracks {
+		points := make([][2]float64, len(track.coords))
+		for i, coord := range track.coords {
+			points[i] = proj.project(float64(coord[0]), float64(coord[1]))
+		}
+		canvas.polyline(points, 2.5*unit, mapJourneyColour)
+	}
+
+	for _, station := range stations {
+		canvas.circle(proj.project(float64(station.Lon), float64(station.Lat)), 3*unit, mapWhite, mapStationColour)
+	}
+
+	if opts.Labels {
+		for _, station := range stations {
+			pos := proj.project(float64(station.Lon), float64(station.Lat))
+			size := 11 * unit
+			x := pos[0] + 5*unit
+			if width := canvas.textWidth(station.Name, size); x+width > float64(opts.Width) {
+				// put the label on the left of the station instead of letting it go off the edge
+				x = pos[0] - 5*unit - width
+			}
+			canvas.text([2]float64{x, pos[1] - 3*unit}, station.Name, size, mapStationColour)
+		}
+	}
+
+	var totalDistance float32
+	for _, journey := range journeys {
+		totalDistance += journey.Distance
+	}
+	caption := fmt.Sprintf("%d journeys, %.1f miles", len(journeys), totalDistance)
+	canvas.text([2]float64{8 * unit, float64(opts.Height) - 8*unit}, caption, 14*unit, mapStationColour)
+
+	return canvas.encode(w)
+}
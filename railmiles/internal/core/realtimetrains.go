@@ -7,124 +7,232 @@ import (
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/carlmjohnson/requests"
+	"github.com/codemicro/railmiles/railmiles/internal/config"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
 	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"golang.org/x/exp/slog"
+	"io"
 	"math"
+	"net"
+	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
-type DistanceWithRoute struct {
-	Distance float32
-	Route    []string
+func init() {
+	RegisterDistanceProvider("realtimetrains", func(conf *config.Config) (DistanceProvider, error) {
+		if conf.RealTimeTrains.Username == "" || conf.RealTimeTrains.Password == "" {
+			return nil, errors.New("realtimetrains distance provider requires API credentials")
+		}
+		return &realTimeTrains{
+			username: conf.RealTimeTrains.Username,
+			password: conf.RealTimeTrains.Password,
+		}, nil
+	})
 }
 
-func (dwr *DistanceWithRoute) Add(dw2 *DistanceWithRoute) {
-	dwr.Distance += dw2.Distance
-	dwr.Route = append(dwr.Route, dw2.Route...)
+// realTimeTrains searches for services using the api.rtt.io API and scrapes mileages from the realtimetrains.co.uk
+// detailed service pages, since the API does not expose them.
+type realTimeTrains struct {
+	username string
+	password string
 }
 
-func (c *Core) GetRouteDistance(stations []string, inputServices []string, date time.Time, statusChan chan *util.SSEItem) (*DistanceWithRoute, error) {
-	year := strconv.Itoa(time.Now().Year())
-	month := strconv.Itoa(int(time.Now().Month()))
-	if len(month) == 1 {
-		month = "0" + month
+func (rtt *realTimeTrains) SearchServices(ctx context.Context, from, to string, date time.Time) ([]string, error) {
+	var rttResp struct {
+		Services []struct {
+			ServiceUid     string `json:"serviceUid"`
+			IsPassenger    bool   `json:"isPassenger"`
+			RunDate        string `json:"runDate"`
+			LocationDetail struct {
+				DisplayAs string `json:"displayAs"`
+			} `json:"locationDetail"`
+		} `json:"services"`
 	}
-	day := strconv.Itoa(time.Now().Day())
-	if len(day) == 1 {
-		day = "0" + day
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	err := requests.
+		URL("https://api.rtt.io").
+		Pathf("/api/v1/json/search/%s/to/%s/%s", from, to, date.Format("2006/01/02")).
+		ToJSON(&rttResp).
+		BasicAuth(rtt.username, rtt.password).
+		Fetch(ctx)
+	if err != nil {
+		return nil, rttRequestError(err)
 	}
-	todayRunDate := date.Format("2006-01-02")
 
-	var services [][]string
-	for _, x := range inputServices {
-		if x != "" {
-			services = append(services, []string{x})
-		} else {
-			services = append(services, nil)
+	runDate := date.Format("2006-01-02")
+
+	var possibleUIDs []string
+	for _, service := range rttResp.Services {
+		if len(possibleUIDs) == 10 {
+			break
+		}
+		if service.RunDate == runDate && // If this train started on a different date and runs through midnight
+			!strings.EqualFold(service.LocationDetail.DisplayAs, "CANCELLED_CALL") && // If this train was cancelled
+			service.IsPassenger {
+			possibleUIDs = append(possibleUIDs, service.ServiceUid)
 		}
 	}
+	return possibleUIDs, nil
+}
 
-	for i := 0; i < len(stations)-1; i += 1 {
-		if len(services[i]) == 0 {
-			var rttResp struct {
-				Services []struct {
-					ServiceUid     string `json:"serviceUid"`
-					IsPassenger    bool   `json:"isPassenger"`
-					RunDate        string `json:"runDate"`
-					LocationDetail struct {
-						DisplayAs string `json:"displayAs"`
-					} `json:"locationDetail"`
-				} `json:"services"`
-			}
-			util.SendSSE(statusChan, "status", fmt.Sprintf("Searching for services for leg %s->%s", stations[i], stations[i+1]))
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-			err := requests.
-				URL("https://api.rtt.io").
-				Pathf("/api/v1/json/search/%s/to/%s/%s/%s/%s", stations[i], stations[i+1], year, month, day).
-				ToJSON(&rttResp).
-				BasicAuth(c.config.RealTimeTrains.Username, c.config.RealTimeTrains.Password).
-				Fetch(ctx)
-			cancel()
-			if err != nil {
-				return nil, fmt.Errorf("search for service %s->%s: %w", stations[i], stations[i+1], err)
-			}
+func (rtt *realTimeTrains) ServiceDistance(ctx context.Context, uid, from, to string, date time.Time) (*DistanceWithRoute, error) {
+	doc, err := rtt.getServicePage(ctx, uid, date)
+	if err != nil {
+		return nil, err
+	}
 
-			var possibleUIDs []string
-			for _, service := range rttResp.Services {
-				if len(possibleUIDs) == 10 {
-					break
-				}
-				if service.RunDate == todayRunDate && // If this train started on a different date and runs through midnight
-					!strings.EqualFold(service.LocationDetail.DisplayAs, "CANCELLED_CALL") && // If this train was cancelled
-					service.IsPassenger {
-					possibleUIDs = append(possibleUIDs, service.ServiceUid)
-				}
-			}
-			if len(possibleUIDs) == 0 {
-				return nil, errors.New("no route found")
-			}
-			services[i] = possibleUIDs
-		}
+	dist, err := getSingleTrainDistance(doc, from, to)
+	if err != nil {
+		return nil, err
 	}
+	dist.Legs = []*db.Leg{getServiceDetails(doc, uid, from, to, date)}
 
-	var total DistanceWithRoute
-	for i := 0; i < len(stations)-1; i += 1 {
-		if i != 0 {
-			total.Route = append(total.Route, stations[i])
-		}
-		var dist *DistanceWithRoute
-		for _, serv := range services[i] {
-			util.SendSSE(statusChan, "status", fmt.Sprintf("Fetching distance for service %s (for leg %s->%s)", serv, stations[i], stations[i+1]))
+	return dist, nil
+}
 
-			d, err := c.getSingleTrainDistance(serv, stations[i], stations[i+1], date)
-			if err != nil {
-				if !errors.Is(err, noDistancesError) {
-					return nil, util.Wrap(err, "scraping train")
-				}
-				continue
+var headcodeRegexp = regexp.MustCompile(`\b\d[A-Z]\d{2}\b`)
+
+// getServiceDetails reads the operator and headcode of a service from its detailed RTT page, along with its scheduled
+// and actual times at departure and destination. Anything that isn't on the page is left blank, since the details of
+// the service are nice to have but not worth failing over when we have the distance.
+func getServiceDetails(doc *goquery.Document, uid, departure, destination string, date time.Time) *db.Leg {
+	header := doc.Find(".header").First()
+	leg := &db.Leg{
+		ServiceUID: uid,
+		Operator:   strings.TrimSpace(header.Find(".toc").First().Text()),
+		Headcode:   headcodeRegexp.FindString(header.Text()),
+	}
+
+	// Times from RTT are in UK local time.
+	ukTimezone, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		slog.Warn("unable to load UK timezone", "err", err)
+		return leg
+	}
+	runDate := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, ukTimezone)
+
+	// The page doesn't say which times are on the day after the service started, so that has to be worked out from
+	// the scheduled times going backwards.
+	var (
+		departed    bool
+		nextDay     bool
+		lastMinutes = -1
+	)
+	scheduledTime := func(selection *goquery.Selection) *time.Time {
+		x := strings.TrimSpace(selection.First().Text())
+		if m := rttMinutes(x); m != -1 {
+			if lastMinutes != -1 && m < lastMinutes-12*60 {
+				nextDay = true
 			}
-			dist = d
-			break
+			lastMinutes = m
 		}
+		return rttTime(runDate, x, nextDay)
+	}
 
-		if dist == nil {
-			return nil, util.UserError(fmt.Errorf("no distance information provided for %s -> %s (tried %s) - manual distance required", stations[i], stations[i+1], strings.Join(services[i], ", ")))
+	doc.Find(".location.call,.location.pass").EachWithBreak(func(i int, selection *goquery.Selection) bool {
+		crs := shortcodeRegexp.FindString(selection.Find(".location a").Text())
+		scheduledArrival := scheduledTime(selection.Find(".gbtt .arr"))
+		scheduledDeparture := scheduledTime(selection.Find(".gbtt .dep"))
+
+		if !departed && strings.EqualFold(crs, departure) {
+			departed = true
+			leg.ScheduledDeparture = scheduledDeparture
+			leg.ActualDeparture = rttActualTime(scheduledDeparture, ukTimezone, selection.Find(".realtime .dep.act").First().Text())
+		} else if departed && strings.EqualFold(crs, destination) {
+			leg.ScheduledArrival = scheduledArrival
+			leg.ActualArrival = rttActualTime(scheduledArrival, ukTimezone, selection.Find(".realtime .arr.act").First().Text())
+			return false
 		}
+		return true
+	})
+
+	return leg
+}
+
+// rttMinutes returns the number of minutes after midnight of a time in the form HHMM, or -1 if x is not a valid time.
+// Anything after the minutes (such as a half minute) is ignored.
+func rttMinutes(x string) int {
+	if len(x) < 4 {
+		return -1
+	}
+	hours, err := strconv.Atoi(x[:2])
+	if err != nil {
+		return -1
+	}
+	minutes, err := strconv.Atoi(x[2:4])
+	if err != nil {
+		return -1
+	}
+	return hours*60 + minutes
+}
 
-		total.Add(dist)
+// rttActualTime converts the actual time a service arrived or departed somewhere, in the form HHMM in the timezone loc,
+// to UTC. The time is taken to be within 12 hours of scheduled. nil is returned if either is missing.
+func rttActualTime(scheduled *time.Time, loc *time.Location, x string) *time.Time {
+	if scheduled == nil {
+		return nil
 	}
 
-	return &total, nil
+	local := scheduled.In(loc)
+	t := rttTime(time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc), strings.TrimSpace(x), false)
+	if t == nil {
+		return nil
+	}
+
+	if diff := t.Sub(*scheduled); diff < -12*time.Hour {
+		*t = t.AddDate(0, 0, 1)
+	} else if diff > 12*time.Hour {
+		*t = t.AddDate(0, 0, -1)
+	}
+	return t
 }
 
-var shortcodeRegexp = regexp.MustCompile(`[A-Z]{3}`)
+// rttTime converts a time in the form HHMM on the day a service ran, in the timezone of runDate, to UTC. nil is
+// returned if x is not a valid time.
+func rttTime(runDate time.Time, x string, nextDay bool) *time.Time {
+	m := rttMinutes(x)
+	if m == -1 {
+		return nil
+	}
 
-var noDistancesError = errors.New("no distances available")
+	if nextDay {
+		runDate = runDate.AddDate(0, 0, 1)
+	}
+	t := time.Date(runDate.Year(), runDate.Month(), runDate.Day(), m/60, m%60, 0, 0, runDate.Location()).UTC()
+	return &t
+}
 
-func (c *Core) getSingleTrainDistance(uid, departure, destination string, date time.Time) (*DistanceWithRoute, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+// rttRequestError wraps an error from a request to RTT with ErrProviderUnavailable if trying again later might work,
+// which is when RTT couldn't be reached, or it responded with a server error or asked us to slow down. Anything else,
+// such as a 404 for a service that doesn't exist or a response that can't be decoded, is returned as is.
+func rttRequestError(err error) error {
+	var (
+		respErr *requests.ResponseError
+		netErr  net.Error
+	)
+	switch {
+	case errors.As(err, &respErr):
+		if respErr.StatusCode != http.StatusTooManyRequests && respErr.StatusCode < 500 {
+			return err
+		}
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF):
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+}
+
+var shortcodeRegexp = regexp.MustCompile(`[A-Z]{3}`)
+
+// getServicePage fetches the detailed RTT page for a service, which includes the mileage of each location it passes.
+func (rtt *realTimeTrains) getServicePage(ctx context.Context, uid string, date time.Time) (*goquery.Document, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
 
 	var htmlContent string
@@ -134,7 +242,7 @@ func (c *Core) getSingleTrainDistance(uid, departure, destination string, date t
 		ToString(&htmlContent).
 		Fetch(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("fetch train with UID %s: %w", uid, err)
+		return nil, fmt.Errorf("fetch train with UID %s: %w", uid, rttRequestError(err))
 	}
 
 	doc, err := goquery.NewDocumentFromReader(bytes.NewBufferString(htmlContent))
@@ -142,6 +250,10 @@ func (c *Core) getSingleTrainDistance(uid, departure, destination string, date t
 		return nil, fmt.Errorf("load RTT HTML: %w", err)
 	}
 
+	return doc, nil
+}
+
+func getSingleTrainDistance(doc *goquery.Document, departure, destination string) (*DistanceWithRoute, error) {
 	var waypoints [][3]string
 
 	doc.Find(".location.call,.location.pass").Each(func(i int, selection *goquery.Selection) {
@@ -165,7 +277,7 @@ func (c *Core) getSingleTrainDistance(uid, departure, destination string, date t
 	for _, wp := range waypoints {
 		if strings.EqualFold(wp[0], departure) || strings.EqualFold(wp[0], destination) {
 			if wp[1] == "" || wp[2] == "" {
-				return nil, noDistancesError
+				return nil, ErrNoDistances
 				//return nil, util.UserError(fmt.Errorf("no distance information provided for %s -> %s (%s) - manual distance required", departure, destination, uid))
 			}
 			miles, err := strconv.Atoi(wp[1])
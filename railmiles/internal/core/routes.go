@@ -4,18 +4,24 @@ import (
 	"context"
 	"github.com/codemicro/railmiles/railmiles/internal/db"
 	"github.com/google/uuid"
+	"github.com/uptrace/bun"
 )
 
 func (c *Core) GetCallingPoints(journeyID uuid.UUID) ([]string, error) {
+	return getCallingPoints(c.db.DB, journeyID)
+}
+
+func getCallingPoints(idb bun.IDB, journeyID uuid.UUID) ([]string, error) {
 	var route []string
-	err := c.db.DB.NewSelect().Model((*db.Route)(nil)).Column("station").Where(`journey_id = ?`, journeyID).Order("sequence").Scan(context.Background(), &route)
+	err := idb.NewSelect().Model((*db.Route)(nil)).Column("station").Where(`journey_id = ?`, journeyID).Order("sequence").Scan(context.Background(), &route)
 	return route, err
 }
 
-func (c *Core) InsertRoute(journeyID uuid.UUID, route []string) error {
+func insertRoute(idb bun.IDB, userID, journeyID uuid.UUID, route []string) error {
 	var routeParts []*db.Route
 	r := &db.Route{
 		JourneyID: journeyID,
+		UserID:    userID,
 	}
 	for i, point := range route {
 		rq := *r
@@ -23,6 +29,18 @@ func (c *Core) InsertRoute(journeyID uuid.UUID, route []string) error {
 		rq.Station = point
 		routeParts = append(routeParts, &rq)
 	}
-	_, err := c.db.DB.NewInsert().Model(&routeParts).Exec(context.Background())
+	_, err := idb.NewInsert().Model(&routeParts).Exec(context.Background())
 	return err
 }
+
+// replaceRoute removes all calling points stored for a journey and replaces them with route.
+func replaceRoute(idb bun.IDB, userID, journeyID uuid.UUID, route []string) error {
+	_, err := idb.NewDelete().Model((*db.Route)(nil)).Where("journey_id = ?", journeyID).Where("user_id = ?", userID).Exec(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(route) == 0 {
+		return nil
+	}
+	return insertRoute(idb, userID, journeyID, route)
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StationDetail struct {
+	Name string
+	Lat  float32
+	Lon  float32
+	// Country is one of England, Scotland or Wales, and Region is the ITL1 region (for example, "North West" - all of
+	// Scotland and all of Wales are regions of their own). County is the county or unitary authority. Any of these
+	// may be blank if the station data was generated without them.
+	Country string
+	Region  string
+	County  string
+}
+
+// stationData is a copy of the stations and station aliases tables, since station names and locations are needed far
+// too often to query the database each time. It's replaced whenever the tables are changed.
+var stationData struct {
+	sync.RWMutex
+	stations map[string]*StationDetail
+	aliases  map[string]string
+}
+
+func (c *Core) loadStations() error {
+	var (
+		stations []*db.Station
+		aliases  []*db.StationAlias
+	)
+
+	if err := c.db.DB.NewSelect().Model(&stations).Scan(context.Background()); err != nil {
+		return util.Wrap(err, "querying stations")
+	}
+
+	if err := c.db.DB.NewSelect().Model(&aliases).Scan(context.Background()); err != nil {
+		return util.Wrap(err, "querying station aliases")
+	}
+
+	stationMap := make(map[string]*StationDetail, len(stations))
+	for _, station := range stations {
+		stationMap[station.Code] = &StationDetail{
+			Name:    station.Name,
+			Lat:     station.Lat,
+			Lon:     station.Lon,
+			Country: station.Country,
+			Region:  station.Region,
+			County:  station.County,
+		}
+	}
+
+	aliasMap := make(map[string]string, len(aliases))
+	for _, alias := range aliases {
+		aliasMap[alias.Alias] = alias.Code
+	}
+
+	stationData.Lock()
+	defer stationData.Unlock()
+	stationData.stations = stationMap
+	stationData.aliases = aliasMap
+
+	return nil
+}
+
+// allStations returns every known station, keyed by CRS code. The map must not be modified.
+func allStations() map[string]*StationDetail {
+	stationData.RLock()
+	defer stationData.RUnlock()
+	return stationData.stations
+}
+
+// allStationAliases returns every station alias, mapped to the CRS code of the station it refers to. The map must not
+// be modified.
+func allStationAliases() map[string]string {
+	stationData.RLock()
+	defer stationData.RUnlock()
+	return stationData.aliases
+}
+
+// StationDataVersion identifies the version of the station seed data included in this build.
+func StationDataVersion() string {
+	sum := sha256.Sum256(db.StationSeed)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ResolveStationCode returns the CRS code of a station, following an alias if short is one. If the station isn't
+// known, false is returned.
+func ResolveStationCode(short string) (string, bool) {
+	stationData.RLock()
+	defer stationData.RUnlock()
+
+	if _, found := stationData.stations[short]; found {
+		return short, true
+	}
+	if code, found := stationData.aliases[short]; found {
+		if _, found := stationData.stations[code]; found {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+func GetStationName(short string) string {
+	x := short
+	if ff := GetStationDetail(short); ff != nil {
+		x = ff.Name
+	}
+	return x
+}
+
+func GetStationDetail(short string) *StationDetail {
+	code, found := ResolveStationCode(short)
+	if !found {
+		return nil
+	}
+
+	stationData.RLock()
+	defer stationData.RUnlock()
+	return stationData.stations[code]
+}
+
+var stationCodeRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// ErrInvalidStation is wrapped by the errors returned when a station or alias can't be saved because of a problem with
+// what was provided.
+var ErrInvalidStation = errors.New("invalid station")
+
+func validateStationCode(code string) error {
+	if !stationCodeRegexp.MatchString(code) {
+		return fmt.Errorf("%w: code %#v must be three letters", ErrInvalidStation, code)
+	}
+	return nil
+}
+
+// GetCustomStations returns every station that has been added or changed by an admin.
+func (c *Core) GetCustomStations() ([]*db.Station, error) {
+	var stations []*db.Station
+	if err := c.db.DB.NewSelect().Model(&stations).Where("custom = true").Order("code").Scan(context.Background()); err != nil {
+		return nil, err
+	}
+	return stations, nil
+}
+
+// PutStation adds a station, or overrides the details of an existing station. Stations saved with PutStation aren't
+// changed when the station seed data is updated.
+func (c *Core) PutStation(station *db.Station) error {
+	station.Code = strings.ToUpper(strings.TrimSpace(station.Code))
+	station.Name = strings.TrimSpace(station.Name)
+
+	if err := validateStationCode(station.Code); err != nil {
+		return err
+	}
+	if station.Name == "" {
+		return fmt.Errorf("%w: name cannot be blank", ErrInvalidStation)
+	}
+	if station.Lat < -90 || station.Lat > 90 || station.Lon < -180 || station.Lon > 180 {
+		return fmt.Errorf("%w: location is out of range", ErrInvalidStation)
+	}
+
+	station.Custom = true
+	station.UpdatedAt = time.Now().UTC()
+
+	err := c.inTx(func(tx bun.Tx) error {
+		isAlias, err := tx.NewSelect().Model((*db.StationAlias)(nil)).Where("alias = ?", station.Code).Exists(context.Background())
+		if err != nil {
+			return err
+		}
+		if isAlias {
+			return fmt.Errorf("%w: %s is already an alias of another station", ErrInvalidStation, station.Code)
+		}
+
+		_, err = tx.NewInsert().Model(station).On("CONFLICT (code) DO UPDATE").Exec(context.Background())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.loadStations()
+}
+
+// ResetStation removes any changes an admin has made to a station. If the station isn't in the seed data, it's
+// deleted.
+func (c *Core) ResetStation(code string) error {
+	err := c.inTx(func(tx bun.Tx) error {
+		res, err := tx.NewUpdate().Model((*db.Station)(nil)).Set("custom = false").Where("code = ?", code).Where("custom = true").Exec(context.Background())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		return db.SeedStations(context.Background(), tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.loadStations()
+}
+
+func (c *Core) GetStationAliases() ([]*db.StationAlias, error) {
+	var aliases []*db.StationAlias
+	if err := c.db.DB.NewSelect().Model(&aliases).Order("alias").Scan(context.Background()); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// PutStationAlias makes alias another code for a station, replacing whatever the alias previously referred to.
+func (c *Core) PutStationAlias(alias *db.StationAlias) error {
+	alias.Alias = strings.ToUpper(strings.TrimSpace(alias.Alias))
+	alias.Code = strings.ToUpper(strings.TrimSpace(alias.Code))
+
+	if err := validateStationCode(alias.Alias); err != nil {
+		return err
+	}
+
+	if alias.Alias == alias.Code {
+		return fmt.Errorf("%w: a station cannot be an alias of itself", ErrInvalidStation)
+	}
+
+	stations := allStations()
+
+	if _, found := stations[alias.Alias]; found {
+		return fmt.Errorf("%w: %s is already a station", ErrInvalidStation, alias.Alias)
+	}
+
+	if _, found := stations[alias.Code]; !found {
+		return fmt.Errorf("%w: unknown station %#v", ErrInvalidStation, alias.Code)
+	}
+
+	if _, err := c.db.DB.NewInsert().Model(alias).On("CONFLICT (alias) DO UPDATE").Exec(context.Background()); err != nil {
+		return err
+	}
+
+	return c.loadStations()
+}
+
+func (c *Core) DeleteStationAlias(alias string) error {
+	res, err := c.db.DB.NewDelete().Model((*db.StationAlias)(nil)).Where("alias = ?", alias).Exec(context.Background())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return c.loadStations()
+}
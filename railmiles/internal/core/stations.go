@@ -0,0 +1,141 @@
+package core
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slices"
+	"strings"
+	"time"
+)
+
+// StationStats describes how often a user has visited a station.
+//
+// A journey calls at a station if the station is its origin, its destination or one of its vias. A journey passes
+// through a station if the station is only in the calling points stored for the journey. Each journey is counted
+// once, even if it visits the same station more than once.
+type StationStats struct {
+	Shortcode     string    `json:"shortcode"`
+	Name          string    `json:"name"`
+	Lat           float32   `json:"lat,omitempty"`
+	Lon           float32   `json:"lon,omitempty"`
+	CalledAt      int       `json:"calledAt"`
+	PassedThrough int       `json:"passedThrough"`
+	FirstVisit    time.Time `json:"firstVisit,omitzero"`
+	LastVisit     time.Time `json:"lastVisit,omitzero"`
+}
+
+func (ss *StationStats) Visits() int {
+	return ss.CalledAt + ss.PassedThrough
+}
+
+type stationVisit struct {
+	Station   string    `bun:"station"`
+	JourneyID uuid.UUID `bun:"journey_id,type:uuid"`
+	Date      time.Time `bun:"date"`
+	Called    bool      `bun:"called"`
+}
+
+// getStationVisits returns a row for every station of every journey a user has made. If any stations are given, only
+// rows for those stations are returned.
+func (c *Core) getStationVisits(userID uuid.UUID, stations ...string) ([]*stationVisit, error) {
+	var visits []*stationVisit
+	err := c.db.DB.NewRaw(`SELECT "station", "journey_id", "date", "called" FROM (
+			SELECT "from" AS "station", "id" AS "journey_id", "date", true AS "called" FROM "railmiles_journeys_v2" WHERE "user_id" = ?0
+			UNION ALL
+			SELECT "to", "id", "date", true FROM "railmiles_journeys_v2" WHERE "user_id" = ?0
+			UNION ALL
+			SELECT "via"."value", "journey"."id", "journey"."date", true FROM "railmiles_journeys_v2" AS "journey", json_each("journey"."via") AS "via" WHERE "journey"."user_id" = ?0
+			UNION ALL
+			SELECT "route"."station", "journey"."id", "journey"."date", false FROM "railmiles_routes_v3" AS "route" JOIN "railmiles_journeys_v2" AS "journey" ON "journey"."id" = "route"."journey_id" WHERE "journey"."user_id" = ?0
+		) WHERE ?1 OR "station" IN (?2)`, userID, len(stations) == 0, bun.In(stations)).Scan(context.Background(), &visits)
+	return visits, err
+}
+
+func summariseStationVisits(visits []*stationVisit) []*StationStats {
+	type key struct {
+		station   string
+		journeyID uuid.UUID
+	}
+
+	// A station is often both a via and a stored calling point of the same journey, in which case the journey calls
+	// at it.
+	called := make(map[key]bool)
+	for _, visit := range visits {
+		k := key{visit.Station, visit.JourneyID}
+		called[k] = called[k] || visit.Called
+	}
+
+	stats := make(map[string]*StationStats)
+	seen := make(map[key]bool)
+	for _, visit := range visits {
+		k := key{visit.Station, visit.JourneyID}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+
+		ss, found := stats[visit.Station]
+		if !found {
+			ss = &StationStats{
+				Shortcode:  visit.Station,
+				Name:       GetStationName(visit.Station),
+				FirstVisit: visit.Date,
+				LastVisit:  visit.Date,
+			}
+			if details := GetStationDetail(visit.Station); details != nil {
+				ss.Lat, ss.Lon = details.Lat, details.Lon
+			}
+			stats[visit.Station] = ss
+		}
+
+		if called[k] {
+			ss.CalledAt += 1
+		} else {
+			ss.PassedThrough += 1
+		}
+
+		if visit.Date.Before(ss.FirstVisit) {
+			ss.FirstVisit = visit.Date
+		}
+		if visit.Date.After(ss.LastVisit) {
+			ss.LastVisit = visit.Date
+		}
+	}
+
+	res := make([]*StationStats, 0, len(stats))
+	for _, ss := range stats {
+		res = append(res, ss)
+	}
+	// Most visited first, then alphabetically.
+	slices.SortFunc(res, func(a, b *StationStats) int {
+		if a.Visits() != b.Visits() {
+			return b.Visits() - a.Visits()
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+// GetStationStats returns statistics for every station a user has visited, with the most visited first.
+func (c *Core) GetStationStats(userID uuid.UUID) ([]*StationStats, error) {
+	visits, err := c.getStationVisits(userID)
+	if err != nil {
+		return nil, err
+	}
+	return summariseStationVisits(visits), nil
+}
+
+// GetSingleStationStats returns statistics for a single station. nil is returned if the user has never visited the
+// station.
+func (c *Core) GetSingleStationStats(userID uuid.UUID, station string) (*StationStats, error) {
+	visits, err := c.getStationVisits(userID, strings.ToUpper(station))
+	if err != nil {
+		return nil, err
+	}
+	stats := summariseStationVisits(visits)
+	if len(stats) == 0 {
+		return nil, nil
+	}
+	return stats[0], nil
+}
@@ -0,0 +1,336 @@
+package core
+
+import (
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultStationSearchLimit = 10
+	MaxStationSearchLimit     = 50
+)
+
+type StationSearchResult struct {
+	Shortcode string  `json:"shortcode"`
+	Name      string  `json:"name"`
+	Lat       float32 `json:"lat"`
+	Lon       float32 `json:"lon"`
+	// Exact is set if the query was this station's CRS code or one of its aliases.
+	Exact bool `json:"exact"`
+	// Uses is the number of journeys that have called at or passed through this station.
+	Uses int `json:"uses"`
+
+	score int
+}
+
+// How well a query matches a station. Higher is better.
+const (
+	matchNone = iota
+	matchFuzzy
+	matchCodeTypo
+	matchTypo
+	matchSubstring
+	matchWordPrefix
+	matchPrefix
+	matchCode
+	matchExact
+)
+
+// normaliseStationName lowercases a station name or query and removes punctuation, so that "St. Pancras" matches
+// "st pancras" and "&" matches "and".
+func normaliseStationName(x string) string {
+	x = strings.ToLower(x)
+	x = strings.ReplaceAll(x, "&", " and ")
+
+	var sb strings.Builder
+	lastWasSpace := true
+	for _, r := range x {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			sb.WriteRune(r)
+			lastWasSpace = false
+		case unicode.IsSpace(r) || r == '-' || r == '/':
+			if !lastWasSpace {
+				sb.WriteRune(' ')
+				lastWasSpace = true
+			}
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// isSubsequence checks if every character of query appears in x in the same order.
+func isSubsequence(query, x string) bool {
+	qr := []rune(query)
+	i := 0
+	for _, r := range x {
+		if i < len(qr) && r == qr[i] {
+			i += 1
+		}
+	}
+	return i == len(qr)
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// isCodeTypo checks if query is a station code with a single letter changed or two adjacent letters swapped.
+func isCodeTypo(query, code string) bool {
+	if len(query) != len(code) || query == code {
+		return false
+	}
+
+	var diffs []int
+	for i := range query {
+		if query[i] != code[i] {
+			diffs = append(diffs, i)
+		}
+	}
+
+	switch len(diffs) {
+	case 1:
+		return true
+	case 2:
+		i, j := diffs[0], diffs[1]
+		return j == i+1 && query[i] == code[j] && query[j] == code[i]
+	}
+	return false
+}
+
+// matchStation scores how well a normalised query matches a station's normalised name.
+func matchStation(query, name string) int {
+	switch {
+	case name == query:
+		return matchExact
+	case strings.HasPrefix(name, query):
+		return matchPrefix
+	}
+
+	for _, word := range strings.Fields(name) {
+		if strings.HasPrefix(word, query) {
+			return matchWordPrefix
+		}
+	}
+
+	if strings.Contains(name, query) {
+		return matchSubstring
+	}
+
+	// Allow for typos by comparing the query to the start of the name. Short queries would match almost anything.
+	if qr, nr := []rune(query), []rune(name); len(qr) >= 4 {
+		allowed := 1
+		if len(qr) >= 8 {
+			allowed = 2
+		}
+		if levenshtein(qr, nr[:min(len(nr), len(qr))]) <= allowed {
+			return matchTypo
+		}
+	}
+
+	if isSubsequence(query, name) {
+		return matchFuzzy
+	}
+
+	return matchNone
+}
+
+// SearchStations finds stations whose name or code matches query. Results are ordered by how closely they match, and
+// then by how often the user has been to them. If query is blank, the user's most used stations are returned.
+//
+// This is called for every keystroke in station inputs, so visits are only counted for the stations that could end up
+// in the results.
+func (c *Core) SearchStations(userID uuid.UUID, query string, limit int) ([]*StationSearchResult, error) {
+	if limit <= 0 || limit > MaxStationSearchLimit {
+		limit = DefaultStationSearchLimit
+	}
+
+	var (
+		stations   = allStations()
+		normQuery  = normaliseStationName(query)
+		upperQuery = strings.ToUpper(strings.TrimSpace(query))
+		exactCode  = upperQuery
+		results    []*StationSearchResult
+	)
+
+	if normQuery == "" {
+		return c.mostUsedStations(userID, limit)
+	}
+
+	if code, found := allStationAliases()[upperQuery]; found {
+		exactCode = code
+	}
+
+	for code, details := range stations {
+		score := matchNone
+		switch {
+		case code == exactCode:
+			score = matchCode
+		default:
+			score = matchStation(normQuery, normaliseStationName(details.Name))
+			if score < matchCodeTypo && stationCodeRegexp.MatchString(upperQuery) && isCodeTypo(upperQuery, code) {
+				score = matchCodeTypo
+			}
+		}
+
+		if score == matchNone {
+			continue
+		}
+
+		results = append(results, &StationSearchResult{
+			Shortcode: code,
+			Name:      details.Name,
+			Lat:       details.Lat,
+			Lon:       details.Lon,
+			Exact:     code == exactCode,
+			score:     score,
+		})
+	}
+
+	// Results are ordered by score before uses, so anything scoring lower than the result that would be last can be
+	// dropped without counting its visits.
+	if len(results) > limit {
+		slices.SortFunc(results, func(a, b *StationSearchResult) int {
+			return b.score - a.score
+		})
+		cutoff := results[limit-1].score
+		results = slices.DeleteFunc(results, func(x *StationSearchResult) bool {
+			return x.score < cutoff
+		})
+	}
+
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	visits, err := c.getStationVisits(userID, util.Map(results, func(x *StationSearchResult) string {
+		return x.Shortcode
+	})...)
+	if err != nil {
+		return nil, err
+	}
+	uses := make(map[string]int)
+	for _, ss := range summariseStationVisits(visits) {
+		uses[ss.Shortcode] = ss.Visits()
+	}
+	for _, result := range results {
+		result.Uses = uses[result.Shortcode]
+	}
+
+	sortStationSearchResults(results)
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// mostUsedStations returns the stations a user has been to most often.
+func (c *Core) mostUsedStations(userID uuid.UUID, limit int) ([]*StationSearchResult, error) {
+	stats, err := c.GetStationStats(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*StationSearchResult
+	for _, ss := range stats {
+		details := GetStationDetail(ss.Shortcode)
+		if details == nil {
+			continue
+		}
+		results = append(results, &StationSearchResult{
+			Shortcode: ss.Shortcode,
+			Name:      details.Name,
+			Lat:       details.Lat,
+			Lon:       details.Lon,
+			Uses:      ss.Visits(),
+			score:     matchFuzzy,
+		})
+	}
+
+	sortStationSearchResults(results)
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func sortStationSearchResults(results []*StationSearchResult) {
+	slices.SortFunc(results, func(a, b *StationSearchResult) int {
+		if a.score != b.score {
+			return b.score - a.score
+		}
+		if a.Uses != b.Uses {
+			return b.Uses - a.Uses
+		}
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) - len(b.Name)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// stationSuggestionLimit is the maximum number of suggestions included in an UnknownStationError.
+const stationSuggestionLimit = 5
+
+// UnknownStationError is returned when a station code isn't in the station dataset. Suggestions contains stations
+// that might have been meant instead.
+type UnknownStationError struct {
+	Code        string
+	Suggestions []*StationSearchResult
+}
+
+func (e *UnknownStationError) Error() string {
+	if e.Code == "" {
+		return "Station is required"
+	}
+	msg := fmt.Sprintf("Unknown station %#v", e.Code)
+	if len(e.Suggestions) != 0 {
+		msg += " (did you mean " + strings.Join(util.Map(e.Suggestions, func(x *StationSearchResult) string {
+			return x.Shortcode + " " + x.Name
+		}), ", ") + "?)"
+	}
+	return msg
+}
+
+// CheckStationCode returns the CRS code of a station given its CRS code or one of its aliases. If the station isn't
+// known, an *UnknownStationError is returned.
+func (c *Core) CheckStationCode(userID uuid.UUID, code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if resolved, found := ResolveStationCode(code); found {
+		return resolved, nil
+	}
+	if code == "" {
+		return "", &UnknownStationError{}
+	}
+
+	suggestions, err := c.SearchStations(userID, code, stationSuggestionLimit)
+	if err != nil {
+		return "", util.Wrap(err, "searching for stations like %#v", code)
+	}
+	return "", &UnknownStationError{Code: code, Suggestions: suggestions}
+}
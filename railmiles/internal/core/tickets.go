@@ -0,0 +1,232 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slices"
+	"math"
+	"strings"
+	"time"
+)
+
+// ticketJoin adds the ticket used for each journey to a query on journeys.
+const ticketJoin = `LEFT JOIN "railmiles_tickets" AS "ticket" ON "ticket"."id" = "journey"."ticket_id"`
+
+// ticketShare is the part of the fare of a ticket that is counted against each journey it was used for. A return
+// ticket is split equally between the outbound and return journeys.
+const ticketShare = `"ticket"."fare" * 1.0 / (SELECT count(*) FROM "railmiles_journeys_v2" AS "shared" WHERE "shared"."ticket_id" = "ticket"."id")`
+
+type JourneyTicket struct {
+	*db.Ticket
+	// SharedWithReturn is set if the ticket was also used for the return of the journey.
+	SharedWithReturn bool `json:"sharedWithReturn"`
+}
+
+// GetJourneyTicket returns the ticket used for a journey, or nil if one hasn't been recorded.
+func (c *Core) GetJourneyTicket(journey *db.Journey) (*JourneyTicket, error) {
+	if journey.TicketID == nil {
+		return nil, nil
+	}
+
+	ticket := new(db.Ticket)
+	err := c.db.DB.NewSelect().Model(ticket).Where("id = ?", *journey.TicketID).Where("user_id = ?", journey.UserID).Scan(context.Background())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	res := &JourneyTicket{Ticket: ticket}
+	if journey.ReturnID != nil {
+		returnJourney, err := c.GetJourney(journey.UserID, *journey.ReturnID)
+		if err != nil {
+			return nil, util.Wrap(err, "fetching return journey")
+		}
+		res.SharedWithReturn = returnJourney != nil && returnJourney.TicketID != nil && *returnJourney.TicketID == ticket.ID
+	}
+	return res, nil
+}
+
+// ErrInvalidTicket is wrapped by the errors returned when a ticket can't be saved because of a problem with it.
+var ErrInvalidTicket = errors.New("invalid ticket")
+
+// PutTicket saves the ticket used for a journey, replacing any that was recorded before. The ID and user ID of ticket
+// are ignored.
+//
+// If shareWithReturn is set and the journey has a return, the return is changed to use the same ticket. If it isn't
+// set and the return was sharing the ticket, the ticket is removed from the return. If the journey doesn't exist,
+// sql.ErrNoRows is returned.
+func (c *Core) PutTicket(userID, journeyID uuid.UUID, ticket *db.Ticket, shareWithReturn bool) error {
+	ticket.Type = strings.TrimSpace(ticket.Type)
+	ticket.Railcard = strings.TrimSpace(ticket.Railcard)
+	ticket.Reference = strings.TrimSpace(ticket.Reference)
+
+	if ticket.Type == "" {
+		return fmt.Errorf("%w: ticket type is required", ErrInvalidTicket)
+	}
+
+	if ticket.Fare < 0 {
+		return fmt.Errorf("%w: fare cannot be negative", ErrInvalidTicket)
+	}
+
+	return c.inTx(func(tx bun.Tx) error {
+		journey, err := getJourney(tx, userID, journeyID)
+		if err != nil {
+			return util.Wrap(err, "fetching journey")
+		}
+		if journey == nil {
+			return sql.ErrNoRows
+		}
+
+		ticket.UserID = userID
+		ticket.UpdatedAt = time.Now().UTC()
+		if journey.TicketID == nil {
+			ticket.ID = uuid.New()
+			if _, err := tx.NewInsert().Model(ticket).Exec(context.Background()); err != nil {
+				return util.Wrap(err, "inserting ticket")
+			}
+			if err := setJourneyTicket(tx, userID, journeyID, &ticket.ID); err != nil {
+				return err
+			}
+		} else {
+			ticket.ID = *journey.TicketID
+			if _, err := tx.NewUpdate().Model(ticket).WherePK().Where("user_id = ?", userID).Exec(context.Background()); err != nil {
+				return util.Wrap(err, "updating ticket")
+			}
+		}
+
+		if journey.ReturnID != nil {
+			returnJourney, err := getJourney(tx, userID, *journey.ReturnID)
+			if err != nil {
+				return util.Wrap(err, "fetching return journey")
+			}
+
+			if returnJourney != nil {
+				isShared := returnJourney.TicketID != nil && *returnJourney.TicketID == ticket.ID
+				if shareWithReturn && !isShared {
+					if err := setJourneyTicket(tx, userID, returnJourney.ID, &ticket.ID); err != nil {
+						return err
+					}
+				} else if !shareWithReturn && isShared {
+					if err := setJourneyTicket(tx, userID, returnJourney.ID, nil); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		return deleteUnusedTickets(tx, userID)
+	})
+}
+
+// DeleteTicket removes the ticket recorded for a journey. If the ticket was shared with the return of the journey, the
+// return keeps it. If the journey doesn't exist, sql.ErrNoRows is returned.
+func (c *Core) DeleteTicket(userID, journeyID uuid.UUID) error {
+	return c.inTx(func(tx bun.Tx) error {
+		journey, err := getJourney(tx, userID, journeyID)
+		if err != nil {
+			return util.Wrap(err, "fetching journey")
+		}
+		if journey == nil {
+			return sql.ErrNoRows
+		}
+
+		if err := setJourneyTicket(tx, userID, journeyID, nil); err != nil {
+			return err
+		}
+		return deleteUnusedTickets(tx, userID)
+	})
+}
+
+func setJourneyTicket(idb bun.IDB, userID, journeyID uuid.UUID, ticketID *uuid.UUID) error {
+	_, err := idb.NewUpdate().
+		Model((*db.Journey)(nil)).
+		Set("ticket_id = ?", ticketID).
+		Where("id = ?", journeyID).
+		Where("user_id = ?", userID).
+		Exec(context.Background())
+	if err != nil {
+		return util.Wrap(err, "setting ticket of journey %s", journeyID.String())
+	}
+	return nil
+}
+
+// deleteUnusedTickets removes any of the tickets of a user that aren't used for any journeys.
+func deleteUnusedTickets(idb bun.IDB, userID uuid.UUID) error {
+	_, err := idb.NewDelete().
+		Model((*db.Ticket)(nil)).
+		Where("user_id = ?", userID).
+		Where(`"id" NOT IN (SELECT "ticket_id" FROM "railmiles_journeys_v2" WHERE "ticket_id" IS NOT NULL)`).
+		Exec(context.Background())
+	if err != nil {
+		return util.Wrap(err, "deleting unused tickets")
+	}
+	return nil
+}
+
+type TicketTypeSpend struct {
+	Type     string  `json:"type"`
+	Journeys int     `json:"journeys"`
+	Miles    float32 `json:"miles"`
+	// Spend is in pence.
+	Spend        int     `json:"spend"`
+	PencePerMile float32 `json:"pencePerMile"`
+}
+
+// GetTicketTypeSpend returns how much a user has spent on each type of ticket, most first. Journeys without a ticket
+// recorded are left out.
+func (c *Core) GetTicketTypeSpend(userID uuid.UUID, filter *JourneyFilter) ([]*TicketTypeSpend, error) {
+	var rows []*struct {
+		Type     string
+		Journeys int
+		Miles    float32
+		Spend    float64
+	}
+	q := c.db.DB.NewSelect().
+		Model((*db.Journey)(nil)).
+		ColumnExpr(`"ticket"."type" AS "type"`).
+		ColumnExpr(`count(*) AS "journeys"`).
+		ColumnExpr(`sum("journey"."distance") AS "miles"`).
+		ColumnExpr(`sum(`+ticketShare+`) AS "spend"`).
+		Join(ticketJoin).
+		Where(`"journey"."user_id" = ?`, userID).
+		Where(`"ticket"."id" IS NOT NULL`).
+		Group("ticket.type")
+	if err := filter.apply(q).Scan(context.Background(), &rows); err != nil {
+		return nil, err
+	}
+
+	res := make([]*TicketTypeSpend, len(rows))
+	for i, row := range rows {
+		res[i] = &TicketTypeSpend{
+			Type:         row.Type,
+			Journeys:     row.Journeys,
+			Miles:        row.Miles,
+			Spend:        int(math.Round(row.Spend)),
+			PencePerMile: pencePerMile(row.Spend, row.Miles),
+		}
+	}
+
+	slices.SortFunc(res, func(a, b *TicketTypeSpend) int {
+		if a.Spend != b.Spend {
+			return b.Spend - a.Spend
+		}
+		return strings.Compare(a.Type, b.Type)
+	})
+
+	return res, nil
+}
+
+func pencePerMile(spend float64, miles float32) float32 {
+	if miles == 0 {
+		return 0
+	}
+	return float32(spend / float64(miles))
+}
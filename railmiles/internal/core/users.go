@@ -0,0 +1,311 @@
+package core
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const passwordHashIterations = 600_000
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations, hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+func checkPasswordHash(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	expected, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	actual, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(expected, actual) == 1
+}
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrUsernameTaken     = errors.New("username already taken")
+	ErrInvalidPassword   = errors.New("password must be at least 8 characters long")
+	ErrInvalidUsername   = errors.New("username cannot be blank")
+	ErrCannotDeleteAdmin = errors.New("cannot delete the configured admin user")
+	ErrIncorrectPassword = errors.New("current password is incorrect")
+)
+
+// legacyAdminUsername is the username given to the user that owns everything created before there were multiple users.
+// See the 20261018124500_users migration.
+const legacyAdminUsername = "admin"
+
+// BootstrapAdminUser makes sure that the admin user named in the configuration file exists. If it has no password
+// set (for example, if it was just created), the password from the configuration file is used.
+//
+// If the configured admin user doesn't exist but the legacy admin user created when upgrading from a single-user
+// version does, and its password has never been set, the legacy user is renamed instead of creating a new one, so that
+// existing journeys stay with the configured admin.
+func (c *Core) BootstrapAdminUser() error {
+	user, err := c.GetUserByUsername(c.config.Auth.Username)
+	if err != nil {
+		return util.Wrap(err, "fetching admin user")
+	}
+
+	if user == nil {
+		user, err = c.GetUserByUsername(legacyAdminUsername)
+		if err != nil {
+			return util.Wrap(err, "fetching legacy admin user")
+		}
+
+		if user != nil && user.IsAdmin && user.PasswordHash == "" {
+			user.Username = c.config.Auth.Username
+			if _, err := c.db.DB.NewUpdate().Model(user).Column("username").WherePK().Exec(context.Background()); err != nil {
+				return util.Wrap(err, "renaming legacy admin user")
+			}
+		} else {
+			user = nil
+		}
+	}
+
+	if user == nil {
+		user = &db.User{
+			ID:        uuid.New(),
+			Username:  c.config.Auth.Username,
+			IsAdmin:   true,
+			CreatedAt: time.Now().UTC(),
+		}
+		if _, err := c.db.DB.NewInsert().Model(user).Exec(context.Background()); err != nil {
+			return util.Wrap(err, "creating admin user")
+		}
+	}
+
+	if user.PasswordHash == "" && c.config.Auth.Password != "" {
+		if err := c.SetPassword(user.ID, c.config.Auth.Password); err != nil {
+			return util.Wrap(err, "setting admin user password")
+		}
+	}
+
+	return nil
+}
+
+// DefaultUser returns the admin user named in the configuration file. When authentication is disabled, every request
+// is made as this user.
+func (c *Core) DefaultUser() (*db.User, error) {
+	user, err := c.GetUserByUsername(c.config.Auth.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (c *Core) GetUserByUsername(username string) (*db.User, error) {
+	user := new(db.User)
+	if err := c.db.DB.NewSelect().Model(user).Where("username = ?", username).Scan(context.Background()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// Authenticate returns the user with the given username if password is correct, otherwise nil.
+func (c *Core) Authenticate(username, password string) (*db.User, error) {
+	user, err := c.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || !checkPasswordHash(user.PasswordHash, password) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func (c *Core) GetUser(id uuid.UUID) (*db.User, error) {
+	user := new(db.User)
+	if err := c.db.DB.NewSelect().Model(user).Where("id = ?", id).Scan(context.Background()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (c *Core) GetUsers() ([]*db.User, error) {
+	var users []*db.User
+	err := c.db.DB.NewSelect().Model(&users).Order("username").Scan(context.Background())
+	return users, err
+}
+
+func (c *Core) CreateUser(username, password string, isAdmin bool) (*db.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, ErrInvalidUsername
+	}
+
+	if len(password) < 8 {
+		return nil, ErrInvalidPassword
+	}
+
+	existing, err := c.GetUserByUsername(username)
+	if err != nil {
+		return nil, util.Wrap(err, "checking for existing user")
+	}
+	if existing != nil {
+		return nil, ErrUsernameTaken
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, util.Wrap(err, "hashing password")
+	}
+
+	user := &db.User{
+		ID:           uuid.New(),
+		Username:     username,
+		PasswordHash: hash,
+		IsAdmin:      isAdmin,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	if _, err := c.db.DB.NewInsert().Model(user).Exec(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (c *Core) SetPassword(userID uuid.UUID, password string) error {
+	if len(password) < 8 {
+		return ErrInvalidPassword
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return util.Wrap(err, "hashing password")
+	}
+
+	_, err = c.db.DB.NewUpdate().Model((*db.User)(nil)).Set("password_hash = ?", hash).Where("id = ?", userID).Exec(context.Background())
+	return err
+}
+
+// ChangePassword sets a new password for a user after checking that currentPassword is their existing password. If
+// the user doesn't have a password yet, currentPassword is ignored.
+func (c *Core) ChangePassword(userID uuid.UUID, currentPassword, newPassword string) error {
+	user, err := c.GetUser(userID)
+	if err != nil {
+		return util.Wrap(err, "fetching user")
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	if user.PasswordHash != "" && !checkPasswordHash(user.PasswordHash, currentPassword) {
+		return ErrIncorrectPassword
+	}
+
+	return c.SetPassword(userID, newPassword)
+}
+
+// DeleteUser removes a user and everything that belongs to them.
+func (c *Core) DeleteUser(id uuid.UUID) error {
+	user, err := c.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if strings.EqualFold(user.Username, c.config.Auth.Username) {
+		return ErrCannotDeleteAdmin
+	}
+
+	return c.inTx(func(tx bun.Tx) error {
+		_, err := tx.NewDelete().
+			Model((*db.JobEvent)(nil)).
+			Where(`"job_id" IN (SELECT "id" FROM "railmiles_jobs" WHERE "user_id" = ?)`, id).
+			Exec(context.Background())
+		if err != nil {
+			return err
+		}
+
+		for _, model := range []any{(*db.Route)(nil), (*db.Leg)(nil), (*db.Claim)(nil), (*db.Ticket)(nil), (*db.Journey)(nil), (*db.Session)(nil), (*db.APIToken)(nil), (*db.Job)(nil), (*db.Upload)(nil)} {
+			if _, err := tx.NewDelete().Model(model).Where("user_id = ?", id).Exec(context.Background()); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.NewDelete().Model((*db.User)(nil)).Where("id = ?", id).Exec(context.Background())
+		return err
+	})
+}
+
+// EnableSharing creates a new share token for a user, allowing anyone with the token to view their dashboard. Any
+// previous share token stops working. Only a hash of the token is stored, so it can't be retrieved again later.
+func (c *Core) EnableSharing(userID uuid.UUID) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = c.db.DB.NewUpdate().Model((*db.User)(nil)).Set("share_token_hash = ?", hashToken(token)).Where("id = ?", userID).Exec(context.Background())
+	return token, err
+}
+
+func (c *Core) DisableSharing(userID uuid.UUID) error {
+	_, err := c.db.DB.NewUpdate().Model((*db.User)(nil)).Set("share_token_hash = NULL").Where("id = ?", userID).Exec(context.Background())
+	return err
+}
+
+func (c *Core) GetUserByShareToken(token string) (*db.User, error) {
+	if token == "" {
+		return nil, nil
+	}
+	user := new(db.User)
+	if err := c.db.DB.NewSelect().Model(user).Where("share_token_hash = ?", hashToken(token)).Scan(context.Background()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
@@ -43,7 +43,7 @@ func init() {
 					slices.Reverse(n)
 				}
 
-				j := Journey{
+				j := journeyV2{
 					ID:       uuid.New(),
 					From:     outbound.To,
 					To:       outbound.From,
@@ -58,7 +58,7 @@ func init() {
 				}
 
 				var route []string
-				err := db.NewSelect().Model((*Route)(nil)).Column("station").Where(`journey_id = ?`, outbound.ID).Order("sequence").Scan(context.Background(), &route)
+				err := db.NewSelect().Model((*routeV3)(nil)).Column("station").Where(`journey_id = ?`, outbound.ID).Order("sequence").Scan(context.Background(), &route)
 				if err != nil {
 					return util.Wrap(err, "get route")
 				}
@@ -66,8 +66,8 @@ func init() {
 				if len(route) != 0 {
 					slices.Reverse(route)
 
-					var routeParts []*Route
-					r := &Route{
+					var routeParts []*routeV3
+					r := &routeV3{
 						JourneyID: j.ID,
 					}
 					for i, point := range route {
@@ -82,7 +82,7 @@ func init() {
 					}
 				}
 
-				db.NewUpdate().Model((*Journey)(nil)).Set("return_id = ?", j.ID).Where("id = ?", outbound.ID).Exec(context.Background())
+				db.NewUpdate().Model((*journeyV2)(nil)).Set("return_id = ?", j.ID).Where("id = ?", outbound.ID).Exec(context.Background())
 				if err != nil {
 					return util.Wrap(err, "update old route with return ID")
 				}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"strings"
+	"time"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_leg_cache" (
+					"from" VARCHAR COLLATE NOCASE,
+					"to" VARCHAR COLLATE NOCASE,
+					"calling_points" VARCHAR,
+					"distance" REAL,
+					"hits" INTEGER,
+					"updated_at" TIMESTAMP,
+					PRIMARY KEY ("from", "to", "calling_points")
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating leg cache table")
+			}
+
+			// Seed the cache with every single-leg journey that had its route automatically resolved. Journeys with
+			// a via cannot be used since we don't know how the distance was split between legs, and journeys with no
+			// calling points stored had a manual distance entered.
+			var journeys []struct {
+				ID       uuid.UUID `bun:"id,type:uuid"`
+				From     string    `bun:"from"`
+				To       string    `bun:"to"`
+				Distance float32   `bun:"distance"`
+			}
+			if err := db.NewRaw(`SELECT "id", "from", "to", "distance" FROM "railmiles_journeys_v2" WHERE "via" IS NULL`).Scan(ctx, &journeys); err != nil {
+				return util.Wrap(err, "read journeys")
+			}
+
+			entries := make(map[[3]string]*legCacheEntryV1)
+			for _, journey := range journeys {
+				var route []string
+				if err := db.NewRaw(`SELECT "station" FROM "railmiles_routes_v3" WHERE "journey_id" = ? ORDER BY "sequence"`, journey.ID).Scan(ctx, &route); err != nil {
+					return util.Wrap(err, "read route")
+				}
+				if len(route) == 0 {
+					continue
+				}
+
+				key := [3]string{strings.ToUpper(journey.From), strings.ToUpper(journey.To), strings.Join(route, ",")}
+				if e, found := entries[key]; found {
+					e.Hits += 1
+					continue
+				}
+				entries[key] = &legCacheEntryV1{
+					From:          key[0],
+					To:            key[1],
+					CallingPoints: key[2],
+					Distance:      journey.Distance,
+					Hits:          1,
+					UpdatedAt:     time.Now().UTC(),
+				}
+			}
+
+			for _, entry := range entries {
+				if _, err := db.NewInsert().Model(entry).Exec(ctx); err != nil {
+					return util.Wrap(err, "insert leg cache entry")
+				}
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_sessions" (
+					"token_hash" VARCHAR PRIMARY KEY,
+					"created_at" TIMESTAMP,
+					"expires_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating sessions table")
+			}
+
+			_, err = db.NewRaw(`CREATE TABLE "railmiles_api_tokens" (
+					"id" uuid PRIMARY KEY,
+					"name" VARCHAR,
+					"token_hash" VARCHAR UNIQUE,
+					"created_at" TIMESTAMP,
+					"last_used_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating API tokens table")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
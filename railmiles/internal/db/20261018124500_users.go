@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"time"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_users" (
+					"id" uuid PRIMARY KEY,
+					"username" VARCHAR COLLATE NOCASE UNIQUE,
+					"password_hash" VARCHAR,
+					"is_admin" BOOLEAN,
+					"share_token_hash" VARCHAR UNIQUE,
+					"created_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating users table")
+			}
+
+			for _, table := range []string{"railmiles_journeys_v2", "railmiles_routes_v3", "railmiles_sessions", "railmiles_api_tokens"} {
+				if _, err := db.NewRaw(`ALTER TABLE ? ADD COLUMN "user_id" uuid;`, bun.Ident(table)).Exec(ctx); err != nil {
+					return util.Wrap(err, "adding user ID column to %s", table)
+				}
+			}
+
+			if _, err := db.NewRaw(`CREATE INDEX "railmiles_journeys_v2_user_id_date" ON "railmiles_journeys_v2" ("user_id", "date");`).Exec(ctx); err != nil {
+				return util.Wrap(err, "creating journey user index")
+			}
+
+			var n int
+			if err := db.NewRaw(`SELECT (SELECT count(*) FROM "railmiles_journeys_v2") + (SELECT count(*) FROM "railmiles_api_tokens")`).Scan(ctx, &n); err != nil {
+				return util.Wrap(err, "counting existing data")
+			}
+
+			if n == 0 {
+				return nil
+			}
+
+			// Everything that already exists belongs to a single admin user. The password for this user is set from
+			// the configuration file at startup (see (*core.Core).BootstrapAdminUser).
+			adminID := uuid.New()
+			if _, err := db.NewRaw(
+				`INSERT INTO "railmiles_users" ("id", "username", "password_hash", "is_admin", "created_at") VALUES (?, 'admin', '', true, ?)`,
+				adminID, time.Now().UTC(),
+			).Exec(ctx); err != nil {
+				return util.Wrap(err, "creating admin user")
+			}
+
+			for _, table := range []string{"railmiles_journeys_v2", "railmiles_routes_v3", "railmiles_sessions", "railmiles_api_tokens"} {
+				if _, err := db.NewRaw(`UPDATE ? SET "user_id" = ?`, bun.Ident(table), adminID).Exec(ctx); err != nil {
+					return util.Wrap(err, "assigning existing %s rows to admin user", table)
+				}
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
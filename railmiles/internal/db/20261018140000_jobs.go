@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_jobs" (
+					"id" uuid PRIMARY KEY,
+					"user_id" uuid,
+					"kind" VARCHAR,
+					"payload" VARCHAR,
+					"state" VARCHAR,
+					"attempts" INTEGER,
+					"run_after" TIMESTAMP,
+					"error" VARCHAR,
+					"result" VARCHAR,
+					"created_at" TIMESTAMP,
+					"updated_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating jobs table")
+			}
+
+			_, err = db.NewRaw(`CREATE INDEX "railmiles_jobs_state_run_after" ON "railmiles_jobs" ("state", "run_after")`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating jobs index")
+			}
+
+			_, err = db.NewRaw(`CREATE TABLE "railmiles_job_events" (
+					"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+					"job_id" uuid,
+					"event" VARCHAR,
+					"message" VARCHAR,
+					"created_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating job events table")
+			}
+
+			_, err = db.NewRaw(`CREATE INDEX "railmiles_job_events_job_id" ON "railmiles_job_events" ("job_id", "id")`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating job events index")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
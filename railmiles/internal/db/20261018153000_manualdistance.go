@@ -0,0 +1,27 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			// Whether existing journeys had their distances entered manually wasn't recorded. It can't be worked out from
+			// whether they have calling points either, since direct services and some cached legs don't have any, so
+			// existing journeys are all assumed not to have been.
+			_, err := db.NewRaw(`ALTER TABLE "railmiles_journeys_v2" ADD COLUMN "manual_distance" BOOLEAN NOT NULL DEFAULT false`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "adding manual distance column")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
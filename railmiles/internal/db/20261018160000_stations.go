@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+	"time"
+)
+
+// stationV1 and stationAliasV1 are Station and StationAlias as they were when this migration was written.
+type stationV1 struct {
+	bun.BaseModel `bun:"table:railmiles_stations,alias:station"`
+
+	Code      string `bun:",pk"`
+	Name      string
+	Lat       float32
+	Lon       float32
+	Country   string
+	Region    string
+	County    string
+	Custom    bool
+	UpdatedAt time.Time
+}
+
+type stationAliasV1 struct {
+	bun.BaseModel `bun:"table:railmiles_station_aliases"`
+
+	Alias string `bun:",pk"`
+	Code  string
+}
+
+// seedStationsV1 is SeedStations as it was when this migration was written, so that the stations it inserts don't
+// depend on later changes to Station.
+func seedStationsV1(ctx context.Context, idb bun.IDB) error {
+	var seed map[string]*stationV1
+	if err := json.Unmarshal(StationSeed, &seed); err != nil {
+		return util.Wrap(err, "parsing station seed data")
+	}
+
+	now := time.Now().UTC()
+	stations := make([]*stationV1, 0, len(seed))
+	for code, station := range seed {
+		station.Code = code
+		station.UpdatedAt = now
+		stations = append(stations, station)
+	}
+
+	const chunkSize = 100
+	for i := 0; i < len(stations); i += chunkSize {
+		chunk := stations[i:min(i+chunkSize, len(stations))]
+		_, err := idb.NewInsert().
+			Model(&chunk).
+			On("CONFLICT (code) DO UPDATE").
+			Set(`"name" = EXCLUDED."name"`).
+			Set(`"lat" = EXCLUDED."lat"`).
+			Set(`"lon" = EXCLUDED."lon"`).
+			Set(`"country" = EXCLUDED."country"`).
+			Set(`"region" = EXCLUDED."region"`).
+			Set(`"county" = EXCLUDED."county"`).
+			Set(`"updated_at" = EXCLUDED."updated_at"`).
+			Where(`"station"."custom" = false`).
+			Exec(ctx)
+		if err != nil {
+			return util.Wrap(err, "upserting stations")
+		}
+	}
+
+	codes := make([]string, len(stations))
+	for i, station := range stations {
+		codes[i] = station.Code
+	}
+
+	_, err := idb.NewDelete().
+		Model((*stationV1)(nil)).
+		Where(`"custom" = false`).
+		Where(`"code" NOT IN (?)`, bun.In(codes)).
+		Exec(ctx)
+	if err != nil {
+		return util.Wrap(err, "removing old stations")
+	}
+
+	return nil
+}
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_stations" (
+					"code" VARCHAR PRIMARY KEY,
+					"name" VARCHAR,
+					"lat" REAL,
+					"lon" REAL,
+					"country" VARCHAR,
+					"region" VARCHAR,
+					"county" VARCHAR,
+					"custom" BOOLEAN NOT NULL DEFAULT false,
+					"updated_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating stations table")
+			}
+
+			_, err = db.NewRaw(`CREATE TABLE "railmiles_station_aliases" (
+					"alias" VARCHAR PRIMARY KEY,
+					"code" VARCHAR
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating station aliases table")
+			}
+
+			if err := seedStationsV1(ctx, db); err != nil {
+				return util.Wrap(err, "seeding stations")
+			}
+
+			// These are the DPRS codes that getStationData.py leaves out of the station data.
+			//
+			// Source: http://www.railwaycodes.org.uk/crs/crs2.shtm
+			aliases := []*stationAliasV1{
+				{Alias: "EBF", Code: "EBD"}, // Ebbsfleet International
+				{Alias: "GCL", Code: "GLC"}, // Glasgow Central
+				{Alias: "GQL", Code: "GLQ"}, // Glasgow Queen Street
+				{Alias: "HEZ", Code: "HEW"}, // Heworth
+				{Alias: "HII", Code: "HHY"}, // Highbury & Islington
+				{Alias: "XHZ", Code: "HHY"},
+				{Alias: "LIF", Code: "LTV"}, // Lichfield Trent Valley
+				{Alias: "LVL", Code: "LIV"}, // Liverpool Lime Street
+				{Alias: "ALE", Code: "LPY"}, // Liverpool South Parkway
+				{Alias: "SPL", Code: "STP"}, // London St Pancras
+				{Alias: "SPX", Code: "STP"},
+				{Alias: "XRO", Code: "RET"}, // Retford
+				{Alias: "GTI", Code: "SGB"}, // Smethwick Galton Bridge
+				{Alias: "TAH", Code: "TAM"}, // Tamworth
+				{Alias: "WJH", Code: "WIJ"}, // Willesden Junction
+				{Alias: "WJL", Code: "WIJ"},
+				{Alias: "WPH", Code: "WOP"}, // Worcestershire Parkway
+			}
+			if _, err := db.NewInsert().Model(&aliases).Exec(ctx); err != nil {
+				return util.Wrap(err, "inserting station aliases")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_legs" (
+					"journey_id" uuid,
+					"sequence" INTEGER,
+					"user_id" uuid,
+					"from" VARCHAR,
+					"to" VARCHAR,
+					"distance" REAL,
+					"service_uid" VARCHAR,
+					"operator" VARCHAR,
+					"headcode" VARCHAR,
+					"scheduled_departure" TIMESTAMP,
+					"actual_departure" TIMESTAMP,
+					"scheduled_arrival" TIMESTAMP,
+					"actual_arrival" TIMESTAMP,
+					PRIMARY KEY ("journey_id", "sequence")
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating legs table")
+			}
+
+			if _, err := db.NewRaw(`CREATE INDEX "railmiles_legs_user_id" ON "railmiles_legs" ("user_id");`).Exec(ctx); err != nil {
+				return util.Wrap(err, "creating leg user index")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"strings"
+	"time"
+)
+
+// journeyV3 and legV2 are Journey and Leg as they were when this migration was written. SplitJourneysIntoLegs uses
+// them too, so that it keeps working here after columns are added to either table.
+type journeyV3 struct {
+	bun.BaseModel `bun:"table:railmiles_journeys_v2,alias:journey"`
+
+	ID             uuid.UUID `bun:",pk,type:uuid"`
+	UserID         uuid.UUID `bun:",type:uuid"`
+	From           *StationName
+	To             *StationName
+	Via            []*StationName `bun:",nullzero"`
+	Distance       float32
+	Date           time.Time
+	ReturnID       *uuid.UUID `bun:",nullzero,type:uuid"`
+	ManualDistance bool
+}
+
+type legV2 struct {
+	bun.BaseModel `bun:"table:railmiles_legs,alias:leg"`
+
+	JourneyID          uuid.UUID `bun:",pk,type:uuid"`
+	Sequence           int       `bun:",pk"`
+	UserID             uuid.UUID `bun:",type:uuid"`
+	From               string
+	To                 string
+	Distance           float32
+	CallingPoints      []string   `bun:",nullzero"`
+	ServiceUID         string     `bun:",nullzero"`
+	Operator           string     `bun:",nullzero"`
+	Headcode           string     `bun:",nullzero"`
+	ScheduledDeparture *time.Time `bun:",nullzero"`
+	ActualDeparture    *time.Time `bun:",nullzero"`
+	ScheduledArrival   *time.Time `bun:",nullzero"`
+	ActualArrival      *time.Time `bun:",nullzero"`
+}
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`ALTER TABLE "railmiles_legs" ADD COLUMN "calling_points" VARCHAR`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "adding calling points column")
+			}
+
+			// Legs that have already been recorded only have calling points stored for the whole journey, which can be
+			// divided between them.
+			if err := splitExistingLegRoutes(ctx, db); err != nil {
+				return util.Wrap(err, "adding calling points to existing legs")
+			}
+
+			if err := SplitJourneysIntoLegs(ctx, db); err != nil {
+				return util.Wrap(err, "splitting journeys into legs")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
+
+func splitExistingLegRoutes(ctx context.Context, db *bun.DB) error {
+	var legs []*legV2
+	if err := db.NewSelect().Model(&legs).Order("journey_id", "sequence").Scan(ctx); err != nil {
+		return util.Wrap(err, "fetching legs")
+	}
+
+	var routeParts []*routeV3
+	if err := db.NewSelect().Model(&routeParts).Order("journey_id", "sequence").Scan(ctx); err != nil {
+		return util.Wrap(err, "fetching routes")
+	}
+
+	routes := make(map[uuid.UUID][]string)
+	for _, part := range routeParts {
+		routes[part.JourneyID] = append(routes[part.JourneyID], strings.ToUpper(part.Station))
+	}
+
+	byJourney := make(map[uuid.UUID][]*legV2)
+	for _, leg := range legs {
+		byJourney[leg.JourneyID] = append(byJourney[leg.JourneyID], leg)
+	}
+
+	for journeyID, journeyLegs := range byJourney {
+		stations := []string{journeyLegs[0].From}
+		for _, leg := range journeyLegs {
+			stations = append(stations, leg.To)
+		}
+
+		split := splitCallingPoints(stations, routes[journeyID])
+		if split == nil {
+			continue
+		}
+
+		for i, leg := range journeyLegs {
+			if len(split[i]) == 0 {
+				continue
+			}
+			leg.CallingPoints = split[i]
+			if _, err := db.NewUpdate().Model(leg).Column("calling_points").WherePK().Exec(ctx); err != nil {
+				return util.Wrap(err, "updating leg")
+			}
+		}
+	}
+
+	return nil
+}
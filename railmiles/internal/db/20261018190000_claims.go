@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_claims" (
+					"journey_id" uuid PRIMARY KEY,
+					"user_id" uuid,
+					"status" VARCHAR,
+					"amount" INTEGER NOT NULL DEFAULT 0,
+					"updated_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating claims table")
+			}
+
+			if _, err := db.NewRaw(`CREATE INDEX "railmiles_claims_user_id" ON "railmiles_claims" ("user_id");`).Exec(ctx); err != nil {
+				return util.Wrap(err, "creating claim user index")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`CREATE TABLE "railmiles_tickets" (
+					"id" uuid PRIMARY KEY,
+					"user_id" uuid,
+					"fare" INTEGER NOT NULL DEFAULT 0,
+					"type" VARCHAR,
+					"railcard" VARCHAR,
+					"reference" VARCHAR,
+					"updated_at" TIMESTAMP
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "creating tickets table")
+			}
+
+			if _, err := db.NewRaw(`CREATE INDEX "railmiles_tickets_user_id" ON "railmiles_tickets" ("user_id");`).Exec(ctx); err != nil {
+				return util.Wrap(err, "creating ticket user index")
+			}
+
+			if _, err := db.NewRaw(`ALTER TABLE "railmiles_journeys_v2" ADD COLUMN "ticket_id" uuid;`).Exec(ctx); err != nil {
+				return util.Wrap(err, "adding ticket ID column")
+			}
+
+			if _, err := db.NewRaw(`CREATE INDEX "railmiles_journeys_ticket_id" ON "railmiles_journeys_v2" ("ticket_id");`).Exec(ctx); err != nil {
+				return util.Wrap(err, "creating journey ticket index")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
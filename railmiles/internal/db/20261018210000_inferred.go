@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			// Whether the distances of existing journeys were inferred wasn't recorded, so they are all assumed not to
+			// have been.
+			_, err := db.NewRaw(`ALTER TABLE "railmiles_journeys_v2" ADD COLUMN "inferred_distance" BOOLEAN NOT NULL DEFAULT false`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "adding inferred distance column to journeys")
+			}
+
+			_, err = db.NewRaw(`ALTER TABLE "railmiles_legs" ADD COLUMN "inferred" BOOLEAN NOT NULL DEFAULT false`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "adding inferred column to legs")
+			}
+
+			// Legs that were split out of existing journeys by SplitJourneysIntoLegs only have estimated distances,
+			// unless the journey has a single leg. Legs with a service UID were given their distances by the distance
+			// provider.
+			_, err = db.NewRaw(`UPDATE "railmiles_legs" SET "inferred" = true
+				WHERE "service_uid" IS NULL
+				AND "journey_id" IN (SELECT "journey_id" FROM "railmiles_legs" GROUP BY "journey_id" HAVING count(*) > 1)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "marking split legs as inferred")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewRaw(`ALTER TABLE "railmiles_journeys_v2" ADD COLUMN "planned_arrival" TIMESTAMP`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "adding planned arrival column to journeys")
+			}
+
+			// The arrival time of the last leg is the best guess at the plan for existing journeys, and is what their
+			// delays were worked out from until now.
+			_, err = db.NewRaw(`UPDATE "railmiles_journeys_v2" SET "planned_arrival" = (
+					SELECT "scheduled_arrival" FROM "railmiles_legs"
+					WHERE "railmiles_legs"."journey_id" = "railmiles_journeys_v2"."id"
+					ORDER BY "sequence" DESC
+					LIMIT 1
+				)
+			`).Exec(ctx)
+			if err != nil {
+				return util.Wrap(err, "setting planned arrival of existing journeys")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
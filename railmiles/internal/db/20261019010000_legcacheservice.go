@@ -0,0 +1,25 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			for _, column := range []string{"service_uid", "operator", "headcode"} {
+				_, err := db.NewRaw(`ALTER TABLE "railmiles_leg_cache" ADD COLUMN ? VARCHAR`, bun.Ident(column)).Exec(ctx)
+				if err != nil {
+					return util.Wrap(err, "adding %s column to leg cache", column)
+				}
+			}
+			return nil
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return errors.New("not supported")
+		},
+	)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/uptrace/bun/extra/bundebug"
 	"github.com/uptrace/bun/migrate"
 	"golang.org/x/exp/slog"
+	"sort"
 	"time"
 )
 
@@ -63,3 +64,30 @@ func (db *DB) Migrate() error {
 
 	return nil
 }
+
+// AppliedMigrations returns the names of every migration that has been applied to the database, oldest first.
+func (db *DB) AppliedMigrations() ([]string, error) {
+	mig := migrate.NewMigrator(db.DB, Migrations)
+
+	applied, err := mig.AppliedMigrations(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, m := range applied {
+		res = append(res, m.Name)
+	}
+	// migration names start with a timestamp
+	sort.Strings(res)
+	return res, nil
+}
+
+// KnownMigrations returns the names of every migration included in this build, oldest first.
+func KnownMigrations() []string {
+	var res []string
+	for _, m := range Migrations.Sorted() {
+		res = append(res, m.Name)
+	}
+	return res
+}
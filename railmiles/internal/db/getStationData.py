@@ -119,6 +119,73 @@ for elem in rj.get("elements", []):
     }
 
 
+# ITL1 regions are English regions (admin_level 5 in OpenStreetMap), and the whole of Scotland and the whole of Wales.
+# Northern Ireland is included for completeness, though few stations there have a CRS code.
+COUNTRY_ADMIN_LEVEL = "4"
+REGION_ADMIN_LEVEL = "5"
+COUNTY_ADMIN_LEVEL = "6"
+
+
+def get_areas():
+    # For each station, output the station followed by every administrative area it's in. The areas that follow a node
+    # belong to it up until the next node.
+    query = """[out:json][timeout:900];
+node["ref:crs"];
+foreach(
+  out ids;
+  is_in;
+  area._["boundary"="administrative"]["admin_level"~"^[456]$"];
+  out tags;
+);"""
+
+    print("Querying Overpass for administrative areas", file=sys.stderr)
+
+    r = requests.post(url, data={"data": query})
+    r.raise_for_status()
+
+    areas = {}
+    current = None
+
+    for elem in r.json().get("elements", []):
+        if elem.get("type") == "node":
+            current = areas.setdefault(elem["id"], {})
+            continue
+
+        if current is None:
+            continue
+
+        tags = elem.get("tags", {})
+        name = tags.get("name:en", tags.get("name", ""))
+        current[tags.get("admin_level")] = name
+
+    return areas
+
+
+areas = get_areas()
+
+print("Adding regions", file=sys.stderr)
+
+for elem in rj.get("elements", []):
+    crs = elem.get("tags", {}).get("ref:crs")
+    if crs not in out:
+        continue
+
+    station_areas = areas.get(elem["id"], {})
+
+    country = station_areas.get(COUNTRY_ADMIN_LEVEL, "")
+    region = station_areas.get(REGION_ADMIN_LEVEL, "")
+    if region == "" or country != "England":
+        region = country
+    # OSM region names are things like "North West England", whereas ITL1 regions are "North West" (but "East of
+    # England" is the same in both).
+    if country == "England" and region != "East of England":
+        region = case_insensitive_rstrip(region, "England")
+
+    out[crs]["country"] = country
+    out[crs]["region"] = region
+    out[crs]["county"] = station_areas.get(COUNTY_ADMIN_LEVEL, "")
+
+
 nrt_names = get_names_from_pdf(NRT_STATION_INDEX_FILENAME)
 
 print("Overwriting station names with NRT names", file=sys.stderr)
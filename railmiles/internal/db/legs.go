@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"strings"
+)
+
+// StationLocator returns the location of a station, or false if it isn't known.
+type StationLocator func(code string) (lat, lon float32, found bool)
+
+// BuildLegs splits a journey through stations into one leg for each pair of adjacent stations. callingPoints is every
+// station passed between the first and last station, including the intermediate stations themselves, as stored in
+// railmiles_routes_v3. If the calling points can't be matched up with the stations, the legs are left without any.
+//
+// distance is shared between the legs in proportion to the straight line distance along each of them. If any station
+// can't be located, it is shared equally instead. If there is more than one leg, they are all marked as inferred, since
+// their distances are only estimates.
+func BuildLegs(stations, callingPoints []string, distance float32, locate StationLocator) []*Leg {
+	if len(stations) < 2 {
+		return nil
+	}
+
+	split := splitCallingPoints(stations, callingPoints)
+
+	var (
+		legs    = make([]*Leg, len(stations)-1)
+		lengths = make([]float64, len(legs))
+		total   float64
+		located = true
+	)
+	for i := range legs {
+		legs[i] = &Leg{From: stations[i], To: stations[i+1], Inferred: len(legs) > 1}
+		if split != nil {
+			legs[i].CallingPoints = split[i]
+		}
+
+		path := append([]string{legs[i].From}, legs[i].CallingPoints...)
+		path = append(path, legs[i].To)
+		for j := 0; j < len(path)-1 && located; j += 1 {
+			lat1, lon1, found1 := locate(path[j])
+			lat2, lon2, found2 := locate(path[j+1])
+			located = found1 && found2
+			lengths[i] += util.HaversineMiles(lat1, lon1, lat2, lon2)
+		}
+		total += lengths[i]
+	}
+
+	for i, leg := range legs {
+		if located && total != 0 {
+			leg.Distance = float32(lengths[i]/total) * distance
+		} else {
+			leg.Distance = distance / float32(len(legs))
+		}
+	}
+
+	return legs
+}
+
+// splitCallingPoints divides the calling points of a journey between each of its legs. nil is returned if the
+// intermediate stations of the journey don't all appear in the calling points in order.
+func splitCallingPoints(stations, callingPoints []string) [][]string {
+	var (
+		res = make([][]string, len(stations)-1)
+		leg int
+	)
+	for _, station := range callingPoints {
+		if leg < len(res)-1 && strings.EqualFold(station, stations[leg+1]) {
+			leg += 1
+			continue
+		}
+		res[leg] = append(res[leg], station)
+	}
+	if leg != len(res)-1 {
+		return nil
+	}
+	return res
+}
+
+// SplitJourneysIntoLegs creates legs for every journey that doesn't have any, using the calling points stored for it
+// where possible. The distance of each leg is estimated from the distance of the journey, and no service details are
+// known. Since this is run by a migration, it only uses the columns that existed at the time.
+func SplitJourneysIntoLegs(ctx context.Context, idb bun.IDB) error {
+	var journeys []*journeyV3
+	err := idb.NewSelect().
+		Model(&journeys).
+		Where(`"journey"."id" NOT IN (SELECT DISTINCT "journey_id" FROM "railmiles_legs")`).
+		Scan(ctx)
+	if err != nil {
+		return util.Wrap(err, "fetching journeys without legs")
+	}
+
+	if len(journeys) == 0 {
+		return nil
+	}
+
+	var routeParts []*routeV3
+	if err := idb.NewSelect().Model(&routeParts).Order("journey_id", "sequence").Scan(ctx); err != nil {
+		return util.Wrap(err, "fetching routes")
+	}
+
+	routes := make(map[uuid.UUID][]string)
+	for _, part := range routeParts {
+		routes[part.JourneyID] = append(routes[part.JourneyID], strings.ToUpper(part.Station))
+	}
+
+	var stations []*stationV1
+	if err := idb.NewSelect().Model(&stations).Scan(ctx); err != nil {
+		return util.Wrap(err, "fetching stations")
+	}
+
+	locations := make(map[string]*stationV1, len(stations))
+	for _, station := range stations {
+		locations[station.Code] = station
+	}
+
+	locate := func(code string) (float32, float32, bool) {
+		if station, found := locations[code]; found {
+			return station.Lat, station.Lon, true
+		}
+		return 0, 0, false
+	}
+
+	var legs []*legV2
+	for _, journey := range journeys {
+		path := []string{strings.ToUpper(journey.From.Shortcode)}
+		for _, via := range journey.Via {
+			path = append(path, strings.ToUpper(via.Shortcode))
+		}
+		path = append(path, strings.ToUpper(journey.To.Shortcode))
+
+		for i, leg := range BuildLegs(path, routes[journey.ID], journey.Distance, locate) {
+			legs = append(legs, &legV2{
+				JourneyID:     journey.ID,
+				Sequence:      i,
+				UserID:        journey.UserID,
+				From:          leg.From,
+				To:            leg.To,
+				Distance:      leg.Distance,
+				CallingPoints: leg.CallingPoints,
+			})
+		}
+	}
+
+	// Inserting in chunks keeps us under SQLite's limit on the number of parameters in a single query.
+	const chunkSize = 200
+	for i := 0; i < len(legs); i += chunkSize {
+		chunk := legs[i:min(i+chunkSize, len(legs))]
+		if _, err := idb.NewInsert().Model(&chunk).Exec(ctx); err != nil {
+			return util.Wrap(err, "inserting legs")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/uptrace/bun"
+	"time"
+)
+
+// StationSeed is the station dataset generated by getStationData.py. It's copied into the stations table, where it
+// can be added to or overridden.
+//
+//go:embed stationData.json
+var StationSeed []byte
+
+// SeedStations makes the stations table match StationSeed. Stations that have been added or changed by an admin (ie.
+// those marked Custom) are left alone.
+func SeedStations(ctx context.Context, idb bun.IDB) error {
+	var seed map[string]*Station
+	if err := json.Unmarshal(StationSeed, &seed); err != nil {
+		return util.Wrap(err, "parsing station seed data")
+	}
+
+	now := time.Now().UTC()
+	stations := make([]*Station, 0, len(seed))
+	for code, station := range seed {
+		station.Code = code
+		station.UpdatedAt = now
+		stations = append(stations, station)
+	}
+
+	// Keeping the number of parameters in each query under SQLite's limit.
+	const chunkSize = 100
+	for i := 0; i < len(stations); i += chunkSize {
+		chunk := stations[i:min(i+chunkSize, len(stations))]
+		_, err := idb.NewInsert().
+			Model(&chunk).
+			On("CONFLICT (code) DO UPDATE").
+			Set(`"name" = EXCLUDED."name"`).
+			Set(`"lat" = EXCLUDED."lat"`).
+			Set(`"lon" = EXCLUDED."lon"`).
+			Set(`"country" = EXCLUDED."country"`).
+			Set(`"region" = EXCLUDED."region"`).
+			Set(`"county" = EXCLUDED."county"`).
+			Set(`"updated_at" = EXCLUDED."updated_at"`).
+			Where(`"station"."custom" = false`).
+			Exec(ctx)
+		if err != nil {
+			return util.Wrap(err, "upserting stations")
+		}
+	}
+
+	codes := make([]string, len(stations))
+	for i, station := range stations {
+		codes[i] = station.Code
+	}
+
+	// Stations that have been removed from the seed data
+	_, err := idb.NewDelete().
+		Model((*Station)(nil)).
+		Where(`"custom" = false`).
+		Where(`"code" NOT IN (?)`, bun.In(codes)).
+		Exec(ctx)
+	if err != nil {
+		return util.Wrap(err, "removing old stations")
+	}
+
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
+	"strings"
 	"time"
 )
 
@@ -23,10 +24,24 @@ type journeyV1 struct {
 	Return   bool           `json:"return"`
 }
 
+type journeyV2 struct {
+	bun.BaseModel `bun:"table:railmiles_journeys_v2"`
+
+	ID uuid.UUID `bun:",pk,type:uuid"`
+
+	From     *StationName
+	To       *StationName
+	Via      []*StationName `bun:",nullzero"`
+	Distance float32
+	Date     time.Time
+	ReturnID *uuid.UUID `bun:",nullzero,type:uuid"`
+}
+
 type Journey struct {
 	bun.BaseModel `bun:"table:railmiles_journeys_v2" json:"-"`
 
-	ID uuid.UUID `bun:",pk,type:uuid" json:"id"`
+	ID     uuid.UUID `bun:",pk,type:uuid" json:"id"`
+	UserID uuid.UUID `bun:",type:uuid" json:"-"`
 
 	From     *StationName   `json:"from"`
 	To       *StationName   `json:"to"`
@@ -34,6 +49,19 @@ type Journey struct {
 	Distance float32        `json:"distance"`
 	Date     time.Time      `json:"date"`
 	ReturnID *uuid.UUID     `bun:",nullzero,type:uuid" json:"returnID,omitempty"`
+	// ManualDistance is set when Distance was entered by the user instead of being worked out from the route.
+	ManualDistance bool `json:"manualDistance"`
+	// InferredDistance is set when some of Distance was estimated from previously recorded journeys because the
+	// distance provider couldn't give it.
+	InferredDistance bool `json:"inferredDistance"`
+	// TicketID refers to the ticket used for the journey, if one has been recorded. A return ticket is shared by a
+	// journey and its return.
+	TicketID *uuid.UUID `bun:",nullzero,type:uuid" json:"ticketID,omitempty"`
+	// PlannedArrival is when the journey was originally due to arrive at its destination. It is set from the
+	// scheduled arrival of the last leg once that is first known, either when the legs are saved or when their times
+	// are refreshed, and isn't changed afterwards. This means a journey that was edited to use a later train after a
+	// missed connection is still counted as late.
+	PlannedArrival *time.Time `bun:",nullzero" json:"plannedArrival,omitempty"`
 }
 
 type routeV1 struct {
@@ -53,12 +81,21 @@ type routeV2 struct {
 	Station  string
 }
 
+type routeV3 struct {
+	bun.BaseModel `bun:"table:railmiles_routes_v3"`
+
+	JourneyID uuid.UUID `bun:",pk,type:uuid"`
+	Sequence  int
+	Station   string
+}
+
 type Route struct {
 	bun.BaseModel `bun:"table:railmiles_routes_v3"`
 
 	JourneyID uuid.UUID `bun:",pk,type:uuid"`
 	Sequence  int
 	Station   string
+	UserID    uuid.UUID `bun:",type:uuid"`
 }
 
 type StationName struct {
@@ -93,3 +130,209 @@ func (sn *StationName) Scan(src any) error {
 func (sn *StationName) Value() (driver.Value, error) {
 	return sn.Shortcode, nil
 }
+
+type legCacheEntryV1 struct {
+	bun.BaseModel `bun:"table:railmiles_leg_cache"`
+
+	From          string `bun:",pk"`
+	To            string `bun:",pk"`
+	CallingPoints string `bun:",pk"`
+	Distance      float32
+	Hits          int
+	UpdatedAt     time.Time
+}
+
+type LegCacheEntry struct {
+	bun.BaseModel `bun:"table:railmiles_leg_cache"`
+
+	From          string  `bun:",pk" json:"from"`
+	To            string  `bun:",pk" json:"to"`
+	CallingPoints string  `bun:",pk" json:"callingPoints"`
+	Distance      float32 `json:"distance"`
+	Hits          int     `json:"hits"`
+	// ServiceUID, Operator and Headcode describe the service that Distance was most recently fetched for, if the
+	// distance provider gave its details.
+	ServiceUID string    `bun:",nullzero" json:"serviceUID,omitempty"`
+	Operator   string    `bun:",nullzero" json:"operator,omitempty"`
+	Headcode   string    `bun:",nullzero" json:"headcode,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func (lce *LegCacheEntry) Route() []string {
+	if lce.CallingPoints == "" {
+		return nil
+	}
+	return strings.Split(lce.CallingPoints, ",")
+}
+
+type User struct {
+	bun.BaseModel `bun:"table:railmiles_users" json:"-"`
+
+	ID           uuid.UUID `bun:",pk,type:uuid" json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	IsAdmin      bool      `json:"isAdmin"`
+	// ShareTokenHash is the hash of the token in the user's share link, if they've created one.
+	ShareTokenHash *string   `bun:",nullzero" json:"-"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+type Session struct {
+	bun.BaseModel `bun:"table:railmiles_sessions"`
+
+	TokenHash string    `bun:",pk"`
+	UserID    uuid.UUID `bun:",type:uuid"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type APIToken struct {
+	bun.BaseModel `bun:"table:railmiles_api_tokens" json:"-"`
+
+	ID         uuid.UUID  `bun:",pk,type:uuid" json:"id"`
+	UserID     uuid.UUID  `bun:",type:uuid" json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `bun:",nullzero" json:"lastUsedAt"`
+}
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobFailed    JobState = "failed"
+	JobDone      JobState = "done"
+	JobCancelled JobState = "cancelled"
+)
+
+type Job struct {
+	bun.BaseModel `bun:"table:railmiles_jobs" json:"-"`
+
+	ID        uuid.UUID `bun:",pk,type:uuid" json:"id"`
+	UserID    uuid.UUID `bun:",type:uuid" json:"-"`
+	Kind      string    `json:"kind"`
+	Payload   string    `json:"-"`
+	State     JobState  `json:"state"`
+	Attempts  int       `json:"attempts"`
+	RunAfter  time.Time `json:"runAfter"`
+	Error     string    `bun:",nullzero" json:"error,omitempty"`
+	Result    string    `bun:",nullzero" json:"result,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Finished returns true if the job will not be run again.
+func (j *Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+type JobEvent struct {
+	bun.BaseModel `bun:"table:railmiles_job_events" json:"-"`
+
+	ID        int64     `bun:",pk,autoincrement" json:"id"`
+	JobID     uuid.UUID `bun:",type:uuid" json:"-"`
+	Event     string    `json:"event"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Upload is a file uploaded for a job to process. Uploads are kept separately from the jobs that use them so that large
+// files aren't copied around with the job.
+type Upload struct {
+	bun.BaseModel `bun:"table:railmiles_uploads"`
+
+	ID        uuid.UUID `bun:",pk,type:uuid"`
+	UserID    uuid.UUID `bun:",type:uuid"`
+	Content   []byte
+	CreatedAt time.Time
+}
+
+type Station struct {
+	bun.BaseModel `bun:"table:railmiles_stations"`
+
+	Code    string  `bun:",pk" json:"code"`
+	Name    string  `json:"name"`
+	Lat     float32 `json:"lat"`
+	Lon     float32 `json:"lon"`
+	Country string  `json:"country"`
+	Region  string  `json:"region"`
+	County  string  `json:"county"`
+	// Custom is set if the station was added or changed by an admin, in which case it isn't updated from the seed
+	// data.
+	Custom    bool      `json:"custom"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// StationAlias maps an alternative code for a station, such as one of the DPRS codes used by some ticketing systems,
+// to its CRS code.
+type StationAlias struct {
+	bun.BaseModel `bun:"table:railmiles_station_aliases"`
+
+	Alias string `bun:",pk" json:"alias"`
+	Code  string `json:"code"`
+}
+
+// Leg is the part of a journey travelled on a single service. Every journey has at least one leg, and the stations
+// that a journey goes via are where one leg ends and the next begins. Service details are only known if the distance
+// of the leg was fetched from the distance provider.
+type Leg struct {
+	bun.BaseModel `bun:"table:railmiles_legs" json:"-"`
+
+	JourneyID uuid.UUID `bun:",pk,type:uuid" json:"-"`
+	Sequence  int       `bun:",pk" json:"sequence"`
+	UserID    uuid.UUID `bun:",type:uuid" json:"-"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Distance  float32   `json:"distance"`
+	// Inferred is set when Distance is an estimate instead of being given by the distance provider or the user. It was
+	// either inferred from previously recorded journeys, or worked out by splitting the distance of the whole journey
+	// between its legs.
+	Inferred bool `json:"inferred"`
+	// CallingPoints are the stations passed between From and To.
+	CallingPoints []string `bun:",nullzero" json:"callingPoints"`
+	ServiceUID    string   `bun:",nullzero" json:"serviceUID,omitempty"`
+	// Operator is the ATOC code of the train operating company that ran the service.
+	Operator           string     `bun:",nullzero" json:"operator,omitempty"`
+	Headcode           string     `bun:",nullzero" json:"headcode,omitempty"`
+	ScheduledDeparture *time.Time `bun:",nullzero" json:"scheduledDeparture,omitempty"`
+	ActualDeparture    *time.Time `bun:",nullzero" json:"actualDeparture,omitempty"`
+	ScheduledArrival   *time.Time `bun:",nullzero" json:"scheduledArrival,omitempty"`
+	ActualArrival      *time.Time `bun:",nullzero" json:"actualArrival,omitempty"`
+}
+
+type ClaimStatus string
+
+const (
+	ClaimNotClaimed ClaimStatus = "notClaimed"
+	ClaimSubmitted  ClaimStatus = "submitted"
+	ClaimPaid       ClaimStatus = "paid"
+)
+
+// Claim records a Delay Repay claim made for a delayed journey.
+type Claim struct {
+	bun.BaseModel `bun:"table:railmiles_claims" json:"-"`
+
+	JourneyID uuid.UUID   `bun:",pk,type:uuid" json:"journeyID"`
+	UserID    uuid.UUID   `bun:",type:uuid" json:"-"`
+	Status    ClaimStatus `json:"status"`
+	// Amount is the compensation received, in pence.
+	Amount    int       `json:"amount"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Ticket is the ticket used for one or more journeys.
+type Ticket struct {
+	bun.BaseModel `bun:"table:railmiles_tickets" json:"-"`
+
+	ID     uuid.UUID `bun:",pk,type:uuid" json:"id"`
+	UserID uuid.UUID `bun:",type:uuid" json:"-"`
+	// Fare is the price paid for the ticket, in pence, after any railcard discount.
+	Fare     int    `json:"fare"`
+	Type     string `json:"type"`
+	Railcard string `bun:",nullzero" json:"railcard"`
+	// Reference is the number printed on the ticket or the booking reference it was bought with.
+	Reference string    `bun:",nullzero" json:"reference"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
@@ -0,0 +1,244 @@
+package httpsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "railmiles_session"
+	userLocalsKey     = "user"
+)
+
+// requireAuth rejects any request that doesn't have either a valid session cookie or a valid API token in the
+// Authorization header. The user that the request was made by is stored in the request context and can be retrieved
+// with currentUser.
+func (hs *httpServer) requireAuth(ctx *fiber.Ctx) error {
+	if ctx.Path() == "/api/auth/login" || strings.HasPrefix(ctx.Path(), "/api/shared/") {
+		return ctx.Next()
+	}
+
+	if !hs.core.AuthEnabled() {
+		user, err := hs.core.DefaultUser()
+		if err != nil {
+			return util.Wrap(err, "fetching default user")
+		}
+		ctx.Locals(userLocalsKey, user)
+		return ctx.Next()
+	}
+
+	var user *db.User
+
+	if header := ctx.Get("Authorization"); header != "" {
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found {
+			return fiber.ErrUnauthorized
+		}
+		var err error
+		user, err = hs.core.ValidateAPIToken(strings.TrimSpace(token))
+		if err != nil {
+			return util.Wrap(err, "validating API token")
+		}
+	} else if cookie := ctx.Cookies(sessionCookieName); cookie != "" {
+		var err error
+		user, err = hs.core.ValidateSession(cookie)
+		if err != nil {
+			return util.Wrap(err, "validating session")
+		}
+	}
+
+	if user == nil {
+		return fiber.ErrUnauthorized
+	}
+
+	ctx.Locals(userLocalsKey, user)
+	return ctx.Next()
+}
+
+func (hs *httpServer) requireAdmin(ctx *fiber.Ctx) error {
+	if !currentUser(ctx).IsAdmin {
+		return fiber.ErrForbidden
+	}
+	return ctx.Next()
+}
+
+func currentUser(ctx *fiber.Ctx) *db.User {
+	return ctx.Locals(userLocalsKey).(*db.User)
+}
+
+func (hs *httpServer) login(ctx *fiber.Ctx) error {
+	if !strings.EqualFold(ctx.Get("Content-Type"), "application/json") {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "invalid Content-Type (requires application/json)",
+		})
+	}
+
+	requestBody := new(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	})
+
+	if err := json.Unmarshal(ctx.Body(), &requestBody); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+
+	var user *db.User
+	if hs.core.AuthEnabled() {
+		var err error
+		user, err = hs.core.Authenticate(requestBody.Username, requestBody.Password)
+		if err != nil {
+			return util.Wrap(err, "authenticating user")
+		}
+	}
+
+	if user == nil {
+		// Slows down anyone trying to guess the password.
+		time.Sleep(time.Second)
+		ctx.Status(401)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "Incorrect username or password",
+		})
+	}
+
+	token, expires, err := hs.core.CreateSession(user.ID)
+	if err != nil {
+		return util.Wrap(err, "creating session")
+	}
+
+	ctx.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   hs.secureCookies(ctx),
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+
+	return ctx.JSON(StockResponse{Ok: true})
+}
+
+// secureCookies returns true if cookies set in response to ctx should only be sent by the browser over HTTPS.
+func (hs *httpServer) secureCookies(ctx *fiber.Ctx) bool {
+	return ctx.Secure() || hs.config.HTTP.BehindHTTPSProxy
+}
+
+func (hs *httpServer) logout(ctx *fiber.Ctx) error {
+	if cookie := ctx.Cookies(sessionCookieName); cookie != "" {
+		if err := hs.core.DeleteSession(cookie); err != nil {
+			return util.Wrap(err, "deleting session")
+		}
+	}
+
+	ctx.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		Secure:   hs.secureCookies(ctx),
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+
+	ctx.Status(204)
+	return nil
+}
+
+func (hs *httpServer) authStatus(ctx *fiber.Ctx) error {
+	// Only reachable if requireAuth has let the request through.
+	user := currentUser(ctx)
+
+	return ctx.JSON(&struct {
+		Ok          bool `json:"ok"`
+		AuthEnabled bool `json:"authEnabled"`
+		*db.User
+		// Sharing is set if the user has a share link. The link itself is only returned when it's created.
+		Sharing bool `json:"sharing"`
+	}{
+		Ok:          true,
+		AuthEnabled: hs.core.AuthEnabled(),
+		User:        user,
+		Sharing:     user.ShareTokenHash != nil,
+	})
+}
+
+func (hs *httpServer) tokenListing(ctx *fiber.Ctx) error {
+	tokens, err := hs.core.GetAPITokens(currentUser(ctx).ID)
+	if err != nil {
+		return util.Wrap(err, "fetching API tokens")
+	}
+	return ctx.JSON(tokens)
+}
+
+func (hs *httpServer) newToken(ctx *fiber.Ctx) error {
+	if !strings.EqualFold(ctx.Get("Content-Type"), "application/json") {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "invalid Content-Type (requires application/json)",
+		})
+	}
+
+	requestBody := new(struct {
+		Name string `json:"name"`
+	})
+
+	if err := json.Unmarshal(ctx.Body(), &requestBody); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+
+	requestBody.Name = strings.TrimSpace(requestBody.Name)
+	if requestBody.Name == "" {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "A token name is required",
+		})
+	}
+
+	apiToken, token, err := hs.core.CreateAPIToken(currentUser(ctx).ID, requestBody.Name)
+	if err != nil {
+		return util.Wrap(err, "creating API token")
+	}
+
+	ctx.Status(201)
+	return ctx.JSON(&struct {
+		ID    uuid.UUID `json:"id"`
+		Name  string    `json:"name"`
+		Token string    `json:"token"`
+	}{apiToken.ID, apiToken.Name, token})
+}
+
+func (hs *httpServer) deleteToken(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	if err := hs.core.DeleteAPIToken(currentUser(ctx).ID, id); err != nil {
+		if errors.Is(err, core.ErrTokenNotFound) {
+			return fiber.ErrNotFound
+		}
+		return util.Wrap(err, "deleting API token %s", id.String())
+	}
+
+	ctx.Status(204)
+	return nil
+}
@@ -0,0 +1,27 @@
+package httpsrv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/exp/slog"
+	"time"
+)
+
+func (hs *httpServer) downloadBackup(ctx *fiber.Ctx) error {
+	backup, err := hs.core.CreateBackup()
+	if err != nil {
+		slog.Error("error when creating backup", "err", err)
+		return errInternalServerError
+	}
+
+	buf := new(bytes.Buffer)
+	if err := backup.Write(buf); err != nil {
+		slog.Error("error when writing backup", "err", err)
+		return errInternalServerError
+	}
+
+	ctx.Set("Content-Type", "application/gzip")
+	ctx.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="railmiles-backup-%s.json.gz"`, time.Now().Format("2006-01-02")))
+	return ctx.Send(buf.Bytes())
+}
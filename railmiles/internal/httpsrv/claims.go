@@ -0,0 +1,136 @@
+package httpsrv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+	"time"
+)
+
+const refreshArrivalsJobKind = "refreshArrivals"
+
+// arrivalRefreshInterval is how often a refresh of arrival times is queued for each user that has legs waiting for
+// them.
+const arrivalRefreshInterval = time.Hour
+
+// claimListing returns every journey that is eligible for Delay Repay or has a claim recorded against it.
+func (hs *httpServer) claimListing(ctx *fiber.Ctx) error {
+	journeys, err := hs.core.GetDelayedJourneys(currentUser(ctx).ID)
+	if err != nil {
+		return util.Wrap(err, "fetching delayed journeys")
+	}
+	if journeys == nil {
+		journeys = []*core.DelayedJourney{}
+	}
+	return ctx.JSON(journeys)
+}
+
+func (hs *httpServer) putClaim(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	claim := new(db.Claim)
+	if err := json.Unmarshal(ctx.Body(), claim); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+	claim.JourneyID = id
+	claim.UserID = currentUser(ctx).ID
+
+	if err := hs.core.PutClaim(claim); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fiber.ErrNotFound
+		}
+		if errors.Is(err, core.ErrInvalidClaim) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return util.Wrap(err, "saving claim for journey %s", id.String())
+	}
+
+	return ctx.JSON(claim)
+}
+
+// refreshArrivals queues a job to fetch the actual arrival times of recent legs that don't have them yet. If one is
+// already queued or running for the user, the ID of that job is returned instead.
+func (hs *httpServer) refreshArrivals(ctx *fiber.Ctx) error {
+	userID := currentUser(ctx).ID
+
+	job, err := hs.core.GetPendingJob(userID, refreshArrivalsJobKind)
+	if err != nil {
+		return util.Wrap(err, "fetching pending refresh job")
+	}
+
+	if job == nil {
+		job, err = hs.core.EnqueueJob(userID, refreshArrivalsJobKind, struct{}{})
+		if err != nil {
+			return util.Wrap(err, "enqueueing refresh job")
+		}
+	}
+
+	ctx.Status(202)
+	return ctx.JSON(&struct {
+		ProcessorID uuid.UUID `json:"processorID"`
+	}{job.ID})
+}
+
+// runRefreshArrivalsJob fetches arrival times for a user. The result of the job is the JSON-encoded number of legs
+// that were updated.
+func (hs *httpServer) runRefreshArrivalsJob(ctx context.Context, job *db.Job, output chan *util.SSEItem) (string, error) {
+	updated, err := hs.core.RefreshArrivals(ctx, job.UserID, output)
+	if err != nil {
+		return "", err
+	}
+
+	encoded, err := json.Marshal(&struct {
+		Updated int `json:"updated"`
+	}{updated})
+	if err != nil {
+		slog.Error("error when encoding refresh result", "err", err)
+		return "", errInternalServerError
+	}
+
+	return string(encoded), nil
+}
+
+// refreshArrivalsPeriodically queues a refresh of arrival times every arrivalRefreshInterval for every user that has
+// legs waiting for them, so that journeys logged before they were made get their delays without anyone having to ask.
+func (hs *httpServer) refreshArrivalsPeriodically() {
+	for {
+		userIDs, err := hs.core.GetUsersAwaitingArrivals()
+		if err != nil {
+			slog.Error("unable to fetch users awaiting arrival times", "err", err)
+		}
+
+		for _, userID := range userIDs {
+			job, err := hs.core.GetPendingJob(userID, refreshArrivalsJobKind)
+			if err != nil {
+				slog.Error("unable to fetch pending refresh job", "user", userID, "err", err)
+				continue
+			}
+			if job != nil {
+				continue
+			}
+			if _, err := hs.core.EnqueueJob(userID, refreshArrivalsJobKind, struct{}{}); err != nil {
+				slog.Error("unable to enqueue refresh job", "user", userID, "err", err)
+			}
+		}
+
+		time.Sleep(arrivalRefreshInterval)
+	}
+}
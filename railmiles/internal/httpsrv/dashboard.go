@@ -6,47 +6,163 @@ import (
 	"github.com/codemicro/railmiles/railmiles/internal/db"
 	"github.com/codemicro/railmiles/railmiles/internal/util"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"time"
 )
 
+type dashboardResponse struct {
+	GeoJSON json.RawMessage `json:"geoJSON,omitempty"`
+	Stats   struct {
+		LastMonth *core.JourneyStats `json:"lastMonth"`
+		YTD       *core.JourneyStats `json:"ytd"`
+		AllTime   *core.JourneyStats `json:"allTime"`
+		// Selected is only set if a date range was requested
+		Selected *core.JourneyStats `json:"selected,omitempty"`
+	} `json:"stats"`
+	DateRange *core.DateRange `json:"dateRange,omitempty"`
+	Journeys  []*db.Journey   `json:"journeys"`
+	// Delays contains the delay of each journey in Journeys where it is known, keyed by journey ID.
+	Delays     map[uuid.UUID]*core.JourneyDelay `json:"delays"`
+	Completion *core.StationCompletion          `json:"completion"`
+	// Operators is the distance travelled with each operator in the same range as Journeys.
+	Operators []*core.OperatorMileage `json:"operators"`
+	// TicketTypes is the amount spent on each type of ticket in the same range as Journeys.
+	TicketTypes []*core.TicketTypeSpend `json:"ticketTypes,omitempty"`
+}
+
+// hideCosts removes everything about how much was paid for journeys from the dashboard.
+func (dr *dashboardResponse) hideCosts() {
+	for _, stats := range []*core.JourneyStats{dr.Stats.LastMonth, dr.Stats.YTD, dr.Stats.AllTime, dr.Stats.Selected} {
+		if stats != nil {
+			stats.Spend = 0
+			stats.PencePerMile = 0
+		}
+	}
+	dr.TicketTypes = nil
+	for _, journey := range dr.Journeys {
+		journey.TicketID = nil
+	}
+}
+
 func (hs *httpServer) dashboardInfo(ctx *fiber.Ctx) error {
-	var response = struct {
-		GeoJSON json.RawMessage `json:"geoJSON,omitempty"`
-		Stats   struct {
-			LastMonth *core.JourneyStats `json:"lastMonth"`
-			YTD       *core.JourneyStats `json:"ytd"`
-			AllTime   *core.JourneyStats `json:"allTime"`
-		} `json:"stats"`
-		Journeys []*db.Journey `json:"journeys"`
-	}{}
+	dr, loc, err := parseDateRange(ctx)
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
 
-	journeys, err := hs.core.GetJourneys(&core.GetJourneysArgs{Since: core.LastMonth})
+	response, err := hs.buildDashboard(currentUser(ctx).ID, dr, loc)
 	if err != nil {
-		return util.Wrap(err, "fetching journeys in the last month")
+		return err
+	}
+	return ctx.JSON(response)
+}
+
+// sharedDashboardInfo serves a read-only copy of the dashboard of the user that the share token in the URL belongs to.
+func (hs *httpServer) sharedDashboardInfo(ctx *fiber.Ctx) error {
+	user, err := hs.core.GetUserByShareToken(ctx.Params("token"))
+	if err != nil {
+		return util.Wrap(err, "fetching user by share token")
+	}
+
+	if user == nil {
+		return fiber.ErrNotFound
+	}
+
+	dr, loc, err := parseDateRange(ctx)
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
+
+	response, err := hs.buildDashboard(user.ID, dr, loc)
+	if err != nil {
+		return err
+	}
+	// Fares are used for expenses and aren't something that should be shared publicly.
+	response.hideCosts()
+
+	return ctx.JSON(&struct {
+		Username string `json:"username"`
+		*dashboardResponse
+	}{user.Username, response})
+}
+
+// buildDashboard collects the dashboard for a user. The journeys shown are those in dr, or those in the last month if
+// dr is empty. loc is used to work out the current date.
+func (hs *httpServer) buildDashboard(userID uuid.UUID, dr core.DateRange, loc *time.Location) (*dashboardResponse, error) {
+	response := new(dashboardResponse)
+
+	lastMonth, _ := core.LastMonth.Range(loc)
+	ytd, _ := core.YearToDate.Range(loc)
+
+	journeyRange := lastMonth
+	if !dr.IsZero() {
+		journeyRange = dr
+		response.DateRange = &dr
+	}
+
+	journeys, err := hs.core.GetJourneys(&core.GetJourneysArgs{UserID: userID, JourneyFilter: core.JourneyFilter{DateRange: journeyRange}})
+	if err != nil {
+		return nil, util.Wrap(err, "fetching journeys for dashboard")
 	}
 
 	response.GeoJSON = []byte(hs.core.GenerateJourneyGeoJSON(journeys, false))
 
-	lastMonthStats, err := hs.core.GetJourneyStats(core.LastMonth)
+	lastMonthStats, err := hs.core.GetJourneyStats(userID, &core.JourneyFilter{DateRange: lastMonth})
 	if err != nil {
-		return util.Wrap(err, "fetching last month stats")
+		return nil, util.Wrap(err, "fetching last month stats")
 	}
 
-	ytdStats, err := hs.core.GetJourneyStats(core.YearToDate)
+	ytdStats, err := hs.core.GetJourneyStats(userID, &core.JourneyFilter{DateRange: ytd})
 	if err != nil {
-		return util.Wrap(err, "fetching year-to-date stats")
+		return nil, util.Wrap(err, "fetching year-to-date stats")
 	}
 
-	allTimeStats, err := hs.core.GetJourneyStats(core.AllTime)
+	allTimeStats, err := hs.core.GetJourneyStats(userID, &core.JourneyFilter{})
 	if err != nil {
-		return util.Wrap(err, "fetching all time stats")
+		return nil, util.Wrap(err, "fetching all time stats")
+	}
+
+	if !dr.IsZero() {
+		response.Stats.Selected, err = hs.core.GetJourneyStats(userID, &core.JourneyFilter{DateRange: dr})
+		if err != nil {
+			return nil, util.Wrap(err, "fetching stats for selected range")
+		}
 	}
 
 	response.Stats.LastMonth = lastMonthStats
 	response.Stats.YTD = ytdStats
 	response.Stats.AllTime = allTimeStats
 
+	response.Completion, err = hs.core.GetStationCompletion(userID)
+	if err != nil {
+		return nil, util.Wrap(err, "fetching station completion")
+	}
+
+	response.Operators, err = hs.core.GetOperatorMileage(userID, &core.JourneyFilter{DateRange: journeyRange})
+	if err != nil {
+		return nil, util.Wrap(err, "fetching operator mileage")
+	}
+
+	response.TicketTypes, err = hs.core.GetTicketTypeSpend(userID, &core.JourneyFilter{DateRange: journeyRange})
+	if err != nil {
+		return nil, util.Wrap(err, "fetching ticket type spend")
+	}
+
+	response.Delays, err = hs.core.GetJourneyDelays(journeys)
+	if err != nil {
+		return nil, util.Wrap(err, "fetching journey delays")
+	}
+
 	core.PopulateFullStationNames(journeys)
 	response.Journeys = journeys
 
-	return ctx.JSON(response)
+	return response, nil
 }
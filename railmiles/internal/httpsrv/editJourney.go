@@ -0,0 +1,210 @@
+package httpsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+	"strings"
+	"time"
+)
+
+type editJourneyRequest struct {
+	Date              *time.Time `json:"date"`
+	Route             [][]string `json:"route"`
+	ManualDistance    *float32   `json:"manualDistance"`
+	RecomputeDistance bool       `json:"recomputeDistance"`
+}
+
+const editJourneyJobKind = "editJourney"
+
+type editJourneyJob struct {
+	JourneyID uuid.UUID `json:"journeyID"`
+	Date      time.Time `json:"date"`
+	Locations []string  `json:"locations"`
+	Services  []string  `json:"services"`
+}
+
+func (hs *httpServer) editJourney(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	if !strings.EqualFold(ctx.Get("Content-Type"), "application/json") {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "invalid Content-Type (requires application/json)",
+		})
+	}
+
+	requestBody := new(editJourneyRequest)
+
+	if err := json.Unmarshal(ctx.Body(), &requestBody); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+
+	journey, err := hs.core.GetJourney(currentUser(ctx).ID, id)
+	if err != nil {
+		return util.Wrap(err, "fetching journey %s", id.String())
+	}
+
+	if journey == nil {
+		return fiber.ErrNotFound
+	}
+
+	if requestBody.Date != nil {
+		if requestBody.Date.After(time.Now()) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: "Invalid date: occurs in the future",
+			})
+		}
+		journey.Date = requestBody.Date.UTC()
+	}
+
+	var (
+		hasManualDistance = requestBody.ManualDistance != nil && *requestBody.ManualDistance != 0
+		routeChanged      = requestBody.Route != nil
+		locations         []string
+		services          []string
+	)
+
+	if routeChanged {
+		var problem string
+		locations, services, problem = parseRoute(requestBody.Route, journey.Date, hasManualDistance)
+		if problem != "" {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: problem,
+			})
+		}
+		if ok, err := hs.checkRouteStations(ctx, locations); !ok || err != nil {
+			return err
+		}
+
+		journey.From = &db.StationName{Shortcode: locations[0]}
+		journey.To = &db.StationName{Shortcode: locations[len(locations)-1]}
+		journey.Via = util.Map(locations[1:len(locations)-1], func(x string) *db.StationName {
+			return &db.StationName{Shortcode: x}
+		})
+	} else if requestBody.RecomputeDistance && !hasManualDistance {
+		// The services used for each leg are reused where we know them. Any that we don't are searched for, even
+		// though the journey wasn't made today, since there's no way to ask for them after the fact.
+		legs, err := hs.core.GetLegs(journey.ID)
+		if err != nil {
+			return util.Wrap(err, "fetching legs of journey %s", id.String())
+		}
+
+		locations = []string{journey.From.Shortcode}
+		for _, via := range journey.Via {
+			locations = append(locations, via.Shortcode)
+		}
+		locations = append(locations, journey.To.Shortcode)
+
+		services = make([]string, len(locations))
+		if len(legs) == len(locations)-1 {
+			for i, leg := range legs {
+				services[i] = leg.ServiceUID
+			}
+		}
+
+		if ok, err := hs.checkRouteStations(ctx, locations); !ok || err != nil {
+			return err
+		}
+	}
+
+	if hasManualDistance || !(routeChanged || requestBody.RecomputeDistance) {
+		if hasManualDistance {
+			journey.Distance = *requestBody.ManualDistance
+			journey.ManualDistance = true
+			journey.InferredDistance = false
+		}
+
+		// If the stations have changed, any calling points and legs we have for the old route are now wrong.
+		var legs []*db.Leg
+		if routeChanged {
+			legs = core.ManualLegs(locations, services, journey.Distance)
+		}
+		if err := hs.core.EditJourney(journey, nil, legs, routeChanged); err != nil {
+			return util.Wrap(err, "editing journey %s", id.String())
+		}
+
+		return ctx.JSON(&struct {
+			ID uuid.UUID `json:"id"`
+		}{journey.ID})
+	}
+
+	job, err := hs.core.EnqueueJob(journey.UserID, editJourneyJobKind, &editJourneyJob{
+		JourneyID: journey.ID,
+		Date:      journey.Date,
+		Locations: locations,
+		Services:  services,
+	})
+	if err != nil {
+		return util.Wrap(err, "enqueueing edit journey job")
+	}
+
+	ctx.Status(202)
+	return ctx.JSON(&struct {
+		ProcessorID uuid.UUID `json:"processorID"`
+	}{job.ID})
+}
+
+func (hs *httpServer) runEditJourneyJob(ctx context.Context, job *db.Job, output chan *util.SSEItem) (string, error) {
+	payload := new(editJourneyJob)
+	if err := core.DecodeJobPayload(job, payload); err != nil {
+		return "", util.Wrap(err, "decoding job payload")
+	}
+
+	journey, err := hs.core.GetJourney(job.UserID, payload.JourneyID)
+	if err != nil {
+		slog.Error("error when fetching journey to edit", "err", err)
+		return "", errInternalServerError
+	}
+
+	if journey == nil {
+		return "", errors.New("Journey has been deleted")
+	}
+
+	locations := payload.Locations
+
+	dist, err := hs.core.GetRouteDistance(ctx, locations, payload.Services, payload.Date, output)
+	if err != nil {
+		return "", fmt.Errorf("Unable to fetch distance: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	journey.Date = payload.Date
+	journey.From = &db.StationName{Shortcode: locations[0]}
+	journey.To = &db.StationName{Shortcode: locations[len(locations)-1]}
+	journey.Via = util.Map(locations[1:len(locations)-1], func(x string) *db.StationName {
+		return &db.StationName{Shortcode: x}
+	})
+	journey.Distance = dist.Distance
+	journey.ManualDistance = false
+	journey.InferredDistance = dist.Inferred
+
+	if err := hs.core.EditJourney(journey, dist.Route, dist.Legs, true); err != nil {
+		slog.Error("error when editing journey", "err", err)
+		return "", errInternalServerError
+	}
+
+	return journey.ID.String(), nil
+}
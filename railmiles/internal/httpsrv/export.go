@@ -0,0 +1,80 @@
+package httpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+	"time"
+)
+
+func (hs *httpServer) exportJourneys(ctx *fiber.Ctx) error {
+	format, err := core.ParseExportFormat(ctx.Query("format", "csv"))
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
+
+	dr, _, err := parseDateRange(ctx)
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
+
+	userID := currentUser(ctx).ID
+
+	ctx.Set("Content-Type", format.ContentType())
+	ctx.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="railmiles-%s.%s"`, time.Now().Format("2006-01-02"), format))
+	ctx.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := hs.core.ExportJourneys(w, userID, format, dr); err != nil {
+			// Headers have already been sent by now, so there's nothing better we can do.
+			slog.Error("error when exporting journeys", "err", err)
+		}
+		_ = w.Flush()
+	})
+	return nil
+}
+
+func (hs *httpServer) exportJourney(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	format, err := core.ParseExportFormat(ctx.Query("format", "gpx"))
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
+
+	journey, err := hs.core.GetJourney(currentUser(ctx).ID, id)
+	if err != nil {
+		return util.Wrap(err, "fetching journey %s", id.String())
+	}
+
+	if journey == nil {
+		return fiber.ErrNotFound
+	}
+
+	buf := new(bytes.Buffer)
+	if err := hs.core.ExportJourney(buf, journey, format); err != nil {
+		return util.Wrap(err, "exporting journey %s", id.String())
+	}
+
+	ctx.Set("Content-Type", format.ContentType())
+	ctx.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="railmiles-%s.%s"`, id.String(), format))
+	return ctx.Send(buf.Bytes())
+}
@@ -1,6 +1,7 @@
 package httpsrv
 
 import (
+	"errors"
 	"github.com/codemicro/railmiles/railmiles/internal/config"
 	"github.com/codemicro/railmiles/railmiles/internal/core"
 	"github.com/codemicro/railmiles/railmiles/internal/util"
@@ -8,46 +9,109 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
-	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
 	"net/http"
-	"sync"
 )
 
 type httpServer struct {
 	config *config.Config
 	core   *core.Core
-
-	journeyProcessorLock sync.Mutex
-	journeyProcessors    map[uuid.UUID]chan *util.SSEItem
 }
 
+// errInternalServerError is returned from jobs when something has gone wrong that the user can't do anything about.
+// The details should be logged separately.
+var errInternalServerError = errors.New("Internal Server Error")
+
 func Run(conf *config.Config, c *core.Core) error {
 	srv := &httpServer{
 		config: conf,
 		core:   c,
+	}
+
+	c.RegisterJobHandler(newJourneyJobKind, core.JobLaneInteractive, srv.runNewJourneyJob)
+	c.RegisterJobHandler(editJourneyJobKind, core.JobLaneInteractive, srv.runEditJourneyJob)
+	c.RegisterJobHandler(importJobKind, core.JobLaneBackground, srv.runImportJob)
+	c.RegisterJobHandler(refreshArrivalsJobKind, core.JobLaneBackground, srv.runRefreshArrivalsJob)
+	if err := c.StartJobRunner(); err != nil {
+		return util.Wrap(err, "starting job runner")
+	}
+	go srv.refreshArrivalsPeriodically()
 
-		journeyProcessors: make(map[uuid.UUID]chan *util.SSEItem),
+	if c.AuthEnabled() {
+		admin, err := c.DefaultUser()
+		if err != nil {
+			return util.Wrap(err, "fetching admin user")
+		}
+		if admin.PasswordHash == "" {
+			return errors.New("admin user has no password - set auth.password, or set auth.disabled to turn off authentication")
+		}
 	}
 
 	app := fiber.New(fiber.Config{
 		DisableStartupMessage: !conf.Debug,
+		// X-Forwarded-Proto isn't trusted from anyone. If there's an HTTPS proxy in front of the server,
+		// http.behindHTTPSProxy should be set instead.
+		EnableTrustedProxyCheck: true,
 	})
 	if conf.Debug {
 		app.Use(cors.New())
 	}
+	if !c.AuthEnabled() {
+		slog.Warn("authentication disabled in configuration - anyone can use the API as the admin user")
+	}
 	srv.registerRoutes(app)
 
 	return app.Listen(conf.HTTPAddress())
 }
 
 func (hs *httpServer) registerRoutes(app *fiber.App) {
+	app.Use("/api", hs.requireAuth)
+	app.Post("/api/auth/login", hs.login)
+	app.Post("/api/auth/logout", hs.logout)
+	app.Get("/api/auth/status", hs.authStatus)
+	app.Get("/api/tokens", hs.tokenListing)
+	app.Post("/api/tokens", hs.newToken)
+	app.Delete("/api/tokens/:id", hs.deleteToken)
+	app.Post("/api/users/me/password", hs.changePassword)
+	app.Post("/api/users/me/share", hs.enableSharing)
+	app.Delete("/api/users/me/share", hs.disableSharing)
+	app.Get("/api/users", hs.requireAdmin, hs.userListing)
+	app.Post("/api/users", hs.requireAdmin, hs.newUser)
+	app.Delete("/api/users/:id", hs.requireAdmin, hs.deleteUser)
+	app.Get("/api/shared/:token/dashboard", hs.sharedDashboardInfo)
+	app.Get("/api/shared/:token/map", hs.sharedJourneyMap)
 	app.Get("/api/dashboard", hs.dashboardInfo)
 	app.Get("/api/journeys", hs.journeyListing)
 	app.Post("/api/journeys", hs.newJourney)
 	app.Get("/api/journeys/:id", hs.getJourney)
+	app.Get("/api/journeys/:id/export", hs.exportJourney)
 	app.Get("/api/journeys/processor/:id", hs.serveProcessorStream)
+	app.Delete("/api/journeys/processor/:id", hs.cancelProcessor)
+	app.Get("/api/jobs/:id", hs.getJob)
+	app.Post("/api/import", hs.importJourneys)
+	app.Get("/api/export", hs.exportJourneys)
+	app.Get("/api/map", hs.journeyMap)
+	app.Patch("/api/journeys/:id", hs.editJourney)
 	app.Delete("/api/journeys/:id", hs.deleteJourney)
 	app.Post("/api/journeys/:id/return", hs.createReturnJourney)
+	app.Put("/api/journeys/:id/claim", hs.putClaim)
+	app.Put("/api/journeys/:id/ticket", hs.putTicket)
+	app.Delete("/api/journeys/:id/ticket", hs.deleteTicket)
+	app.Get("/api/claims", hs.claimListing)
+	app.Post("/api/claims/refresh", hs.refreshArrivals)
+	app.Get("/api/stations", hs.stationListing)
+	app.Get("/api/stations/search", hs.searchStations)
+	app.Get("/api/stations/unvisited", hs.unvisitedStations)
+	app.Get("/api/stations/:code", hs.getStation)
+	app.Get("/api/admin/stations", hs.requireAdmin, hs.customStationListing)
+	app.Put("/api/admin/stations/:code", hs.requireAdmin, hs.putStation)
+	app.Delete("/api/admin/stations/:code", hs.requireAdmin, hs.resetStation)
+	app.Get("/api/admin/stationaliases", hs.requireAdmin, hs.stationAliasListing)
+	app.Put("/api/admin/stationaliases/:alias", hs.requireAdmin, hs.putStationAlias)
+	app.Delete("/api/admin/stationaliases/:alias", hs.requireAdmin, hs.deleteStationAlias)
+	app.Get("/api/legcache", hs.legCacheListing)
+	app.Delete("/api/legcache/:from/:to", hs.requireAdmin, hs.invalidateLegCache)
+	app.Get("/api/backup", hs.requireAdmin, hs.downloadBackup)
 	app.Use(filesystem.New(filesystem.Config{
 		Root:       http.FS(webAssets.Public),
 		PathPrefix: "public",
@@ -55,26 +119,15 @@ func (hs *httpServer) registerRoutes(app *fiber.App) {
 }
 
 type StockResponse struct {
-	Ok      bool   `json:"ok"`
-	Message string `json:"message,omitempty"`
-}
-
-func (hs *httpServer) newProcessor() (uuid.UUID, chan *util.SSEItem) {
-	hs.journeyProcessorLock.Lock()
-	id := uuid.New()
-	ch := make(chan *util.SSEItem, 16)
-	hs.journeyProcessors[id] = ch
-	hs.journeyProcessorLock.Unlock()
-	return id, ch
+	Ok      bool          `json:"ok"`
+	Message string        `json:"message,omitempty"`
+	Errors  []*FieldError `json:"errors,omitempty"`
 }
 
-func (hs *httpServer) cleanupProcessor(id uuid.UUID) {
-	hs.journeyProcessorLock.Lock()
-	ch, found := hs.journeyProcessors[id]
-	if !found {
-		return
-	}
-	close(ch)
-	delete(hs.journeyProcessors, id)
-	hs.journeyProcessorLock.Unlock()
+// FieldError describes a problem with a single field of a request body. Field is the path to the field in the
+// request body, for example "route[1][0]".
+type FieldError struct {
+	Field       string                      `json:"field"`
+	Message     string                      `json:"message"`
+	Suggestions []*core.StationSearchResult `json:"suggestions,omitempty"`
 }
@@ -0,0 +1,123 @@
+package httpsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+	"io"
+	"strings"
+)
+
+const importJobKind = "import"
+
+type importJob struct {
+	// UploadID is the ID of the upload containing the CSV file.
+	UploadID uuid.UUID           `json:"uploadID"`
+	Columns  *core.ImportColumns `json:"columns"`
+}
+
+// importJourneys accepts a CSV file as a multipart form upload in the "file" field. If the "dryRun" field is set to
+// true, a report of what would be imported is returned straight away. Otherwise, the import is run as a job.
+func (hs *httpServer) importJourneys(ctx *fiber.Ctx) error {
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "A CSV file must be uploaded in the file field",
+		})
+	}
+
+	cols, err := core.ParseImportColumns(ctx.FormValue("columns"))
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return util.Wrap(err, "opening uploaded file")
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return util.Wrap(err, "reading uploaded file")
+	}
+
+	userID := currentUser(ctx).ID
+
+	if strings.EqualFold(ctx.FormValue("dryRun"), "true") {
+		report, err := hs.core.ImportJourneys(context.Background(), userID, bytes.NewReader(content), cols, true, nil)
+		if err != nil {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return ctx.JSON(report)
+	}
+
+	uploadID, err := hs.core.CreateUpload(userID, content)
+	if err != nil {
+		return util.Wrap(err, "storing uploaded file")
+	}
+
+	job, err := hs.core.EnqueueJob(userID, importJobKind, &importJob{
+		UploadID: uploadID,
+		Columns:  cols,
+	})
+	if err != nil {
+		return util.Wrap(err, "enqueueing import job")
+	}
+
+	ctx.Status(202)
+	return ctx.JSON(&struct {
+		ProcessorID uuid.UUID `json:"processorID"`
+	}{job.ID})
+}
+
+// runImportJob imports a CSV file. The result of the job is the JSON-encoded import report. The uploaded file is
+// removed once the import succeeds. Otherwise, it's kept in case the job is retried and is removed later with old jobs.
+func (hs *httpServer) runImportJob(ctx context.Context, job *db.Job, output chan *util.SSEItem) (string, error) {
+	payload := new(importJob)
+	if err := core.DecodeJobPayload(job, payload); err != nil {
+		return "", util.Wrap(err, "decoding job payload")
+	}
+
+	content, err := hs.core.GetUpload(job.UserID, payload.UploadID)
+	if err != nil {
+		return "", util.Wrap(err, "fetching uploaded file")
+	}
+	if content == nil {
+		return "", errors.New("uploaded file no longer exists")
+	}
+
+	report, err := hs.core.ImportJourneys(ctx, job.UserID, bytes.NewReader(content), payload.Columns, false, output)
+	if err != nil {
+		return "", err
+	}
+
+	if err := hs.core.DeleteUpload(job.UserID, payload.UploadID); err != nil {
+		slog.Warn("unable to delete uploaded file", "upload", payload.UploadID, "err", err)
+	}
+
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		slog.Error("error when encoding import report", "err", err)
+		return "", errInternalServerError
+	}
+
+	return string(encoded), nil
+}
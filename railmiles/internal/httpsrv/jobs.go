@@ -0,0 +1,60 @@
+package httpsrv
+
+import (
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (hs *httpServer) getJob(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	job, err := hs.core.GetJob(currentUser(ctx).ID, id)
+	if err != nil {
+		return util.Wrap(err, "fetching job %s", id.String())
+	}
+
+	if job == nil {
+		return fiber.ErrNotFound
+	}
+
+	events, err := hs.core.GetJobEvents(id, 0)
+	if err != nil {
+		return util.Wrap(err, "fetching events for job %s", id.String())
+	}
+
+	return ctx.JSON(&struct {
+		*db.Job
+		Events []*db.JobEvent `json:"events"`
+	}{job, events})
+}
+
+func (hs *httpServer) cancelProcessor(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	if err := hs.core.CancelJob(currentUser(ctx).ID, id); err != nil {
+		if errors.Is(err, core.ErrJobNotFound) {
+			return fiber.ErrNotFound
+		}
+		if errors.Is(err, core.ErrJobFinished) {
+			ctx.Status(409)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: "Processor has already finished",
+			})
+		}
+		return util.Wrap(err, "cancelling job %s", id.String())
+	}
+
+	ctx.Status(204)
+	return nil
+}
@@ -3,15 +3,110 @@ package httpsrv
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/codemicro/railmiles/railmiles/internal/core"
 	"github.com/codemicro/railmiles/railmiles/internal/db"
 	"github.com/codemicro/railmiles/railmiles/internal/util"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
-	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// parseDateRange reads the period, from, to and tz query parameters, as described in core.ParseDateRange. The
+// timezone is returned as well so that it can be used for other date calculations.
+func parseDateRange(ctx *fiber.Ctx) (core.DateRange, *time.Location, error) {
+	loc, err := core.ParseTimezone(ctx.Query("tz"))
+	if err != nil {
+		return core.DateRange{}, nil, err
+	}
+
+	// start and end were the names used for from and to by earlier versions of the export endpoint, and are still
+	// accepted.
+	from := ctx.Query("from", ctx.Query("start"))
+	to := ctx.Query("to", ctx.Query("end"))
+
+	dr, err := core.ParseDateRange(ctx.Query("period"), from, to, loc)
+	if err != nil {
+		return core.DateRange{}, nil, err
+	}
+
+	return dr, loc, nil
+}
+
+// parseBoolQuery reads an optional true/false query parameter. nil is returned if the parameter is missing.
+func parseBoolQuery(ctx *fiber.Ctx, key string) (*bool, error) {
+	x := ctx.Query(key)
+	if x == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(x)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %#v (expected true or false)", key, x)
+	}
+	return &b, nil
+}
+
+func parseDistanceQuery(ctx *fiber.Ctx, key string) (float32, error) {
+	x := ctx.Query(key)
+	if x == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(x, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %#v", key, x)
+	}
+	return float32(f), nil
+}
+
+// parseJourneyFilter reads a core.JourneyFilter from the query parameters: the date range parameters read by
+// parseDateRange, as well as station, stationRole, minDistance, maxDistance, hasReturn and distance (manual or auto).
+func parseJourneyFilter(ctx *fiber.Ctx) (*core.JourneyFilter, error) {
+	var (
+		filter = new(core.JourneyFilter)
+		err    error
+	)
+
+	if filter.DateRange, _, err = parseDateRange(ctx); err != nil {
+		return nil, err
+	}
+
+	filter.Station = strings.TrimSpace(ctx.Query("station"))
+	if filter.StationRole, err = core.ParseStationRole(ctx.Query("stationRole")); err != nil {
+		return nil, err
+	}
+
+	if filter.MinDistance, err = parseDistanceQuery(ctx, "minDistance"); err != nil {
+		return nil, err
+	}
+	if filter.MaxDistance, err = parseDistanceQuery(ctx, "maxDistance"); err != nil {
+		return nil, err
+	}
+
+	if filter.HasReturn, err = parseBoolQuery(ctx, "hasReturn"); err != nil {
+		return nil, err
+	}
+
+	switch x := ctx.Query("distance"); x {
+	case "":
+	case "manual", "auto":
+		manual := x == "manual"
+		filter.ManualDistance = &manual
+	default:
+		return nil, fmt.Errorf("invalid distance %#v (expected manual or auto)", x)
+	}
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// journeyListing returns a page of the journeys matching the filter in the query parameters (see parseJourneyFilter).
+// Journeys are sorted by the sort parameter (date or distance) in the order given by order (asc or desc, default
+// desc).
 func (hs *httpServer) journeyListing(ctx *fiber.Ctx) error {
 	const pageSize = 20
 
@@ -23,27 +118,65 @@ func (hs *httpServer) journeyListing(ctx *fiber.Ctx) error {
 	}
 
 	var response = struct {
-		NumPages   int           `json:"numPages"`
-		PageNumber uint          `json:"pageNumber"`
-		Data       []*db.Journey `json:"data"`
+		NumPages   int                `json:"numPages"`
+		PageNumber uint               `json:"pageNumber"`
+		Stats      *core.JourneyStats `json:"stats"`
+		Data       []*db.Journey      `json:"data"`
+		// Delays contains the delay of each journey in Data where it is known, keyed by journey ID.
+		Delays map[uuid.UUID]*core.JourneyDelay `json:"delays"`
 	}{
 		PageNumber: pageNumber,
 	}
 
-	journeyStats, err := hs.core.GetJourneyStats(core.AllTime)
+	args := &core.GetJourneysArgs{
+		UserID: currentUser(ctx).ID,
+		Offset: int(pageSize * pageNumber),
+		Limit:  pageSize,
+	}
+
+	filter, err := parseJourneyFilter(ctx)
+	if err == nil {
+		args.JourneyFilter = *filter
+		args.SortBy, err = core.ParseJourneySort(ctx.Query("sort"))
+	}
+	if err == nil {
+		switch order := ctx.Query("order"); order {
+		case "asc":
+			args.Ascending = true
+		case "", "desc":
+		default:
+			err = fmt.Errorf("invalid order %#v (expected asc or desc)", order)
+		}
+	}
+	if err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
+
+	journeyStats, err := hs.core.GetJourneyStats(args.UserID, filter)
 	if err != nil {
 		return util.Wrap(err, "getting all journey stats")
 	}
+	response.Stats = journeyStats
 
-	response.NumPages = int(math.Ceil(float64(journeyStats.Count/pageSize))) + 1
+	// There's always at least one page, even if it's empty.
+	response.NumPages = max(1, (journeyStats.Count+pageSize-1)/pageSize)
 
-	if !(int(pageNumber*pageSize) > journeyStats.Count) {
-		journeys, err := hs.core.GetJourneys(&core.GetJourneysArgs{Offset: int(pageSize * pageNumber), Limit: pageSize})
+	if int(pageNumber*pageSize) < journeyStats.Count {
+		journeys, err := hs.core.GetJourneys(args)
 		if err != nil {
 			return util.Wrap(err, "getting paginated journeys")
 		}
 		core.PopulateFullStationNames(journeys)
 		response.Data = journeys
+
+		response.Delays, err = hs.core.GetJourneyDelays(journeys)
+		if err != nil {
+			return util.Wrap(err, "getting journey delays")
+		}
 	}
 
 	return ctx.JSON(response)
@@ -53,6 +186,11 @@ func (hs *httpServer) getJourney(ctx *fiber.Ctx) error {
 	var response = struct {
 		GeoJSON json.RawMessage `json:"geoJSON"`
 		Data    *db.Journey     `json:"data"`
+		Legs    []*db.Leg       `json:"legs"`
+		// Delay is only set if the arrival time of the journey is known.
+		Delay  *core.JourneyDelay  `json:"delay,omitempty"`
+		Claim  *db.Claim           `json:"claim,omitempty"`
+		Ticket *core.JourneyTicket `json:"ticket,omitempty"`
 	}{}
 
 	id, err := uuid.Parse(ctx.Params("id"))
@@ -60,7 +198,7 @@ func (hs *httpServer) getJourney(ctx *fiber.Ctx) error {
 		return fiber.ErrNotFound
 	}
 
-	journey, err := hs.core.GetJourney(id)
+	journey, err := hs.core.GetJourney(currentUser(ctx).ID, id)
 	if err != nil {
 		return util.Wrap(err, "fetching journey %s", id.String())
 	}
@@ -73,6 +211,22 @@ func (hs *httpServer) getJourney(ctx *fiber.Ctx) error {
 	core.PopulateFullStationNames(ja)
 
 	response.Data = journey
+	response.Legs, err = hs.core.GetLegs(journey.ID)
+	if err != nil {
+		return util.Wrap(err, "fetching legs of journey %s", id.String())
+	}
+	response.Delay, err = hs.core.GetJourneyDelay(journey)
+	if err != nil {
+		return util.Wrap(err, "fetching delay of journey %s", id.String())
+	}
+	response.Claim, err = hs.core.GetClaim(journey.UserID, journey.ID)
+	if err != nil {
+		return util.Wrap(err, "fetching claim for journey %s", id.String())
+	}
+	response.Ticket, err = hs.core.GetJourneyTicket(journey)
+	if err != nil {
+		return util.Wrap(err, "fetching ticket for journey %s", id.String())
+	}
 	response.GeoJSON = []byte(hs.core.GenerateJourneyGeoJSON(ja, true))
 
 	return ctx.JSON(&response)
@@ -84,7 +238,7 @@ func (hs *httpServer) deleteJourney(ctx *fiber.Ctx) error {
 		return fiber.ErrNotFound
 	}
 
-	if err := hs.core.DeleteJourney(id); err != nil {
+	if err := hs.core.DeleteJourney(currentUser(ctx).ID, id); err != nil {
 		return util.Wrap(err, "deleting journey %s", id.String())
 	}
 
@@ -98,7 +252,7 @@ func (hs *httpServer) createReturnJourney(ctx *fiber.Ctx) error {
 		return fiber.ErrNotFound
 	}
 
-	newID, err := hs.core.CreateReturnJourney(id)
+	newID, err := hs.core.CreateReturnJourney(currentUser(ctx).ID, id)
 	if err != nil {
 		if errors.Is(err, core.ErrReturnAlreadyExists) {
 			ctx.Status(409)
@@ -0,0 +1,32 @@
+package httpsrv
+
+import (
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+)
+
+func (hs *httpServer) legCacheListing(ctx *fiber.Ctx) error {
+	entries, err := hs.core.GetLegCache()
+	if err != nil {
+		return util.Wrap(err, "fetching leg cache")
+	}
+	return ctx.JSON(entries)
+}
+
+func (hs *httpServer) invalidateLegCache(ctx *fiber.Ctx) error {
+	from := strings.ToUpper(ctx.Params("from"))
+	to := strings.ToUpper(ctx.Params("to"))
+
+	n, err := hs.core.InvalidateLegCache(from, to)
+	if err != nil {
+		return util.Wrap(err, "invalidating leg cache for %s->%s", from, to)
+	}
+
+	if n == 0 {
+		return fiber.ErrNotFound
+	}
+
+	ctx.Status(204)
+	return nil
+}
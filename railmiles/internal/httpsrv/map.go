@@ -0,0 +1,70 @@
+package httpsrv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (hs *httpServer) journeyMap(ctx *fiber.Ctx) error {
+	return hs.serveJourneyMap(ctx, currentUser(ctx).ID)
+}
+
+func (hs *httpServer) sharedJourneyMap(ctx *fiber.Ctx) error {
+	user, err := hs.core.GetUserByShareToken(ctx.Params("token"))
+	if err != nil {
+		return util.Wrap(err, "fetching user by share token")
+	}
+
+	if user == nil {
+		return fiber.ErrNotFound
+	}
+
+	return hs.serveJourneyMap(ctx, user.ID)
+}
+
+// serveJourneyMap renders a map of a user's journeys. The query parameters format (svg or png), width, height and
+// labels are accepted, as well as those read by parseDateRange.
+func (hs *httpServer) serveJourneyMap(ctx *fiber.Ctx, userID uuid.UUID) error {
+	badRequest := func(err error) error {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: err.Error(),
+		})
+	}
+
+	format, err := core.ParseMapFormat(ctx.Query("format", "svg"))
+	if err != nil {
+		return badRequest(err)
+	}
+
+	dr, _, err := parseDateRange(ctx)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	opts := &core.MapOptions{
+		Format:    format,
+		Width:     ctx.QueryInt("width", 800),
+		Height:    ctx.QueryInt("height", 1000),
+		Labels:    ctx.QueryBool("labels", false),
+		DateRange: dr,
+	}
+
+	if err := opts.Validate(); err != nil {
+		return badRequest(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := hs.core.RenderJourneyMap(buf, userID, opts); err != nil {
+		return util.Wrap(err, "rendering map")
+	}
+
+	ctx.Set("Content-Type", format.ContentType())
+	ctx.Set("Content-Disposition", fmt.Sprintf(`inline; filename="railmiles-map.%s"`, format))
+	return ctx.Send(buf.Bytes())
+}
@@ -2,7 +2,9 @@ package httpsrv
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/codemicro/railmiles/railmiles/internal/core"
 	"github.com/codemicro/railmiles/railmiles/internal/db"
@@ -21,6 +23,14 @@ type newJourneyRequest struct {
 	CreateReturn   bool       `json:"createReturn"`
 }
 
+const newJourneyJobKind = "newJourney"
+
+type newJourneyJob struct {
+	Request   *newJourneyRequest `json:"request"`
+	Locations []string           `json:"locations"`
+	Services  []string           `json:"services"`
+}
+
 func (hs *httpServer) newJourney(ctx *fiber.Ctx) error {
 	if !strings.EqualFold(ctx.Get("Content-Type"), "application/json") {
 		ctx.Status(400)
@@ -50,147 +60,208 @@ func (hs *httpServer) newJourney(ctx *fiber.Ctx) error {
 
 	requestBody.Date = requestBody.Date.UTC()
 
+	locations, services, problem := parseRoute(requestBody.Route, requestBody.Date, requestBody.ManualDistance != 0)
+	if problem != "" {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: problem,
+		})
+	}
+
+	if ok, err := hs.checkRouteStations(ctx, locations); !ok || err != nil {
+		return err
+	}
+
+	job, err := hs.core.EnqueueJob(currentUser(ctx).ID, newJourneyJobKind, &newJourneyJob{
+		Request:   requestBody,
+		Locations: locations,
+		Services:  services,
+	})
+	if err != nil {
+		return util.Wrap(err, "enqueueing new journey job")
+	}
+
+	ctx.Status(202)
+	return ctx.JSON(&struct {
+		ProcessorID uuid.UUID `json:"processorID"`
+	}{job.ID})
+}
+
+// parseRoute splits a route from a request body into a list of station codes and a list of service UIDs. If the route
+// is invalid, a message describing the problem is returned.
+func parseRoute(route [][]string, date time.Time, hasManualDistance bool) ([]string, []string, string) {
+	if len(route) < 2 {
+		return nil, nil, "A route must contain at least two stations"
+	}
+
 	var (
-		needsServiceUID = time.Now().UTC().Truncate(24*time.Hour) != requestBody.Date.Truncate(24*time.Hour)
+		needsServiceUID = time.Now().UTC().Truncate(24*time.Hour) != date.Truncate(24*time.Hour)
 		locations       []string
 		services        []string
 	)
 
-	{
-		for i, line := range requestBody.Route {
-			if line[1] == "" {
-				if needsServiceUID && i != len(requestBody.Route)-1 && requestBody.ManualDistance == 0 {
-					ctx.Status(400)
-					return ctx.JSON(StockResponse{
-						Ok:      false,
-						Message: "Service UIDs required as services were run on a different day to today",
-					})
-				}
-				services = append(services, "")
-			} else {
-				services = append(services, strings.TrimSpace(line[1]))
+	for i, line := range route {
+		if len(line) != 2 {
+			return nil, nil, "Malformed route"
+		}
+		if line[1] == "" {
+			if needsServiceUID && i != len(route)-1 && !hasManualDistance {
+				return nil, nil, "Service UIDs required as services were run on a different day to today"
 			}
-			locations = append(locations, strings.ToUpper(strings.TrimSpace(line[0])))
+			services = append(services, "")
+		} else {
+			services = append(services, strings.TrimSpace(line[1]))
 		}
+		locations = append(locations, strings.ToUpper(strings.TrimSpace(line[0])))
 	}
 
-	pid, ch := hs.newProcessor()
+	return locations, services, ""
+}
 
-	go hs.processNewJourney(requestBody, locations, services, pid, ch)
+// checkRouteStations replaces the station codes in locations, which came from the route in a request body, with the
+// CRS codes of the stations they refer to. If any of them aren't known, a response listing them is sent and false is
+// returned.
+func (hs *httpServer) checkRouteStations(ctx *fiber.Ctx, locations []string) (bool, error) {
+	var fieldErrors []*FieldError
+	for i, location := range locations {
+		code, err := hs.core.CheckStationCode(currentUser(ctx).ID, location)
+		if err != nil {
+			var use *core.UnknownStationError
+			if !errors.As(err, &use) {
+				return false, util.Wrap(err, "checking station %#v", location)
+			}
+			fieldErrors = append(fieldErrors, &FieldError{
+				Field:       fmt.Sprintf("route[%d][0]", i),
+				Message:     use.Error(),
+				Suggestions: use.Suggestions,
+			})
+			continue
+		}
+		locations[i] = code
+	}
 
-	ctx.Status(202)
-	return ctx.JSON(&struct {
-		ProcessorID uuid.UUID `json:"processorID"`
-	}{pid})
+	if len(fieldErrors) == 0 {
+		return true, nil
+	}
+
+	ctx.Status(400)
+	return false, ctx.JSON(StockResponse{
+		Ok:      false,
+		Message: strings.Join(util.Map(fieldErrors, func(x *FieldError) string { return x.Message }), "; "),
+		Errors:  fieldErrors,
+	})
 }
 
-func (hs *httpServer) processNewJourney(requestBody *newJourneyRequest, locations, services []string, processID uuid.UUID, output chan *util.SSEItem) {
-	defer func() {
-		// In some cases, if we have a simple journey to process (eg. one with a predefined length that needs no
-		// external API calls), it can be processed, inserted and the stream cleaned up before the client has the time
-		// to roundtrip and make that initial request. This then means the client gets a 404 when requesting the stream
-		// and just does nothing. Adding a delay here prevents that 404.
-		go func() {
-			time.Sleep(time.Second * 10)
-			hs.cleanupProcessor(processID)
-		}()
-	}()
+func (hs *httpServer) runNewJourneyJob(ctx context.Context, job *db.Job, output chan *util.SSEItem) (string, error) {
+	payload := new(newJourneyJob)
+	if err := core.DecodeJobPayload(job, payload); err != nil {
+		return "", util.Wrap(err, "decoding job payload")
+	}
+
+	var (
+		requestBody = payload.Request
+		locations   = payload.Locations
+	)
 
 	dist := new(core.DistanceWithRoute)
 	if requestBody.ManualDistance != 0 {
 		dist.Distance = requestBody.ManualDistance
+		dist.Legs = core.ManualLegs(locations, payload.Services, dist.Distance)
 	} else {
 		var err error
-		dist, err = hs.core.GetRouteDistance(locations, services, requestBody.Date, output)
+		dist, err = hs.core.GetRouteDistance(ctx, locations, payload.Services, requestBody.Date, output)
 		if err != nil {
-			output <- &util.SSEItem{
-				Event:   "error",
-				Message: "Unable to fetch distance: " + err.Error(),
-			}
-			return
+			return "", fmt.Errorf("Unable to fetch distance: %w", err)
 		}
 	}
 
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	var via []string
 	if len(locations) > 2 {
 		via = locations[1 : len(locations)-1]
 	}
 
 	j := &db.Journey{
-		ID:   uuid.New(),
-		From: &db.StationName{Shortcode: locations[0]},
-		To:   &db.StationName{Shortcode: locations[len(locations)-1]},
+		ID:     uuid.New(),
+		UserID: job.UserID,
+		From:   &db.StationName{Shortcode: locations[0]},
+		To:     &db.StationName{Shortcode: locations[len(locations)-1]},
 		Via: util.Map(via, func(x string) *db.StationName {
 			return &db.StationName{Shortcode: x}
 		}),
-		Distance: dist.Distance,
-		Date:     requestBody.Date,
+		Distance:         dist.Distance,
+		Date:             requestBody.Date,
+		ManualDistance:   requestBody.ManualDistance != 0,
+		InferredDistance: dist.Inferred,
 	}
 
-	if err := hs.core.InsertJourney(j); err != nil {
-		slog.Error("error when inserting new journey", "err", err)
-		output <- &util.SSEItem{
-			Event:   "error",
-			Message: "Internal Server Error",
-		}
-		return
+	if err := hs.core.CreateJourney(j, dist.Route, dist.Legs, requestBody.CreateReturn); err != nil {
+		slog.Error("error when creating new journey", "err", err)
+		return "", errInternalServerError
 	}
 
-	if len(dist.Route) != 0 {
-		if err := hs.core.InsertRoute(j.ID, dist.Route); err != nil {
-			slog.Error("error when inserting new journey route", "err", err)
-			output <- &util.SSEItem{
-				Event:   "error",
-				Message: "Internal Server Error",
-			}
-			return
-		}
-	}
-
-	if requestBody.CreateReturn {
-		_, err := hs.core.CreateReturnJourney(j.ID)
-		if err != nil {
-			slog.Error("error when creating return journey", "err", err)
-			output <- &util.SSEItem{
-				Event:   "error",
-				Message: "Internal Server Error",
-			}
-			return
-		}
-	}
-
-	output <- &util.SSEItem{
-		Event:   "finished",
-		Message: j.ID.String(),
-	}
+	return j.ID.String(), nil
 }
 
+// serveProcessorStream streams the events of a job as server-sent events. Events that were recorded before the client
+// connected are replayed first, so it doesn't matter how late a client subscribes.
 func (hs *httpServer) serveProcessorStream(ctx *fiber.Ctx) error {
-	idStr := ctx.Params("id")
-	id, err := uuid.Parse(idStr)
+	id, err := uuid.Parse(ctx.Params("id"))
 	if err != nil {
-		fmt.Println(err)
 		return fiber.ErrNotFound
 	}
 
-	hs.journeyProcessorLock.Lock()
-	channel, found := hs.journeyProcessors[id]
-	hs.journeyProcessorLock.Unlock()
+	// Subscribing before fetching the job means that if it finishes in the meantime, we'll still find out about it.
+	notify, unsubscribe := hs.core.SubscribeJob(id)
 
-	if !found {
+	job, err := hs.core.GetJob(currentUser(ctx).ID, id)
+	if err != nil {
+		unsubscribe()
+		return util.Wrap(err, "fetching job %s", id.String())
+	}
+
+	if job == nil {
+		unsubscribe()
 		return fiber.ErrNotFound
 	}
 
 	ctx.Set("Content-Type", "text/event-stream")
 	fr := ctx.Response()
 	fr.SetBodyStreamWriter(func(w *bufio.Writer) {
-		for item := range channel {
-			_, _ = w.Write([]byte(item.String()))
-			if err := w.Flush(); err != nil {
-				// client disconnected
+		defer unsubscribe()
+
+		var lastID int64
+		catchUp := func() bool {
+			events, err := hs.core.GetJobEvents(id, lastID)
+			if err != nil {
+				slog.Error("unable to fetch job events", "job", id, "err", err)
+				return false
+			}
+			for _, event := range events {
+				_, _ = w.Write([]byte((&util.SSEItem{Event: event.Event, Message: event.Message}).String()))
+				lastID = event.ID
+			}
+			// an error here means the client disconnected
+			return w.Flush() == nil
+		}
+
+		if !catchUp() || job.Finished() {
+			return
+		}
+
+		// Events from the subscription are only used as a prompt to read from the database, since some may have been
+		// dropped.
+		for range notify {
+			if !catchUp() {
 				return
 			}
 		}
+
+		catchUp()
 	})
 	return nil
 }
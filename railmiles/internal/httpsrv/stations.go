@@ -0,0 +1,176 @@
+package httpsrv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+)
+
+func (hs *httpServer) stationListing(ctx *fiber.Ctx) error {
+	stations, err := hs.core.GetStationStats(currentUser(ctx).ID)
+	if err != nil {
+		return util.Wrap(err, "fetching station stats")
+	}
+	return ctx.JSON(stations)
+}
+
+// searchStations finds stations matching the q query parameter. Up to limit results are returned.
+func (hs *httpServer) searchStations(ctx *fiber.Ctx) error {
+	results, err := hs.core.SearchStations(currentUser(ctx).ID, ctx.Query("q"), ctx.QueryInt("limit", core.DefaultStationSearchLimit))
+	if err != nil {
+		return util.Wrap(err, "searching stations")
+	}
+	if results == nil {
+		results = []*core.StationSearchResult{}
+	}
+	return ctx.JSON(results)
+}
+
+func (hs *httpServer) unvisitedStations(ctx *fiber.Ctx) error {
+	geoJSON, err := hs.core.UnvisitedStationsGeoJSON(currentUser(ctx).ID)
+	if err != nil {
+		return util.Wrap(err, "generating unvisited stations GeoJSON")
+	}
+	ctx.Set(fiber.HeaderContentType, "application/geo+json")
+	return ctx.SendString(geoJSON)
+}
+
+func (hs *httpServer) getStation(ctx *fiber.Ctx) error {
+	var response = struct {
+		Station  *core.StationStats `json:"station"`
+		GeoJSON  json.RawMessage    `json:"geoJSON"`
+		Journeys []*db.Journey      `json:"journeys"`
+	}{}
+
+	code := strings.ToUpper(ctx.Params("code"))
+	if resolved, found := core.ResolveStationCode(code); found {
+		code = resolved
+	}
+	userID := currentUser(ctx).ID
+
+	stats, err := hs.core.GetSingleStationStats(userID, code)
+	if err != nil {
+		return util.Wrap(err, "fetching stats for station %s", code)
+	}
+
+	if stats == nil {
+		// Stations that haven't been visited yet still have a page so long as we know about them.
+		details := core.GetStationDetail(code)
+		if details == nil {
+			return fiber.ErrNotFound
+		}
+		stats = &core.StationStats{
+			Shortcode: code,
+			Name:      details.Name,
+			Lat:       details.Lat,
+			Lon:       details.Lon,
+		}
+	}
+
+	journeys, err := hs.core.GetJourneys(&core.GetJourneysArgs{UserID: userID, JourneyFilter: core.JourneyFilter{Station: code}})
+	if err != nil {
+		return util.Wrap(err, "fetching journeys for station %s", code)
+	}
+	core.PopulateFullStationNames(journeys)
+
+	response.Station = stats
+	response.Journeys = journeys
+	response.GeoJSON = []byte(hs.core.GenerateJourneyGeoJSON(journeys, false))
+
+	return ctx.JSON(&response)
+}
+
+func (hs *httpServer) customStationListing(ctx *fiber.Ctx) error {
+	stations, err := hs.core.GetCustomStations()
+	if err != nil {
+		return util.Wrap(err, "fetching custom stations")
+	}
+	return ctx.JSON(stations)
+}
+
+func (hs *httpServer) putStation(ctx *fiber.Ctx) error {
+	station := new(db.Station)
+	if err := json.Unmarshal(ctx.Body(), station); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+	station.Code = ctx.Params("code")
+
+	if err := hs.core.PutStation(station); err != nil {
+		if errors.Is(err, core.ErrInvalidStation) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return util.Wrap(err, "saving station %s", station.Code)
+	}
+
+	return ctx.JSON(station)
+}
+
+func (hs *httpServer) resetStation(ctx *fiber.Ctx) error {
+	code := strings.ToUpper(ctx.Params("code"))
+	if err := hs.core.ResetStation(code); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fiber.ErrNotFound
+		}
+		return util.Wrap(err, "resetting station %s", code)
+	}
+	ctx.Status(204)
+	return nil
+}
+
+func (hs *httpServer) stationAliasListing(ctx *fiber.Ctx) error {
+	aliases, err := hs.core.GetStationAliases()
+	if err != nil {
+		return util.Wrap(err, "fetching station aliases")
+	}
+	return ctx.JSON(aliases)
+}
+
+func (hs *httpServer) putStationAlias(ctx *fiber.Ctx) error {
+	alias := new(db.StationAlias)
+	if err := json.Unmarshal(ctx.Body(), alias); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+	alias.Alias = ctx.Params("alias")
+
+	if err := hs.core.PutStationAlias(alias); err != nil {
+		if errors.Is(err, core.ErrInvalidStation) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return util.Wrap(err, "saving station alias %s", alias.Alias)
+	}
+
+	return ctx.JSON(alias)
+}
+
+func (hs *httpServer) deleteStationAlias(ctx *fiber.Ctx) error {
+	alias := strings.ToUpper(ctx.Params("alias"))
+	if err := hs.core.DeleteStationAlias(alias); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fiber.ErrNotFound
+		}
+		return util.Wrap(err, "deleting station alias %s", alias)
+	}
+	ctx.Status(204)
+	return nil
+}
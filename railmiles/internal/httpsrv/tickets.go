@@ -0,0 +1,79 @@
+package httpsrv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/db"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type putTicketRequest struct {
+	db.Ticket
+	ShareWithReturn bool `json:"shareWithReturn"`
+}
+
+func (hs *httpServer) putTicket(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	requestBody := new(putTicketRequest)
+	if err := json.Unmarshal(ctx.Body(), requestBody); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+
+	userID := currentUser(ctx).ID
+	if err := hs.core.PutTicket(userID, id, &requestBody.Ticket, requestBody.ShareWithReturn); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fiber.ErrNotFound
+		}
+		if errors.Is(err, core.ErrInvalidTicket) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return util.Wrap(err, "saving ticket for journey %s", id.String())
+	}
+
+	journey, err := hs.core.GetJourney(userID, id)
+	if err != nil {
+		return util.Wrap(err, "fetching journey %s", id.String())
+	}
+	if journey == nil {
+		return fiber.ErrNotFound
+	}
+
+	ticket, err := hs.core.GetJourneyTicket(journey)
+	if err != nil {
+		return util.Wrap(err, "fetching ticket for journey %s", id.String())
+	}
+	return ctx.JSON(ticket)
+}
+
+func (hs *httpServer) deleteTicket(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	if err := hs.core.DeleteTicket(currentUser(ctx).ID, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fiber.ErrNotFound
+		}
+		return util.Wrap(err, "deleting ticket for journey %s", id.String())
+	}
+
+	ctx.Status(204)
+	return nil
+}
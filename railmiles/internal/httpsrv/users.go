@@ -0,0 +1,137 @@
+package httpsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/codemicro/railmiles/railmiles/internal/core"
+	"github.com/codemicro/railmiles/railmiles/internal/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"strings"
+)
+
+func (hs *httpServer) userListing(ctx *fiber.Ctx) error {
+	users, err := hs.core.GetUsers()
+	if err != nil {
+		return util.Wrap(err, "fetching users")
+	}
+	return ctx.JSON(users)
+}
+
+func (hs *httpServer) newUser(ctx *fiber.Ctx) error {
+	if !strings.EqualFold(ctx.Get("Content-Type"), "application/json") {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "invalid Content-Type (requires application/json)",
+		})
+	}
+
+	requestBody := new(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		IsAdmin  bool   `json:"isAdmin"`
+	})
+
+	if err := json.Unmarshal(ctx.Body(), &requestBody); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+
+	user, err := hs.core.CreateUser(requestBody.Username, requestBody.Password, requestBody.IsAdmin)
+	if err != nil {
+		if errors.Is(err, core.ErrInvalidUsername) || errors.Is(err, core.ErrInvalidPassword) || errors.Is(err, core.ErrUsernameTaken) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return util.Wrap(err, "creating user")
+	}
+
+	ctx.Status(201)
+	return ctx.JSON(user)
+}
+
+func (hs *httpServer) deleteUser(ctx *fiber.Ctx) error {
+	id, err := uuid.Parse(ctx.Params("id"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+
+	if err := hs.core.DeleteUser(id); err != nil {
+		if errors.Is(err, core.ErrUserNotFound) {
+			return fiber.ErrNotFound
+		}
+		if errors.Is(err, core.ErrCannotDeleteAdmin) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return util.Wrap(err, "deleting user %s", id.String())
+	}
+
+	ctx.Status(204)
+	return nil
+}
+
+func (hs *httpServer) changePassword(ctx *fiber.Ctx) error {
+	if !strings.EqualFold(ctx.Get("Content-Type"), "application/json") {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "invalid Content-Type (requires application/json)",
+		})
+	}
+
+	requestBody := new(struct {
+		CurrentPassword string `json:"currentPassword"`
+		Password        string `json:"password"`
+	})
+
+	if err := json.Unmarshal(ctx.Body(), &requestBody); err != nil {
+		ctx.Status(400)
+		return ctx.JSON(StockResponse{
+			Ok:      false,
+			Message: "unable to parse request body",
+		})
+	}
+
+	if err := hs.core.ChangePassword(currentUser(ctx).ID, requestBody.CurrentPassword, requestBody.Password); err != nil {
+		if errors.Is(err, core.ErrInvalidPassword) || errors.Is(err, core.ErrIncorrectPassword) {
+			ctx.Status(400)
+			return ctx.JSON(StockResponse{
+				Ok:      false,
+				Message: err.Error(),
+			})
+		}
+		return util.Wrap(err, "changing password")
+	}
+
+	ctx.Status(204)
+	return nil
+}
+
+func (hs *httpServer) enableSharing(ctx *fiber.Ctx) error {
+	token, err := hs.core.EnableSharing(currentUser(ctx).ID)
+	if err != nil {
+		return util.Wrap(err, "enabling sharing")
+	}
+	return ctx.JSON(&struct {
+		Token string `json:"token"`
+	}{token})
+}
+
+func (hs *httpServer) disableSharing(ctx *fiber.Ctx) error {
+	if err := hs.core.DisableSharing(currentUser(ctx).ID); err != nil {
+		return util.Wrap(err, "disabling sharing")
+	}
+	ctx.Status(204)
+	return nil
+}
@@ -3,6 +3,7 @@ package util
 import (
 	"errors"
 	"fmt"
+	"math"
 )
 
 type UserError error
@@ -42,3 +43,16 @@ func ChainsToMiles(chains int) float32 {
 	// 80 chains to a mile
 	return float32(chains) / 80
 }
+
+// HaversineMiles returns the great-circle distance in miles between two points.
+func HaversineMiles(lat1, lon1, lat2, lon2 float32) float64 {
+	const earthRadiusMiles = 3958.8
+
+	toRad := func(x float32) float64 { return float64(x) * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(h))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/codemicro/railmiles/railmiles/internal/config"
 	"github.com/codemicro/railmiles/railmiles/internal/core"
 	"github.com/codemicro/railmiles/railmiles/internal/db"
@@ -8,6 +9,7 @@ import (
 	"github.com/codemicro/railmiles/railmiles/internal/util"
 	"golang.org/x/exp/slog"
 	"os"
+	_ "time/tzdata" // the Docker image doesn't include a timezone database
 )
 
 func main() {
@@ -23,6 +25,10 @@ func run() error {
 		return util.Wrap(err, "loading configuration")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		return runRestore(conf, os.Args[2:])
+	}
+
 	database, err := db.New(conf)
 	if err != nil {
 		return util.Wrap(err, "opening database")
@@ -32,7 +38,27 @@ func run() error {
 		return util.Wrap(err, "migrating database")
 	}
 
-	c := core.New(conf, database)
+	c, err := core.New(conf, database)
+	if err != nil {
+		return util.Wrap(err, "initialising core")
+	}
+
+	if err := c.BootstrapAdminUser(); err != nil {
+		return util.Wrap(err, "setting up admin user")
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			return runImport(conf, c, os.Args[2:])
+		case "export":
+			return runExport(conf, c, os.Args[2:])
+		case "backup":
+			return runBackup(c, os.Args[2:])
+		default:
+			return fmt.Errorf("unknown command %#v", os.Args[1])
+		}
+	}
 
 	return httpsrv.Run(conf, c)
 }
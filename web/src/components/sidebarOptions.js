@@ -9,9 +9,44 @@ export default [
         icon: "table",
         path: "/journeys",
     },
+    {
+        name: "Stations",
+        icon: "geo-alt",
+        path: "/stations",
+    },
+    {
+        name: "Delay Repay",
+        icon: "cash-coin",
+        path: "/claims",
+    },
     {
         name: "Log new journey",
         icon: "plus-lg",
         path: "/new"
+    },
+    {
+        name: "Import journeys",
+        icon: "upload",
+        path: "/import",
+    },
+    {
+        name: "Export journeys",
+        icon: "download",
+        path: "/export",
+    },
+    {
+        name: "API tokens",
+        icon: "key",
+        path: "/tokens",
+    },
+    {
+        name: "Account",
+        icon: "person-circle",
+        path: "/account",
+    },
+    {
+        name: "Sign out",
+        icon: "box-arrow-right",
+        path: "/logout",
     }
 ]
\ No newline at end of file
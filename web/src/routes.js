@@ -3,11 +3,37 @@ import JourneyListing from './routes/JourneyListing.svelte'
 import NewJourney from "./routes/NewJourney.svelte";
 import NotFound from './routes/NotFound.svelte'
 import JourneyDetail from "./routes/JourneyDetail.svelte";
+import EditJourney from "./routes/EditJourney.svelte";
+import Login from "./routes/Login.svelte";
+import Logout from "./routes/Logout.svelte";
+import Tokens from "./routes/Tokens.svelte";
+import Account from "./routes/Account.svelte";
+import Import from "./routes/Import.svelte";
+import Export from "./routes/Export.svelte";
+import Users from "./routes/Users.svelte";
+import SharedDashboard from "./routes/SharedDashboard.svelte";
+import Stations from "./routes/Stations.svelte";
+import StationDetail from "./routes/StationDetail.svelte";
+import StationsAdmin from "./routes/StationsAdmin.svelte";
+import Claims from "./routes/Claims.svelte";
 
 export default {
     '/': Home,
     '/journeys': JourneyListing,
     '/journeys/:id': JourneyDetail,
+    '/journeys/:id/edit': EditJourney,
     '/new': NewJourney,
+    '/stations': Stations,
+    '/stations/:code': StationDetail,
+    '/claims': Claims,
+    '/import': Import,
+    '/export': Export,
+    '/tokens': Tokens,
+    '/account': Account,
+    '/users': Users,
+    '/admin/stations': StationsAdmin,
+    '/shared/:token': SharedDashboard,
+    '/login': Login,
+    '/logout': Logout,
     '*': NotFound,
 }
\ No newline at end of file
@@ -34,6 +34,25 @@ export const formatDate = (date) => {
     return new Date(Date.parse(date)).toLocaleDateString(undefined, dateFormat)
 }
 
+const timeFormat = {hour: '2-digit', minute: '2-digit'};
+
+export const formatTime = (date) => {
+    return new Date(Date.parse(date)).toLocaleTimeString(undefined, timeFormat)
+}
+
+export const formatPence = (pence) => {
+    return "£" + (pence / 100).toFixed(2)
+}
+
+// formatSpend describes the amount spent on the journeys counted in a set of journey stats.
+export const formatSpend = (stats) => {
+    return formatPence(stats.spend) + " spent, " + roundFloat(stats.pencePerMile, 1) + "p per mile"
+}
+
+export const delayLabel = (delay) => {
+    return delay.threshold + "+ min late"
+}
+
 function debounce(func, wait, immediate) {
     let timeout;
 